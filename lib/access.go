@@ -0,0 +1,183 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"main/lib/log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Local http server access: client CIDR allowlists per route group and application credentials
+
+const (
+	RouteGroupProxy   = "proxy"
+	RouteGroupLog     = "log"
+	RouteGroupApp     = "app"
+	RouteGroupApi     = "api"
+	RouteGroupMetrics = "metrics"
+)
+
+func clientIp(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// clientAllowed checks client address against CIDRs of route group, group without list allows any client
+func (service *AgentServiceWrap) clientAllowed(group string, req *http.Request) bool {
+	cidrs := service.Settings.HttpAllow[group]
+	if len(cidrs) == 0 {
+		return true
+	}
+	ip := clientIp(req)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if allowed := net.ParseIP(cidr); allowed != nil && allowed.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Log.Warn().Err(err).Str("Group", group).Msg("Invalid CIDR in http_allow")
+			continue
+		}
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate returns ExternalKey of application presenting valid bearer token or client certificate
+func (service *AgentServiceWrap) authenticate(req *http.Request) (string, bool) {
+	authorization := req.Header.Get("Authorization")
+	if token := strings.TrimPrefix(authorization, "Bearer "); token != authorization && token != "" {
+		sum := sha256.Sum256([]byte(token))
+		for extKey, client := range service.Settings.HttpClients {
+			if client == nil {
+				continue
+			}
+			expected, err := hex.DecodeString(client.TokenSha256)
+			if err != nil || len(expected) == 0 {
+				continue
+			}
+			if subtle.ConstantTimeCompare(sum[:], expected) == 1 {
+				return extKey, true
+			}
+		}
+	}
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		commonName := req.TLS.VerifiedChains[0][0].Subject.CommonName
+		for extKey, client := range service.Settings.HttpClients {
+			if client != nil && (client.CertCN == commonName || (client.CertCN == "" && extKey == commonName)) {
+				return extKey, true
+			}
+		}
+	}
+	return "", false
+}
+
+// guard applies allowlist of route group and, when withAuth is set and application credentials are configured,
+// requires them; keyOf extracts ExternalKey request must be scoped to (required), nil allows any application
+func (service *AgentServiceWrap) guard(group string, withAuth bool, keyOf func(req *http.Request) string,
+	next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !service.clientAllowed(group, req) {
+			log.Log.Warn().Str("Client", req.RemoteAddr).Str("Group", group).
+				Msgf("Client not allowed: %s %s", req.Method, req.URL.Path)
+			_ = WriteJsonResponse(w, http.StatusForbidden, map[string]any{"msg": "forbidden"})
+			return
+		}
+		if keyOf != nil && keyOf(req) == "" {
+			_ = WriteJsonResponse(w, http.StatusBadRequest, map[string]any{"msg": "ext_key is required"})
+			return
+		}
+		if withAuth && len(service.Settings.HttpClients) > 0 {
+			extKey, ok := service.authenticate(req)
+			if ok && keyOf != nil && keyOf(req) != extKey {
+				ok = false
+			}
+			if !ok {
+				log.Log.Warn().Str("Client", req.RemoteAddr).Str("Group", group).
+					Msgf("Authentication failed: %s %s", req.Method, req.URL.Path)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="pca"`)
+				_ = WriteJsonResponse(w, http.StatusUnauthorized, map[string]any{"msg": "unauthorized"})
+				return
+			}
+		}
+		next(w, req)
+	}
+}
+
+// serveHttp starts local http server on bind address, with tls (and client certificates) when configured,
+// server is shut down gracefully when ctx is done
+func (service *AgentServiceWrap) serveHttp(ctx context.Context, handler http.Handler) error {
+	server := &http.Server{Addr: service.Settings.HttpPort, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), TasksShutdownTimeout*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	err := service.listenAndServe(server)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (service *AgentServiceWrap) listenAndServe(server *http.Server) error {
+	if service.Settings.HttpBind != "" {
+		_, port, err := net.SplitHostPort(service.Settings.HttpPort)
+		if err != nil {
+			return err
+		}
+		server.Addr = net.JoinHostPort(service.Settings.HttpBind, port)
+	}
+	tlsSettings := service.Settings.HttpTls
+	certFile, keyFile := service.Settings.HttpCertFiles()
+	if certFile == "" {
+		log.Log.Info().Msgf("Http server started on %s", server.Addr)
+		return server.ListenAndServe()
+	}
+	if tlsSettings.SelfSigned {
+		if err := EnsureSelfSignedCert(certFile, keyFile); err != nil {
+			return fmt.Errorf("can't generate self-signed certificate: %w", err)
+		}
+	}
+	fingerprint, err := CertFileFingerprint(certFile)
+	if err != nil {
+		return err
+	}
+	server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if tlsSettings.ClientCAFile != "" {
+		caPem, err := os.ReadFile(tlsSettings.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return fmt.Errorf("no certificates in %s", tlsSettings.ClientCAFile)
+		}
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	log.Log.Info().Str("Fingerprint", fingerprint).Msgf("Https server started on %s", server.Addr)
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
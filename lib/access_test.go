@@ -0,0 +1,48 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGuardScopesApplicationCredentials(t *testing.T) {
+	sum := sha256.Sum256([]byte("app-token"))
+	settings := DefaultSettings()
+	settings.HttpClients = map[string]*HttpClientAuth{"app": {TokenSha256: hex.EncodeToString(sum[:])}}
+	service := &AgentServiceWrap{Agent: Agent{FilesWatcherMixin: FilesWatcherMixin{Settings: settings}}}
+	appKey := func(req *http.Request) string { return req.URL.Query().Get("ext_key") }
+	handler := service.guard(RouteGroupApp, true, appKey, func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name   string
+		query  string
+		token  string
+		status int
+	}{
+		{"own application", "?ext_key=app", "app-token", http.StatusOK},
+		{"application with same prefix", "?ext_key=billing-app", "app-token", http.StatusUnauthorized},
+		{"application prefix", "?ext_key=ap", "app-token", http.StatusUnauthorized},
+		{"empty ext_key", "?ext_key=", "app-token", http.StatusBadRequest},
+		{"missing ext_key", "", "app-token", http.StatusBadRequest},
+		{"unknown token", "?ext_key=app", "other-token", http.StatusUnauthorized},
+		{"no token", "?ext_key=app", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/app/check"+test.query, nil)
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			recorder := httptest.NewRecorder()
+			handler(recorder, req)
+			if recorder.Code != test.status {
+				t.Fatalf("status = %d, want %d", recorder.Code, test.status)
+			}
+		})
+	}
+}
@@ -14,14 +14,15 @@ import (
 	"io/fs"
 	"main/lib/helpers"
 	"main/lib/install"
+	"main/lib/jsonrpc"
 	"main/lib/log"
 	"main/lib/structs"
-	"net/rpc"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,12 +32,12 @@ type Agent struct {
 	ApiClient *RestClient
 }
 
-func NewAgent(settings *Settings, apiClient *RestClient, rpcClient *rpc.Client) *Agent {
+func NewAgent(settings *Settings, apiClient *RestClient, rpcClient *jsonrpc.Client) *Agent {
 
 	agent := &Agent{
-		RpcClientMixin:    RpcClientMixin{RpcClient: rpcClient},
+		RpcClientMixin:    RpcClientMixin{RpcClient: rpcClient, LockFile: settings.LockFile},
 		ApiClient:         apiClient,
-		FilesWatcherMixin: FilesWatcherMixin{Settings: settings},
+		FilesWatcherMixin: FilesWatcherMixin{Settings: settings, stateVersion: &atomic.Uint64{}},
 	}
 	agent.FilesLoadInstalled()
 	return agent
@@ -124,7 +125,13 @@ func (a *Agent) downloadSoftware(software *structs.Software,
 		}()
 		// }}
 
+		started := time.Now()
 		err := a.ApiClient.DownloadBuild(build.ID, build.FileSpec)
+		var size int64
+		if fileState, statErr := os.Stat(filePath); statErr == nil {
+			size = fileState.Size()
+		}
+		observeDownload(started, size, err)
 		if err != nil {
 			build.FileSpec.Status = structs.Errored
 			build.FileSpec.Error = err.Error()
@@ -136,7 +143,7 @@ func (a *Agent) downloadSoftware(software *structs.Software,
 	head := a.ApiClient.DownloadBuildHEAD(software.Build.ID, 0)
 	software.Build.FileSpec = structs.NewBuildInfo(software.StringWithName(), head)
 	if count != nil {
-		go goLoad(software.Build)
+		log.Go(func() { goLoad(software.Build) })
 	} else {
 		goLoad(software.Build)
 	}
@@ -146,21 +153,31 @@ func (a *Agent) validateBuildCheckSum(build *structs.Build, count *helpers.WaitG
 	if count != nil {
 		defer count.Done()
 	}
+	fail := func(err error) {
+		metricChecksumFailures.Inc()
+		checkSumsTracker.UpdateMessage(text.FgRed.Sprintf("Invalid check sum of %s", build.FileSpec.Name))
+		checkSumsTracker.MarkAsErrored()
+		build.FileSpec.Error = err.Error()
+		build.FileSpec.Status = structs.Errored
+	}
 	file, err := os.Open(path.Join(a.Settings.TmpDir, build.FileSpec.Name+"."+build.FileSpec.HttpInfo.FileType))
+	if err != nil {
+		fail(fmt.Errorf("can't validate checksum: %w", err))
+		return
+	}
+	defer file.Close()
 	hash := sha256.New()
 	if _, err = io.Copy(hash, file); err != nil {
-		checkSumsTracker.MarkAsErrored()
+		fail(fmt.Errorf("can't validate checksum: %w", err))
+		return
 	}
-	if build.FileSpec.HttpInfo.HashValue == hex.EncodeToString(hash.Sum(nil)) {
-		//checkSumsTracker.SetValue(int64(i))
-		checkSumsTracker.Increment(1)
-		build.FileSpec.ValidCheckSum = true
-	} else {
-		checkSumsTracker.UpdateMessage(text.FgRed.Sprintf("Invalid check sum of %s", build.FileSpec.Name))
-		checkSumsTracker.MarkAsErrored()
-		build.FileSpec.Error = errors.New("can't validate checksum").Error()
-		build.FileSpec.Status = structs.Errored
+	if build.FileSpec.HttpInfo.HashValue != hex.EncodeToString(hash.Sum(nil)) {
+		fail(errors.New("can't validate checksum"))
+		return
 	}
+	//checkSumsTracker.SetValue(int64(i))
+	checkSumsTracker.Increment(1)
+	build.FileSpec.ValidCheckSum = true
 }
 
 func (a *Agent) unpackBuildFile(build *structs.Build, count *helpers.WaitGroupCount, progressTrack progress.Writer) {
@@ -251,7 +268,8 @@ func (a *Agent) downloadPackage(targetPackage *structs.Package) {
 	progressTrack.AppendTracker(checkSumsTracker)
 	wg.Add(len(targetPackage.PackageItems))
 	for _, packageItem := range targetPackage.PackageItems {
-		go a.validateBuildCheckSum(packageItem.Software.Build, &wg, checkSumsTracker)
+		build := packageItem.Software.Build
+		log.Go(func() { a.validateBuildCheckSum(build, &wg, checkSumsTracker) })
 	}
 	time.Sleep(5 * time.Millisecond)
 	wg.Wait()
@@ -263,7 +281,8 @@ func (a *Agent) downloadPackage(targetPackage *structs.Package) {
 	//progressTrack.SetPinnedMessages("Unpack builds")
 	wg.Add(len(targetPackage.PackageItems))
 	for _, packageItems := range targetPackage.PackageItems {
-		go a.unpackBuildFile(packageItems.Software.Build, &wg, progressTrack)
+		build := packageItems.Software.Build
+		log.Go(func() { a.unpackBuildFile(build, &wg, progressTrack) })
 	}
 	time.Sleep(2 * time.Millisecond)
 	wg.Wait()
@@ -319,9 +338,12 @@ func (a *Agent) getApplicationUpdate(params *structs.ApplicationUpdateParams) (*
 	var extKey = ""
 	var existVersion *version.Version
 	var existPatchNum int
+	if params.ExternalKey == "" {
+		return helpers.FalsePtr(), nil, errors.New("ext key is empty")
+	}
 	a.FilesIterInstalledPackageItem(func(info *SavedInfo, packageItem *structs.PackageItem) {
 		if packageItem.Software.ExternalKey != nil {
-			if strings.Contains(*packageItem.Software.ExternalKey, params.ExternalKey) {
+			if *packageItem.Software.ExternalKey == params.ExternalKey {
 				existVersion, _ = version.NewVersion(packageItem.Software.Version)
 				existPatchNum = packageItem.Software.Patch
 				extKey = *packageItem.Software.ExternalKey
@@ -376,6 +398,14 @@ func (a *Agent) RegProcess() {
 		System:          OsVersion(),
 		LocalTimeOffset: offset})
 	if isReg {
+		storeErr := a.FilesStoreRegistration(&RegistrationFile{
+			RegisteredAt: time.Now(),
+			ControlIp:    a.Settings.NetInfo.ControlIp,
+			LocalAddress: ipStr,
+		})
+		if storeErr != nil {
+			log.Log.Warn().Err(storeErr).Msg("Can't store registration info")
+		}
 		log.Log.Info().Msgf("Agent registration complete")
 	} else {
 		log.Log.Error().Msgf("Agent registration fails")
@@ -402,6 +432,21 @@ func (a *Agent) installSoftware(software *structs.Software, inst *install.Instal
 	}
 
 	build := software.Build
+	installError := a.installBuild(software, inst)
+	if installError != nil {
+		onError(build, installError)
+		inst.RollbackAll()
+		return installError
+	}
+	if software.Kind != "application" {
+		a.configureSoftware(software.ID)
+	}
+	software.Build.FileSpec.Status = structs.Installed
+	return nil
+}
+
+// installBuild installs unpacked build of software from tmp dir
+func (a *Agent) installBuild(software *structs.Software, inst *install.Installer) error {
 	var installError error
 	if software.Kind == "application" {
 		key := software.ExternalKey
@@ -411,29 +456,99 @@ func (a *Agent) installSoftware(software *structs.Software, inst *install.Instal
 				path.Join(a.Settings.AppFolder, *key))
 		}
 	} else {
-		filepath.Walk(path.Join(a.Settings.TmpDir, software.Build.FileSpec.Name),
+		walkError := filepath.Walk(path.Join(a.Settings.TmpDir, software.Build.FileSpec.Name),
 			func(filePath string, info fs.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
 				if !info.IsDir() && strings.Contains(info.Name(), SupportedPkgExt[RunPkgManager]) {
 					software.PackageInfo, installError = inst.InstallPackage(software.Kind, filePath)
 				}
-				return err
+				return nil
 			},
 		)
+		if installError == nil {
+			installError = walkError
+		}
 	}
+	return installError
+}
 
-	if installError != nil {
-		onError(build, installError)
-		inst.RollbackAll()
-		return installError
+// reinstallSoftware downloads and installs previously applied builds again,
+// downgrade is allowed as they replace builds which failed readiness
+func (a *Agent) reinstallSoftware(softwares ...*structs.Software) error {
+	previous := &structs.Package{PackageItems: make([]*structs.PackageItem, 0, len(softwares))}
+	for _, software := range softwares {
+		previous.PackageItems = append(previous.PackageItems, &structs.PackageItem{Software: software})
+	}
+	a.downloadPackage(previous)
+	inst := install.NewInstaller(RunPkgManager, strings.TrimSpace(RunFlags+" --allow-downgrades"))
+	for _, software := range softwares {
+		if software.Build.FileSpec.Status == structs.Errored {
+			return fmt.Errorf("download build of %s: %s", software.Name, software.Build.FileSpec.Error)
+		}
+		if err := a.installBuild(software, inst); err != nil {
+			return fmt.Errorf("install build of %s: %w", software.Name, err)
+		}
+		if software.Kind != "application" {
+			a.configureSoftware(software.ID)
+		}
+		software.Build.FileSpec.Status = structs.Installed
+		software.Build.FileSpec.Error = ""
 	}
-	if software.Kind != "application" {
-		a.configureSoftware(software.ID)
+	return nil
+}
+
+// restoreSoftware reinstalls previous builds after update or patch failed readiness. When it fails
+// failed builds stay installed, so applied changes record of installed package to them
+func (a *Agent) restoreSoftware(applied func(), softwares ...*structs.Software) error {
+	if err := a.reinstallSoftware(softwares...); err != nil {
+		applied()
+		return fmt.Errorf("%w, installed package record is changed to failed builds", err)
 	}
-	software.Build.FileSpec.Status = structs.Installed
+	log.Log.Info().Msg("Previous builds are reinstalled")
 	return nil
 }
 
+// readinessGate waits readiness of installed software. On failure restore undoes installation:
+// fresh install is rolled back, update or patch reinstalls previously applied builds
+func (a *Agent) readinessGate(restore func() error, softwares ...*structs.Software) error {
+	probes := make(map[string]any)
+	var gateErr error
+	for _, software := range softwares {
+		results, err := WaitReadiness(a.Settings, software)
+		if len(results) != 0 {
+			probes[software.Name] = results
+		}
+		if err != nil {
+			gateErr = err
+			break
+		}
+	}
+	if gateErr == nil {
+		return nil
+	}
+	for _, software := range softwares {
+		software.Build.FileSpec.Status = structs.Errored
+		software.Build.FileSpec.Error = gateErr.Error()
+	}
+	log.Log.Error().Err(gateErr).Msg("Readiness check failed, rollback")
+	if restoreErr := restore(); restoreErr != nil {
+		log.Log.Error().Err(restoreErr).Msg("Rollback failed")
+	}
+	a.ApiClient.Notify(a.createNotification("fails",
+		map[string]any{"error": gateErr.Error(), "readiness": probes}))
+	a.FilesSerializeInstallation()
+	return gateErr
+}
+
 func (a *Agent) InstallPackage(tPackage *structs.Package) error {
+	return a.installPackage(tPackage, nil, nil)
+}
+
+// installPackage installs package, applied is called for update of previous package once package is ready,
+// so record of installed package changes only after successful update
+func (a *Agent) installPackage(tPackage *structs.Package, previous *structs.Package, applied func()) error {
 	a.ApiClient.Notify(a.createNotification("download"))
 	a.downloadPackage(tPackage)
 
@@ -442,19 +557,39 @@ func (a *Agent) InstallPackage(tPackage *structs.Package) error {
 	})
 
 	inst := install.NewInstaller(RunPkgManager, RunFlags)
+	softwares := make([]*structs.Software, 0)
 	for _, packageItem := range tPackage.PackageItems {
 		//build := packageItem.Software.Build
 		installError := a.installSoftware(packageItem.Software, inst)
 		if installError != nil {
 			return installError
 		}
+		softwares = append(softwares, packageItem.Software)
+	}
+	restore := inst.RollbackAll
+	if previous != nil {
+		restore = func() error {
+			previousSoftwares := make([]*structs.Software, 0, len(previous.PackageItems))
+			for _, packageItem := range previous.PackageItems {
+				previousSoftwares = append(previousSoftwares, packageItem.Software)
+			}
+			return a.restoreSoftware(applied, previousSoftwares...)
+		}
+	}
+	gateError := a.readinessGate(restore, softwares...)
+	if gateError != nil {
+		return gateError
+	}
+	if applied != nil {
+		applied()
 	}
 	a.ApiClient.Notify(a.createNotification("installed"))
 	a.FilesSerializeInstallation()
 	return nil
 }
 
-func (a *Agent) patchSoftware(software *structs.Software) error {
+// patchSoftware installs patch of previous software, applied is called once patched software is ready
+func (a *Agent) patchSoftware(software *structs.Software, previous *structs.Software, applied func()) error {
 	// INIT PROGRESS BAR {{
 	progressTrack := *helpers.NewProgressBar(3, 1)
 	progressTrack.SetMessageWidth(50)
@@ -490,16 +625,23 @@ func (a *Agent) patchSoftware(software *structs.Software) error {
 	if installError != nil {
 		return installError
 	}
+	gateError := a.readinessGate(func() error { return a.restoreSoftware(applied, previous) }, software)
+	if gateError != nil {
+		return gateError
+	}
+	applied()
 	a.ApiClient.Notify(a.createNotification("installed"))
 	a.FilesSerializeInstallation()
 	return nil
 }
 
-func (a *Agent) updatePackage(info *SavedInfo) {
+// updatePackage finds and installs update of installed package, returns false if there is no update,
+// assumeYes confirms update without prompt
+func (a *Agent) updatePackage(info *SavedInfo, assumeYes bool) (bool, error) {
 	log.Log.Info().Msgf("Check packages for %s", info.Package.Name)
 	updates := a.ApiClient.GetSoftwareUpdates(info.Unit.ID)
 	upd := helpers.Find(updates, func(pac *structs.Package) bool {
-		if *pac.PrevPackageID == info.Package.ID {
+		if pac.PrevPackageID != nil && *pac.PrevPackageID == info.Package.ID {
 			for _, packItem := range pac.PackageItems {
 				if !packItem.Enable {
 					return false
@@ -509,32 +651,35 @@ func (a *Agent) updatePackage(info *SavedInfo) {
 		}
 		return false
 	})
-	if upd != nil {
-		log.Log.Info().Msgf("Find update for %s", info.Package.Name)
-		t := helpers.ConstructTable(&table.Row{"Package", "Software", "Update"})
-		for _, installedPi := range info.Package.PackageItems {
-			for _, newPi := range (*upd).PackageItems {
-				if installedPi.Software.Name == newPi.Software.Name {
-					t.AppendRow(table.Row{info.Package.Name,
-						installedPi.Software.Name,
-						VersionStringColor(installedPi.Software, newPi.Software)})
-				}
-			}
-		}
-		t.Render()
-		agree := AskConfirm(ForceCmd)
-		if agree {
-			info.Package = *upd
-			a.Tmp = info
-			err := a.InstallPackage(*upd)
-			if err != nil {
-				log.Log.Error().Err(err).Msgf("Update %s FAILED", info.Package.Name)
-				return
+	if upd == nil {
+		log.Log.Info().Msgf("No updates for %s", info.Package.Name)
+		return false, nil
+	}
+	log.Log.Info().Msgf("Find update for %s", info.Package.Name)
+	t := helpers.ConstructTable(&table.Row{"Package", "Software", "Update"})
+	for _, installedPi := range info.Package.PackageItems {
+		for _, newPi := range (*upd).PackageItems {
+			if installedPi.Software.Name == newPi.Software.Name {
+				t.AppendRow(table.Row{info.Package.Name,
+					installedPi.Software.Name,
+					VersionStringColor(installedPi.Software, newPi.Software)})
 			}
 		}
-	} else {
-		log.Log.Info().Msgf("No updates for %s", info.Package.Name)
 	}
+	t.Render()
+	agree := assumeYes || AskConfirm(ForceCmd)
+	if !agree {
+		return false, nil
+	}
+	a.Tmp = info
+	started := time.Now()
+	err := a.installPackage(*upd, info.Package, func() { info.Package = *upd })
+	observeOperation("update", started, err)
+	if err != nil {
+		log.Log.Error().Err(err).Msgf("Update %s FAILED", info.Package.Name)
+		return false, err
+	}
+	return true, nil
 }
 
 func (a *Agent) UpdateProcess(packageId *int, innerIndex *int) {
@@ -559,55 +704,63 @@ func (a *Agent) UpdateProcess(packageId *int, innerIndex *int) {
 			log.Log.Info().Msgf("Package %d not found, please specify correct idx", *packageId)
 			return
 		}
-		a.updatePackage(updatePackage)
+		_, _ = a.updatePackage(updatePackage, false)
 	} else {
 		a.FilesIterInstalled(func(info *SavedInfo) {
-			a.updatePackage(info)
+			_, _ = a.updatePackage(info, false)
 		})
 	}
 }
 
-func (a *Agent) PatchProcess(softwareId *int) {
-	a.FilesIterInstalled(func(info *SavedInfo) {
-		patchSoftware := func(installedSoftware *structs.Software) {
-			software := a.ApiClient.GetSoftwareLatestPatch(installedSoftware.ID)
+// patchInstalledSoftware finds and installs latest patch of installed software, returns false if there is no patch,
+// assumeYes confirms patch without prompt
+func (a *Agent) patchInstalledSoftware(info *SavedInfo, installedSoftware *structs.Software, assumeYes bool) (bool, error) {
+	software := a.ApiClient.GetSoftwareLatestPatch(installedSoftware.ID)
 
-			if software == nil {
-				log.Log.Info().Msgf("Remote software (Package name: %s, SoftwareId: %d) not found",
-					info.Package.Name, installedSoftware.ID)
-				return
-			}
+	if software == nil {
+		log.Log.Info().Msgf("Remote software (Package name: %s, SoftwareId: %d) not found",
+			info.Package.Name, installedSoftware.ID)
+		return false, nil
+	}
 
-			if software.Patch <= installedSoftware.Patch {
-				log.Log.Info().Msgf("Software %s already has latest patch", installedSoftware.Name)
-				return
-			}
+	if software.Patch <= installedSoftware.Patch {
+		log.Log.Info().Msgf("Software %s already has latest patch", installedSoftware.Name)
+		return false, nil
+	}
 
-			log.Log.Info().Msgf("Find new patch for %s", info.Package.Name)
-			t := helpers.ConstructTable(&table.Row{"Software", "Update"})
-			t.AppendRow(table.Row{software.Name, VersionStringColor(installedSoftware, software)})
-			t.Render()
-			agree := AskConfirm(ForceCmd)
-			if agree {
-				for _, pi := range info.Package.PackageItems {
-					if pi.Software.ID == installedSoftware.ID {
-						pi.Software = software
-					}
-				}
-				a.Tmp = info
-				err := a.patchSoftware(software)
-				if err != nil {
-					log.Log.Error().Err(err).Msgf("Patch %s FAILED", info.Package.Name)
-					return
-				}
+	log.Log.Info().Msgf("Find new patch for %s", info.Package.Name)
+	t := helpers.ConstructTable(&table.Row{"Software", "Update"})
+	t.AppendRow(table.Row{software.Name, VersionStringColor(installedSoftware, software)})
+	t.Render()
+	agree := assumeYes || AskConfirm(ForceCmd)
+	if !agree {
+		return false, nil
+	}
+	a.Tmp = info
+	started := time.Now()
+	err := a.patchSoftware(software, installedSoftware, func() {
+		for _, pi := range info.Package.PackageItems {
+			if pi.Software.ID == installedSoftware.ID {
+				pi.Software = software
 			}
 		}
+	})
+	observeOperation("patch", started, err)
+	if err != nil {
+		log.Log.Error().Err(err).Msgf("Patch %s FAILED", info.Package.Name)
+		return false, err
+	}
+	return true, nil
+}
+
+func (a *Agent) PatchProcess(softwareId *int) {
+	a.FilesIterInstalled(func(info *SavedInfo) {
 		if *softwareId != 0 {
 			var founded = false
 			for _, pi := range info.Package.PackageItems {
 				if *softwareId == pi.Software.ID {
 					log.Log.Info().Msgf("Check packages for %s", info.Package.Name)
-					patchSoftware(pi.Software)
+					_, _ = a.patchInstalledSoftware(info, pi.Software, false)
 					founded = true
 					break
 				}
@@ -618,7 +771,7 @@ func (a *Agent) PatchProcess(softwareId *int) {
 		} else {
 			log.Log.Info().Msgf("Check packages for %s", info.Package.Name)
 			for _, pi := range info.Package.PackageItems {
-				patchSoftware(pi.Software)
+				_, _ = a.patchInstalledSoftware(info, pi.Software, false)
 			}
 		}
 	})
@@ -645,7 +798,9 @@ func (a *Agent) InstallProcess(clientId *int, productId *int, packageId *int) {
 		return
 	}
 	a.FilesAddInstallation(targetClient, targetProduct, targetPackage, targetUnit)
-	a.InstallPackage(targetPackage)
+	started := time.Now()
+	err := a.InstallPackage(targetPackage)
+	observeOperation("install", started, err)
 }
 
 func (a *Agent) RemovePackages(packageIds ...int) {
@@ -682,18 +837,3 @@ func (a *Agent) RemovePackages(packageIds ...int) {
 	}
 	a.FilesSerializeInstallation()
 }
-
-func (a *Agent) RemoteShellProcess() error {
-	return nil
-	//ws, wsError := a.RestClient.OpenWebsocket()
-	//if wsError != nil {
-	//	log.Log.Error().Err(wsError).Msg("Unable to start websocket session ")
-	//	return wsError
-	//}
-	//return a.remoteShellWrite(ws)
-
-	//reader := bufio.NewReader(os.Stdin)
-	//for b, err := reader.ReadByte(); err == nil; b, err = reader.ReadByte() {
-	//	stdin.Write([]byte{b})
-	//}
-}
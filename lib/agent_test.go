@@ -0,0 +1,31 @@
+package lib
+
+import (
+	"main/lib/structs"
+	"testing"
+)
+
+func TestGetApplicationUpdateMatchesExactKey(t *testing.T) {
+	key := "billing-app"
+	agent := &Agent{FilesWatcherMixin: FilesWatcherMixin{Settings: DefaultSettings(), Installed: []*SavedInfo{{
+		Package: &structs.Package{PackageItems: []*structs.PackageItem{{
+			Software: &structs.Software{Name: "billing", Version: "1.0.0", ExternalKey: &key},
+		}}},
+	}}}}
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{"empty key", ""},
+		{"suffix of key", "app"},
+		{"prefix of key", "billing"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exist, _, err := agent.getApplicationUpdate(&structs.ApplicationUpdateParams{ExternalKey: test.key})
+			if err == nil || *exist {
+				t.Fatalf("getApplicationUpdate(%q) matched %s", test.key, key)
+			}
+		})
+	}
+}
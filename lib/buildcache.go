@@ -0,0 +1,467 @@
+package lib
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"main/lib/helpers"
+	"main/lib/log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Build cache of relay agent: downloads of builds requested by downstream agents are stored on disk
+// keyed by build id and digest, so each build crosses WAN once. Every request is still authorized
+// by HEAD to upstream, which also gives current digest of build.
+
+// ProxyCacheSize is default size limit of build cache in MiB
+const ProxyCacheSize = 10240
+
+// buildFetchIdleTimeout abandons fetch of build when upstream sends nothing for it
+const buildFetchIdleTimeout = 2 * time.Minute
+
+var buildDownloadPath = regexp.MustCompile(`^/api/v1/agent/build/(\d+)/download$`)
+
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+// buildMeta is stored next to cached build, headers are replayed to downstream
+type buildMeta struct {
+	BuildId            int       `json:"build_id"`
+	Digest             string    `json:"digest"`
+	Size               int64     `json:"size"`
+	ContentType        string    `json:"content_type"`
+	ContentDisposition string    `json:"content_disposition"`
+	StoredAt           time.Time `json:"stored_at"`
+}
+
+type cacheEntry struct {
+	meta     *buildMeta
+	lastUsed time.Time
+}
+
+// cacheFetch is upstream fetch shared by concurrent misses of same key
+type cacheFetch struct {
+	done  chan struct{}
+	entry *cacheEntry
+	err   error
+}
+
+type buildCache struct {
+	dir      string
+	maxBytes int64
+	lock     *sync.Mutex
+	entries  map[string]*cacheEntry
+	inflight map[string]*cacheFetch
+	total    int64
+}
+
+func newBuildCache(dir string, maxBytes int64) *buildCache {
+	cache := &buildCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lock:     &sync.Mutex{},
+		entries:  map[string]*cacheEntry{},
+		inflight: map[string]*cacheFetch{},
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Log.Error().Err(err).Msgf("Can't create build cache %s", dir)
+		return cache
+	}
+	cache.scan()
+	return cache
+}
+
+// resize applies changed size limit, builds over it are evicted
+func (cache *buildCache) resize(maxBytes int64) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.maxBytes == maxBytes {
+		return
+	}
+	cache.maxBytes = maxBytes
+	cache.evict("")
+}
+
+func (cache *buildCache) dataPath(key string) string {
+	return filepath.Join(cache.dir, key+".bin")
+}
+
+func (cache *buildCache) metaPath(key string) string {
+	return filepath.Join(cache.dir, key+".json")
+}
+
+// scan indexes cached builds, unfinished fetches and builds without metadata are removed
+func (cache *buildCache) scan() {
+	files, err := os.ReadDir(cache.dir)
+	if err != nil {
+		log.Log.Error().Err(err).Msgf("Can't read build cache %s", cache.dir)
+		return
+	}
+	for _, file := range files {
+		name := file.Name()
+		switch filepath.Ext(name) {
+		case ".part":
+			_ = os.Remove(filepath.Join(cache.dir, name))
+		case ".json":
+			key := strings.TrimSuffix(name, ".json")
+			if entry := cache.load(key); entry != nil {
+				cache.entries[key] = entry
+				cache.total += entry.meta.Size
+			} else {
+				cache.remove(key)
+			}
+		case ".bin":
+			if !helpers.FileExists(cache.metaPath(strings.TrimSuffix(name, ".bin"))) {
+				_ = os.Remove(filepath.Join(cache.dir, name))
+			}
+		}
+	}
+	metricProxyCacheBytes.Set(float64(cache.total))
+	cache.evict("")
+}
+
+// load reads entry from disk, modification time of metadata is time of last use
+func (cache *buildCache) load(key string) *cacheEntry {
+	metaInfo, err := os.Stat(cache.metaPath(key))
+	if err != nil {
+		return nil
+	}
+	data, err := os.ReadFile(cache.metaPath(key))
+	if err != nil {
+		return nil
+	}
+	meta := &buildMeta{}
+	if err = json.Unmarshal(data, meta); err != nil {
+		return nil
+	}
+	dataInfo, err := os.Stat(cache.dataPath(key))
+	if err != nil || dataInfo.Size() != meta.Size {
+		return nil
+	}
+	return &cacheEntry{meta: meta, lastUsed: metaInfo.ModTime()}
+}
+
+func (cache *buildCache) remove(key string) {
+	_ = os.Remove(cache.dataPath(key))
+	_ = os.Remove(cache.metaPath(key))
+}
+
+// open returns cached entry with its data file, file is opened under lock so concurrent eviction
+// can't remove it before it is served (open file survives unlink)
+func (cache *buildCache) open(key string) (*cacheEntry, *os.File) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry, ok := cache.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	file, err := os.Open(cache.dataPath(key))
+	if err != nil {
+		log.Log.Error().Err(err).Msg("Cached build is gone")
+		cache.total -= entry.meta.Size
+		delete(cache.entries, key)
+		cache.remove(key)
+		metricProxyCacheBytes.Set(float64(cache.total))
+		return nil, nil
+	}
+	entry.lastUsed = time.Now()
+	_ = os.Chtimes(cache.metaPath(key), entry.lastUsed, entry.lastUsed)
+	return entry, file
+}
+
+// evict removes least recently used builds until cache fits size limit, keep is never removed
+func (cache *buildCache) evict(keep string) {
+	for cache.total > cache.maxBytes {
+		oldestKey := ""
+		var oldest *cacheEntry
+		for key, entry := range cache.entries {
+			if key != keep && (oldest == nil || entry.lastUsed.Before(oldest.lastUsed)) {
+				oldestKey, oldest = key, entry
+			}
+		}
+		if oldest == nil {
+			break
+		}
+		// served files stay readable by open descriptors
+		cache.remove(oldestKey)
+		delete(cache.entries, oldestKey)
+		cache.total -= oldest.meta.Size
+		log.Log.Info().Int("Build", oldest.meta.BuildId).Int64("Size", oldest.meta.Size).Msg("Build evicted from cache")
+	}
+	metricProxyCacheBytes.Set(float64(cache.total))
+}
+
+func (cache *buildCache) store(key string, entry *cacheEntry) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if previous, ok := cache.entries[key]; ok {
+		cache.total -= previous.meta.Size
+	}
+	cache.entries[key] = entry
+	cache.total += entry.meta.Size
+	cache.evict(key)
+}
+
+// fetch returns entry of key, concurrent misses wait for one download started by first of them
+func (cache *buildCache) fetch(ctx context.Context, key string, download func(file *os.File) (*buildMeta, error)) (*cacheEntry, error) {
+	cache.lock.Lock()
+	call, ok := cache.inflight[key]
+	if !ok {
+		call = &cacheFetch{done: make(chan struct{})}
+		cache.inflight[key] = call
+		// download is not bound to ctx of request, other waiters need it when first client is gone
+		go func() {
+			call.entry, call.err = cache.download(key, download)
+			cache.lock.Lock()
+			delete(cache.inflight, key)
+			cache.lock.Unlock()
+			close(call.done)
+		}()
+	}
+	cache.lock.Unlock()
+	select {
+	case <-call.done:
+		return call.entry, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (cache *buildCache) download(key string, download func(file *os.File) (*buildMeta, error)) (*cacheEntry, error) {
+	file, err := os.CreateTemp(cache.dir, key+".*.part")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	meta, err := download(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, _ := json.Marshal(meta)
+	if err = os.WriteFile(cache.metaPath(key), data, 0644); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(file.Name(), cache.dataPath(key)); err != nil {
+		_ = os.Remove(cache.metaPath(key))
+		return nil, err
+	}
+	entry := &cacheEntry{meta: meta, lastUsed: time.Now()}
+	cache.store(key, entry)
+	return entry, nil
+}
+
+// digestHash returns hash of digest algorithm given as sha256, SHA-256, md5 etc.
+func digestHash(algorithm string) hash.Hash {
+	switch strings.ReplaceAll(strings.ToLower(algorithm), "-", "") {
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	case "md5":
+		return md5.New()
+	}
+	return nil
+}
+
+// digestMatches compares sum with digest value encoded as hex or base64
+func digestMatches(sum []byte, value string) bool {
+	return strings.EqualFold(hex.EncodeToString(sum), value) || base64.StdEncoding.EncodeToString(sum) == value
+}
+
+var unsafeKeyChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+func buildCacheKey(buildId int, algorithm string, value string) string {
+	return fmt.Sprintf("build-%d-%s-%s", buildId, unsafeKeyChars.ReplaceAllString(strings.ToLower(algorithm), ""),
+		unsafeKeyChars.ReplaceAllString(value, "_"))
+}
+
+// rangeSize reads size of file from Content-Range: bytes 0-99/100, -1 when unknown
+func rangeSize(header string) int64 {
+	_, size, ok := strings.Cut(header, "/")
+	if !ok {
+		return -1
+	}
+	number, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return number
+}
+
+// upstreamRequest copies downstream request to upstream url with credentials of downstream agent
+func upstreamRequest(ctx context.Context, method string, target *url.URL, from *http.Request) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"Authorization", "User-Agent", "Accept", HopsHeader} {
+		if value := from.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	return req, nil
+}
+
+func relayResponse(w http.ResponseWriter, resp *http.Response) {
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+// serveBuild serves build download from cache, false is returned when build can't be cached
+// and request has to be proxied as is. Upstream is requested by transport of relay, body of build
+// is not limited by time, only by buildFetchIdleTimeout
+func (cache *buildCache) serveBuild(w http.ResponseWriter, req *http.Request, buildId int, target *url.URL,
+	transport http.RoundTripper) bool {
+	client := &http.Client{Transport: transport}
+	head, err := upstreamRequest(req.Context(), http.MethodHead, target, req)
+	if err != nil {
+		return false
+	}
+	headResp, err := client.Do(head)
+	if err != nil {
+		log.Log.Error().Err(err).Int("Build", buildId).Msg("Upstream is not available for build download")
+		_ = WriteJsonResponse(w, relayErrorCode(err), map[string]any{"msg": "upstream is not available"})
+		return true
+	}
+	defer headResp.Body.Close()
+	// denied or missing build and plain HEAD are answered by upstream itself
+	if headResp.StatusCode >= 300 || req.Method == http.MethodHead {
+		relayResponse(w, headResp)
+		return true
+	}
+	algorithm, value, ok := strings.Cut(headResp.Header.Get("Digest"), ":")
+	size := rangeSize(headResp.Header.Get("Content-Range"))
+	if !ok || digestHash(algorithm) == nil || size < 0 || size > cache.maxBytes {
+		metricProxyCache.Inc("bypass")
+		return false
+	}
+	key := buildCacheKey(buildId, algorithm, value)
+	entry, file := cache.open(key)
+	if entry != nil {
+		metricProxyCache.Inc("hit")
+	} else {
+		metricProxyCache.Inc("miss")
+		log.Log.Info().Int("Build", buildId).Int64("Size", size).Msg("Build is not cached, fetch it from upstream")
+		_, err = cache.fetch(req.Context(), key, func(file *os.File) (*buildMeta, error) {
+			return fetchBuild(client, file, req, buildId, target, algorithm, value)
+		})
+		if err != nil {
+			if req.Context().Err() == nil {
+				log.Log.Error().Err(err).Int("Build", buildId).Msg("Can't cache build")
+				_ = WriteJsonResponse(w, relayErrorCode(err), map[string]any{"msg": "build fetch failed"})
+			}
+			return true
+		}
+		// fetched build may be evicted by concurrent store before it is opened, then it is proxied
+		if entry, file = cache.open(key); entry == nil {
+			metricProxyCache.Inc("bypass")
+			return false
+		}
+	}
+	defer file.Close()
+	serveEntry(w, req, entry, file)
+	return true
+}
+
+// idleReader cancels fetch when no bytes are read for timeout
+type idleReader struct {
+	reader  io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+// fetchBuild downloads whole build to file and verifies it by digest given in HEAD,
+// stalled upstream is abandoned after buildFetchIdleTimeout without data
+func fetchBuild(client *http.Client, file *os.File, from *http.Request, buildId int, target *url.URL, algorithm string, value string) (*buildMeta, error) {
+	full := *target
+	query := full.Query()
+	query.Set("start_by", "0")
+	full.RawQuery = query.Encode()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	idle := time.AfterFunc(buildFetchIdleTimeout, cancel)
+	defer idle.Stop()
+	req, err := upstreamRequest(ctx, http.MethodGet, &full, from)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("upstream responded %s", resp.Status)
+	}
+	sum := digestHash(algorithm)
+	body := &idleReader{reader: resp.Body, timer: idle, timeout: buildFetchIdleTimeout}
+	written, err := io.Copy(io.MultiWriter(file, sum), body)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("upstream sent no data of build %d for %s: %w", buildId, buildFetchIdleTimeout, context.DeadlineExceeded)
+		}
+		return nil, err
+	}
+	if !digestMatches(sum.Sum(nil), value) {
+		metricChecksumFailures.Inc()
+		return nil, fmt.Errorf("%w of build %d", ErrDigestMismatch, buildId)
+	}
+	log.Log.Info().Int("Build", buildId).Int64("Size", written).Msg("Build cached")
+	return &buildMeta{
+		BuildId:            buildId,
+		Digest:             algorithm + ":" + value,
+		Size:               written,
+		ContentType:        resp.Header.Get("Content-Type"),
+		ContentDisposition: resp.Header.Get("Content-Disposition"),
+		StoredAt:           time.Now(),
+	}, nil
+}
+
+// serveEntry replies like upstream: start_by is turned into range, so Content-Range is always present
+func serveEntry(w http.ResponseWriter, req *http.Request, entry *cacheEntry, file *os.File) {
+	header := w.Header()
+	if entry.meta.ContentType != "" {
+		header.Set("Content-Type", entry.meta.ContentType)
+	}
+	if entry.meta.ContentDisposition != "" {
+		header.Set("Content-Disposition", entry.meta.ContentDisposition)
+	}
+	header.Set("Digest", entry.meta.Digest)
+	header.Set("ETag", strconv.Quote(entry.meta.Digest))
+	if req.Header.Get("Range") == "" {
+		startBy, _ := strconv.ParseInt(req.URL.Query().Get("start_by"), 10, 64)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", startBy))
+	}
+	http.ServeContent(w, req, "", entry.meta.StoredAt, file)
+}
@@ -0,0 +1,48 @@
+package lib
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBuildCacheOpenSurvivesEviction(t *testing.T) {
+	cache := newBuildCache(t.TempDir(), 10)
+	put := func(key string, data string) {
+		if err := os.WriteFile(cache.dataPath(key), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(cache.metaPath(key), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cache.store(key, &cacheEntry{meta: &buildMeta{Size: int64(len(data))}, lastUsed: time.Now()})
+	}
+	put("first", "12345678")
+	entry, file := cache.open("first")
+	if entry == nil {
+		t.Fatal("open() missed stored build")
+	}
+	defer file.Close()
+
+	// second build does not fit together with first one, so first is evicted while it is served
+	put("second", "abcdefgh")
+	if evicted, _ := cache.open("first"); evicted != nil {
+		t.Fatal("first build is not evicted")
+	}
+	data, err := io.ReadAll(file)
+	if err != nil || string(data) != "12345678" {
+		t.Fatalf("read of evicted build = %q, %v", data, err)
+	}
+}
+
+func TestBuildCacheOpenDropsMissingFile(t *testing.T) {
+	cache := newBuildCache(t.TempDir(), 100)
+	cache.store("gone", &cacheEntry{meta: &buildMeta{Size: 8}, lastUsed: time.Now()})
+	if entry, file := cache.open("gone"); entry != nil || file != nil {
+		t.Fatal("open() returned build without data file")
+	}
+	if _, ok := cache.entries["gone"]; ok || cache.total != 0 {
+		t.Fatalf("entry of missing build is kept, total %d", cache.total)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/alecthomas/kingpin/v2"
 	"main/lib/helpers"
 	"main/lib/log"
+	"main/lib/structs"
 	"os"
 	"os/signal"
 	"strconv"
@@ -18,6 +19,10 @@ var (
 	VersionCmd = Commander.Command("version", "Show version").Alias("v")
 	ForceCmd   = Commander.Flag("force", "Skip confirm").Short('f').Bool()
 
+	// home and config are applied by ConfigurePaths before parse, they are declared for help and validation
+	_ = Commander.Flag("home", "Agent home directory (PCA_HOME)").String()
+	_ = Commander.Flag("config", "Config file (PCA_CONFIG), default is config.json in home").String()
+
 	innerIndexFlag = Commander.Flag("inner-index", "Inner index").Short('i').Default("-1").Int()
 
 	reg = Commander.Command("reg", "Register Agent in Pc system")
@@ -41,7 +46,42 @@ var (
 	listCmdVerbose = listCmd.Flag("verbose", "List installed products").Short('v').Bool()
 
 	reconfigure = Commander.Command("reconf", "Open editor with pca config file")
-	shell       = Commander.Command("shell", "Open remote shell")
+
+	configCmd       = Commander.Command("config", "Manage pca config file")
+	configGet       = configCmd.Command("get", "Print value of config key")
+	configGetKey    = configGet.Arg("key", "Dotted key, e.g. net_info.control_ip").Required().String()
+	configSet       = configCmd.Command("set", "Set value of config key, value is json or plain string")
+	configSetKey    = configSet.Arg("key", "Dotted key, e.g. net_info.control_ip").Required().String()
+	configSetValue  = configSet.Arg("value", "New value").Required().String()
+	configValidate  = configCmd.Command("validate", "Validate config file")
+	configShow      = configCmd.Command("show", "Print config file")
+	configEffective = configShow.Flag("effective", "Print settings agent runs with (defaults and config file)").Bool()
+
+	shell          = Commander.Command("shell", "Open remote shell")
+	shellSessionId = shell.Flag("session", "Remote shell session id").Short('s').Required().Int()
+
+	commandsCmd            = Commander.Command("commands", "Remote commands executed by service")
+	commandsHistory        = commandsCmd.Command("history", "Show results of remote commands")
+	commandsHistoryLimit   = commandsHistory.Flag("limit", "Number of latest commands to show").Short('n').Default("20").Int()
+	commandsHistoryVerbose = commandsHistory.Flag("verbose", "Show captured log lines").Short('v').Bool()
+
+	updatePolicyCmd    = Commander.Command("update-policy", "Maintenance windows and auto-update policies")
+	policyShow         = updatePolicyCmd.Command("show", "Show update policies of installed packages")
+	policySet          = updatePolicyCmd.Command("set", "Set local update policy of installed package")
+	policySetPackageId = policySet.Flag("package", "Package id").Short('p').Required().Int()
+	policySetMode      = policySet.Flag("mode", "Policy mode").Required().Enum("manual", "auto-patch", "auto-update")
+	policySetSchedule  = policySet.Flag("schedule", "Cron schedule of maintenance window start").Default("0 3 * * *").String()
+	policySetDuration  = policySet.Flag("duration", "Maintenance window length in minutes").Default("120").Int()
+	policySetTimezone  = policySet.Flag("timezone", "Timezone of maintenance window").Default("Local").String()
+
+	lockCmd    = Commander.Command("lock", "Operation lock of agent")
+	lockStatus = lockCmd.Command("status", "Show holder of operation lock")
+	lockBreak  = lockCmd.Command("break", "Release lock held by stuck process")
+
+	proxyCmd         = Commander.Command("proxy", "Relay of downstream agents")
+	proxyAgents      = proxyCmd.Command("agents", "List downstream agents using this agent as relay")
+	proxyTrace       = proxyCmd.Command("trace", "Show path and latency to control server through chain of relays")
+	proxyFingerprint = proxyCmd.Command("fingerprint", "Print sha256 fingerprint of https certificate, downstream agents pin it as net_info.cert_sha256")
 
 	soft           = Commander.Command("soft", "Operation on installed software")
 	softSoftwareId = soft.Flag("software", "Software id to operate on").Short('s').Default("-1").Int()
@@ -55,11 +95,19 @@ var (
 	restartService = service.Command("restart", "Restart restart pca service (restart existed service)")
 	statusService  = service.Command("status", "Status of systemctl pca service")
 	serveService   = service.Command("serve", "Serve pca service (system usage only, start service in current process)")
+	infoService    = service.Command("info", "Show state of running pca service")
+	tasksService   = service.Command("tasks", "Show schedule and run history of service tasks")
+	tasksVerbose   = tasksService.Flag("verbose", "Show run history").Short('v').Bool()
+	logsService    = service.Command("logs", "Show latest log lines of running pca service")
+	logsLines      = logsService.Flag("lines", "Number of lines").Short('n').Default("50").Int()
 )
 
 func SelectCommand(command []string, agent *Agent) error {
 
-	args := kingpin.MustParse(Commander.Parse(command))
+	args, parseErr := Commander.Parse(command)
+	if parseErr != nil {
+		return parseErr
+	}
 	log.Log.Debug().Msgf("catch cmd %s", args)
 	handleInterrupt := make(chan os.Signal, 1)
 	signal.Notify(handleInterrupt, os.Interrupt, os.Kill, syscall.SIGTERM)
@@ -84,22 +132,35 @@ func SelectCommand(command []string, agent *Agent) error {
 		})
 	case reconfigure.FullCommand():
 		HandleRoot()
-		oldConfig := agent.Settings
+		// file is restored as it was, settings of agent include environment overrides
+		oldConfig, readErr := os.ReadFile(ConfigPath)
+		if readErr != nil {
+			return readErr
+		}
 		editor := FindInstalledEditor()
 		captureErr, err := helpers.ShellOutCaptureErr(fmt.Sprintf("%s %s", editor, ConfigPath))
 		if err != nil || captureErr != "" {
-			SafeWriteJsonFile(oldConfig, nil, ConfigPath, 0666)
+			_ = os.WriteFile(ConfigPath, oldConfig, 0666)
 			log.Log.Warn().Err(err).Msgf("err: %s, config restored", captureErr)
+		} else if invalidErr := CheckSettingsFile(ConfigPath); invalidErr != nil {
+			_ = os.WriteFile(ConfigPath, oldConfig, 0666)
+			log.Log.Error().Err(invalidErr).Msg("Config is invalid, config restored")
+			break
 		}
-		if agent.RpcClient != nil {
-			var status int
-			err := agent.RpcClient.Call("Agent.RpcReconfigure", &status, &status)
-			if err != nil {
-				agent.RemoteUnlock()
-				log.Log.Fatal().Err(err).Msg("RpcReconfigure failed")
-			}
-		}
+		agent.RemoteReconfigure()
 		log.Log.Info().Msg("Service was reconfigured")
+	case configGet.FullCommand():
+		HandleRoot()
+		return agent.ConfigGet(*configGetKey)
+	case configSet.FullCommand():
+		HandleRoot()
+		return agent.ConfigSet(*configSetKey, *configSetValue)
+	case configValidate.FullCommand():
+		HandleRoot()
+		return agent.ConfigValidate()
+	case configShow.FullCommand():
+		HandleRoot()
+		return agent.ConfigShow(*configEffective)
 	// software manipulate
 	case installCmd.FullCommand():
 		HandleRoot()
@@ -125,7 +186,7 @@ func SelectCommand(command []string, agent *Agent) error {
 			} else {
 				if len(*removePackageIds) == 0 {
 					agent.DisplayInstalled()
-					AskInput("number of package", func(input string) bool {
+					_ = AskInput("number of package", func(input string) bool {
 						num, err := strconv.Atoi(input)
 						if err != nil {
 							log.Log.Info().Msg("Please pass int value")
@@ -177,16 +238,56 @@ func SelectCommand(command []string, agent *Agent) error {
 			}
 			agent.ConfigureProcess(softSoftwareId)
 		})
-	case shell.FullCommand():
-		//if err := test(); err != nil {
-		//	log.Log.Fatal().Err(err)
-		//}
+	case policyShow.FullCommand():
+		agent.DisplayPolicies()
+	case policySet.FullCommand():
+		HandleRoot()
 		agent.WithRemoteLock(func() {
-			err := agent.RemoteShellProcess()
+			err := agent.SetPackagePolicy(*policySetPackageId, &structs.UpdatePolicy{
+				Mode:     *policySetMode,
+				Schedule: *policySetSchedule,
+				Duration: *policySetDuration,
+				Timezone: *policySetTimezone,
+			})
 			if err != nil {
-				log.Log.Fatal().Err(err).Msg("Failed to start remote shell")
+				log.Log.Error().Err(err).Msg("Can't set policy")
 			}
 		})
+	case lockStatus.FullCommand():
+		HandleRoot()
+		if err := agent.DisplayLockStatus(); err != nil {
+			log.Log.Error().Err(err).Msg("Can't get lock status")
+		}
+	case lockBreak.FullCommand():
+		HandleRoot()
+		log.Log.Warn().Msg("Operation holding lock keeps running, break lock only of stuck process")
+		if !AskConfirm(ForceCmd) {
+			break
+		}
+		broken, err := agent.RemoteLockBreak()
+		if err != nil {
+			log.Log.Error().Err(err).Msg("Can't break lock")
+		} else if broken.Owner != nil {
+			log.Log.Warn().Int("Pid", broken.Owner.Pid).Str("Command", broken.Owner.Command).Msg("Lock was broken")
+		} else {
+			log.Log.Info().Msg("Lock is free")
+		}
+	case proxyAgents.FullCommand():
+		HandleRoot()
+		return agent.DisplayProxyAgents()
+	case proxyTrace.FullCommand():
+		return agent.DisplayProxyTrace()
+	case proxyFingerprint.FullCommand():
+		HandleRoot()
+		return agent.DisplayHttpFingerprint()
+	case commandsHistory.FullCommand():
+		agent.DisplayCommandsHistory(*commandsHistoryLimit, *commandsHistoryVerbose)
+	case shell.FullCommand():
+		HandleRoot()
+		err := agent.RemoteShellProcess(&structs.RestShellSessionGet{ID: *shellSessionId})
+		if err != nil {
+			log.Log.Fatal().Err(err).Msg("Failed to start remote shell")
+		}
 	}
 	if strings.Contains(args, service.FullCommand()) {
 		agentService := NewAgentServiceWrap(agent)
@@ -195,7 +296,7 @@ func SelectCommand(command []string, agent *Agent) error {
 		switch args {
 		case installService.FullCommand():
 			HandleRoot()
-			status, err = agentService.Install([]string{"service", "serve"}...)
+			status, err = agentService.InstallService()
 		case removeService.FullCommand():
 			HandleRoot()
 			status, err = agentService.Remove()
@@ -212,6 +313,15 @@ func SelectCommand(command []string, agent *Agent) error {
 			HandleRoot()
 			status, err = agentService.Stop()
 			status, err = agentService.Start()
+		case infoService.FullCommand():
+			HandleRoot()
+			err = agent.DisplayServiceInfo()
+		case tasksService.FullCommand():
+			HandleRoot()
+			err = agent.DisplayServiceTasks(*tasksVerbose)
+		case logsService.FullCommand():
+			HandleRoot()
+			err = agent.DisplayServiceLogs(*logsLines)
 		case serveService.FullCommand():
 			HandleRoot()
 			interrupt := make(chan os.Signal, 1)
@@ -219,7 +329,7 @@ func SelectCommand(command []string, agent *Agent) error {
 			signal.Reset()
 			agentService.OnServiceStart()
 			killSignal := <-interrupt
-			log.Log.Info().Msgf("Got signal:", killSignal)
+			log.Log.Info().Msgf("Got signal: %s", killSignal)
 			agentService.OnServiceStop()
 		}
 		if err != nil {
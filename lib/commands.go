@@ -0,0 +1,247 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/jedib0t/go-pretty/v6/text"
+	"golang.org/x/net/websocket"
+	"main/lib/helpers"
+	"main/lib/log"
+	"main/lib/structs"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	commandsSocketMinBackoff  = 1 * time.Second
+	commandsSocketMaxBackoff  = 2 * time.Minute
+	commandsSocketIdleTimeout = 5 * time.Minute
+	commandsSeenLimit         = 512
+	commandsQueueSize         = 64
+)
+
+// Commands channel
+
+// CommandsChannel receives remote commands pushed by control server over websocket
+// and from polling, and hands every command to Queue only once. Accept is called before
+// enqueue to persist command, rejected commands are dropped
+type CommandsChannel struct {
+	ApiClient *RestClient
+	Queue     chan *structs.RestCommandGet
+	Accept    func(cmd *structs.RestCommandGet) bool
+	OnShell   func(session *structs.RestShellSessionGet)
+
+	connected int32
+	closed    int32
+	overflow  int32
+	conn      *websocket.Conn
+	connLock  sync.Mutex
+
+	seen      map[int]bool
+	seenOrder []int
+	seenLock  sync.Mutex
+}
+
+func NewCommandsChannel(apiClient *RestClient) *CommandsChannel {
+	return &CommandsChannel{
+		ApiClient: apiClient,
+		Queue:     make(chan *structs.RestCommandGet, commandsQueueSize),
+		seen:      make(map[int]bool),
+		seenOrder: make([]int, 0),
+	}
+}
+
+func (ch *CommandsChannel) Connected() bool {
+	return atomic.LoadInt32(&ch.connected) == 1
+}
+
+// Offer enqueues command if it was not received before, returns false for duplicates and when queue
+// is full, then command stays journaled as received and Overflowed tells worker to run it from journal
+func (ch *CommandsChannel) Offer(cmd *structs.RestCommandGet) bool {
+	if cmd == nil || cmd.Command == "" {
+		return false
+	}
+	if !ch.claim(cmd.ID) {
+		log.Log.Debug().Int("CommandId", cmd.ID).Msg("Duplicate command skipped")
+		return false
+	}
+	// command failed to persist is not seen, so next delivery retries it
+	if ch.Accept != nil && !ch.Accept(cmd) {
+		ch.release(cmd.ID)
+		return false
+	}
+	select {
+	case ch.Queue <- cmd:
+		return true
+	default:
+		atomic.StoreInt32(&ch.overflow, 1)
+		log.Log.Warn().Int("CommandId", cmd.ID).Msg("Commands queue is full, command will be run from journal")
+		return false
+	}
+}
+
+// Overflowed tells whether commands were left out of full queue since previous call
+func (ch *CommandsChannel) Overflowed() bool {
+	return atomic.SwapInt32(&ch.overflow, 0) == 1
+}
+
+// claim marks command id as seen, it returns false when id was seen before,
+// so concurrent deliveries of same command over websocket and polling are offered once
+func (ch *CommandsChannel) claim(cmdId int) bool {
+	ch.seenLock.Lock()
+	defer ch.seenLock.Unlock()
+	if ch.seen[cmdId] {
+		return false
+	}
+	ch.markSeen(cmdId)
+	return true
+}
+
+// release forgets claimed id of command which was not accepted
+func (ch *CommandsChannel) release(cmdId int) {
+	ch.seenLock.Lock()
+	defer ch.seenLock.Unlock()
+	delete(ch.seen, cmdId)
+	for i, id := range ch.seenOrder {
+		if id == cmdId {
+			ch.seenOrder = append(ch.seenOrder[:i], ch.seenOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// markSeen remembers id of claimed command, caller holds seenLock
+func (ch *CommandsChannel) markSeen(cmdId int) {
+	ch.seen[cmdId] = true
+	ch.seenOrder = append(ch.seenOrder, cmdId)
+	if len(ch.seenOrder) > commandsSeenLimit {
+		delete(ch.seen, ch.seenOrder[0])
+		ch.seenOrder = ch.seenOrder[1:]
+	}
+}
+
+// Listen keeps websocket with control server open until Close or ctx is done, reconnects with exponential backoff
+func (ch *CommandsChannel) Listen(ctx context.Context) error {
+	atomic.StoreInt32(&ch.closed, 0)
+	backoff := commandsSocketMinBackoff
+	for atomic.LoadInt32(&ch.closed) == 0 {
+		conn, err := ch.ApiClient.OpenCommandsWebsocket()
+		if err != nil {
+			log.Log.Warn().Err(err).Str("Task", "CommandsSocket").
+				Msgf("Websocket connect failed, retry in %s", backoff)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > commandsSocketMaxBackoff {
+				backoff = commandsSocketMaxBackoff
+			}
+			continue
+		}
+		backoff = commandsSocketMinBackoff
+		ch.setConn(conn)
+		log.Log.Info().Str("Task", "CommandsSocket").Msg("Websocket connected")
+		err = ch.receive(conn)
+		ch.setConn(nil)
+		if err != nil && atomic.LoadInt32(&ch.closed) == 0 {
+			log.Log.Warn().Err(err).Str("Task", "CommandsSocket").Msg("Websocket disconnected")
+		}
+	}
+	return nil
+}
+
+func (ch *CommandsChannel) Close() {
+	atomic.StoreInt32(&ch.closed, 1)
+	ch.setConn(nil)
+}
+
+func (ch *CommandsChannel) setConn(conn *websocket.Conn) {
+	ch.connLock.Lock()
+	defer ch.connLock.Unlock()
+	if ch.conn != nil {
+		_ = ch.conn.Close()
+	}
+	ch.conn = conn
+	if conn != nil {
+		atomic.StoreInt32(&ch.connected, 1)
+	} else {
+		atomic.StoreInt32(&ch.connected, 0)
+	}
+}
+
+func (ch *CommandsChannel) receive(conn *websocket.Conn) error {
+	for {
+		err := conn.SetReadDeadline(time.Now().Add(commandsSocketIdleTimeout))
+		if err != nil {
+			return err
+		}
+		var msg structs.WsAgentMessage
+		err = websocket.JSON.Receive(conn, &msg)
+		if err != nil {
+			return err
+		}
+		switch msg.Type {
+		case "command":
+			if msg.Command == nil {
+				log.Log.Warn().Str("Task", "CommandsSocket").Msg("Empty command frame")
+				continue
+			}
+			log.Log.Debug().Int("CommandId", msg.Command.ID).Msg("Command pushed by server")
+			ch.Offer(msg.Command)
+		case "shell":
+			if msg.Shell == nil || ch.OnShell == nil {
+				log.Log.Warn().Str("Task", "CommandsSocket").Msg("Shell session request skipped")
+				continue
+			}
+			go ch.OnShell(msg.Shell)
+		case "ping":
+		default:
+			log.Log.Warn().Err(errors.New("unknown frame type")).Str("Task", "CommandsSocket").Msg(msg.Type)
+		}
+	}
+}
+
+// History
+
+func (a *Agent) DisplayCommandsHistory(limit int, verbose bool) {
+	history := a.FilesGetCommandsHistory()
+	if history == nil {
+		return
+	}
+	records := history.Records
+	if limit > 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	head := table.Row{"Id", "Command", "Status", "Exit", "Started", "Duration", "Reported", "Error"}
+	if verbose {
+		head = append(head, "Logs")
+	}
+	t := helpers.ConstructTable(&head)
+	for _, record := range records {
+		result := record.Result
+		status := text.FgGreen.Sprint(result.Status)
+		if result.Status != structs.CommandDone {
+			status = text.FgRed.Sprint(result.Status)
+		}
+		row := table.Row{result.CmdTriggerId, result.Command, status, result.ExitStatus,
+			result.StartedAt.Local().Format(time.RFC3339),
+			result.FinishedAt.Sub(result.StartedAt).Round(time.Millisecond),
+			record.Acknowledged, result.Error}
+		if verbose {
+			lines := make([]string, 0)
+			for _, line := range result.Logs {
+				lines = append(lines, fmt.Sprintf("%s %s", line["level"], line["message"]))
+			}
+			row = append(row, strings.Join(lines, "\n"))
+		}
+		t.AppendRow(row)
+		t.AppendSeparator()
+	}
+	t.Render()
+}
@@ -0,0 +1,52 @@
+package lib
+
+import (
+	"main/lib/structs"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCommandsChannelOfferOnce(t *testing.T) {
+	tests := []struct {
+		name      string
+		accept    bool
+		wantQueue int
+		wantSeen  bool
+	}{
+		{"accepted command is offered once", true, 1, true},
+		{"rejected command is retried", false, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ch := NewCommandsChannel(nil)
+			var accepted int32
+			ch.Accept = func(cmd *structs.RestCommandGet) bool {
+				atomic.AddInt32(&accepted, 1)
+				// slow journal write keeps other deliveries waiting for decision
+				time.Sleep(10 * time.Millisecond)
+				return test.accept
+			}
+			cmd := &structs.RestCommandGet{ID: 7, Command: "uptime"}
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ch.Offer(cmd)
+				}()
+			}
+			wg.Wait()
+			if len(ch.Queue) != test.wantQueue {
+				t.Fatalf("queue has %d commands, want %d", len(ch.Queue), test.wantQueue)
+			}
+			if test.accept && accepted != 1 {
+				t.Fatalf("Accept called %d times, want 1", accepted)
+			}
+			if ch.seen[cmd.ID] != test.wantSeen || len(ch.seenOrder) != len(ch.seen) {
+				t.Fatalf("seen = %v, order = %v", ch.seen, ch.seenOrder)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"main/lib/log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Non-interactive config management, keys are dotted json names, see schema.go
+
+// Environment: PCA_HOME and PCA_CONFIG locate agent files, any other PCA_<KEY> overrides setting,
+// nested keys are separated by double underscore: PCA_NET_INFO__CONTROL_IP, PCA_HTTP_ALLOW__API='["10.0.0.0/8"]'
+const (
+	EnvPrefix = "PCA_"
+	EnvHome   = "PCA_HOME"
+	EnvConfig = "PCA_CONFIG"
+)
+
+func envSettingKey(name string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimPrefix(name, EnvPrefix)), "__", ".")
+}
+
+// ApplyEnvOverrides sets keys given by PCA_* environment variables, all valid variables are applied
+func ApplyEnvOverrides(settings *Settings) error {
+	problems := make([]string, 0)
+	for _, variable := range os.Environ() {
+		name, value, _ := strings.Cut(variable, "=")
+		if !strings.HasPrefix(name, EnvPrefix) || name == EnvHome || name == EnvConfig {
+			continue
+		}
+		if err := SetSetting(settings, envSettingKey(name), value); err != nil {
+			problems = append(problems, name+": "+err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// EffectiveSettings is settings agent runs with: defaults overridden by config file and environment
+func EffectiveSettings() (*Settings, error) {
+	settings, err := ReadSettingsFile(ConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	return settings, ApplyEnvOverrides(settings)
+}
+
+func printSettingValue(value any) {
+	if text, ok := value.(string); ok {
+		fmt.Println(text)
+		return
+	}
+	data, _ := json.MarshalIndent(value, "", "  ")
+	fmt.Println(string(data))
+}
+
+func (a *Agent) ConfigGet(key string) error {
+	settings, err := EffectiveSettings()
+	if err != nil {
+		return err
+	}
+	value, err := GetSetting(settings, key)
+	if err != nil {
+		return err
+	}
+	printSettingValue(value)
+	return nil
+}
+
+// setFileKey sets value of dotted key in object of config file, missing parents are created
+func setFileKey(file map[string]any, key string, value any) {
+	parts := strings.Split(key, ".")
+	current := file
+	for _, part := range parts[:len(parts)-1] {
+		nested, ok := current[part].(map[string]any)
+		if !ok {
+			nested = make(map[string]any)
+			current[part] = nested
+		}
+		current = nested
+	}
+	current[parts[len(parts)-1]] = value
+}
+
+// ConfigSet changes one key of config file, file is written only when result is valid,
+// other keys are kept as written, so defaults are not persisted. Running service applies it by config watcher
+func (a *Agent) ConfigSet(key string, value string) error {
+	data, err := os.ReadFile(ConfigPath)
+	if err != nil {
+		return err
+	}
+	file := make(map[string]any)
+	if err = json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSettings, err.Error())
+	}
+	settings, err := ReadSettingsFile(ConfigPath)
+	if err != nil {
+		return err
+	}
+	if err = SetSetting(settings, key, value); err != nil {
+		return err
+	}
+	if err = ValidateSettings(settings); err != nil {
+		return err
+	}
+	parsed, err := GetSetting(settings, key)
+	if err != nil {
+		return err
+	}
+	setFileKey(file, key, parsed)
+	if err = SafeWriteJsonFile(file, nil, ConfigPath, 0666); err != nil {
+		return err
+	}
+	log.Log.Info().Str("Key", key).Msg("Config changed")
+	a.RemoteReconfigure()
+	return nil
+}
+
+func (a *Agent) ConfigValidate() error {
+	if err := CheckSettingsFile(ConfigPath); err != nil {
+		return err
+	}
+	log.Log.Info().Msgf("Config %s is valid", ConfigPath)
+	return nil
+}
+
+// redactedSettings is object of settings without secret, it is printed by config show
+func redactedSettings(settings any) (map[string]any, error) {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	object := make(map[string]any)
+	if err = json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+	if secret, ok := object["secret"].(string); ok && secret != "" {
+		object["secret"] = "<redacted>"
+	}
+	return object, nil
+}
+
+func (a *Agent) ConfigShow(effective bool) error {
+	var shown any
+	if effective {
+		settings, err := EffectiveSettings()
+		if err != nil {
+			return err
+		}
+		shown = settings
+	} else {
+		data, err := os.ReadFile(ConfigPath)
+		if err != nil {
+			return err
+		}
+		shown = json.RawMessage(data)
+	}
+	object, err := redactedSettings(shown)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSettings, err.Error())
+	}
+	printSettingValue(object)
+	return nil
+}
@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestConfigSetWritesOnlyFileKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		key   string
+		value string
+		want  string
+	}{
+		{"top level key", `{"debug": false}`, "debug", "true", `{"debug": true}`},
+		{"new key", `{"debug": false}`, "commands_timeout", "30", `{"debug": false, "commands_timeout": 30}`},
+		{"nested key", `{"net_info": {"protocol": "http"}}`, "net_info.control_ip", "10.0.0.1",
+			`{"net_info": {"protocol": "http", "control_ip": "10.0.0.1"}}`},
+		{"map entry", `{}`, "http_clients.ci.cert_cn", "runner",
+			`{"http_clients": {"ci": {"cert_cn": "runner"}}}`},
+	}
+	defer func(configPath string) { ConfigPath = configPath }(ConfigPath)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ConfigPath = path.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(ConfigPath, []byte(test.file), 0600); err != nil {
+				t.Fatal(err)
+			}
+			agent := &Agent{}
+			if err := agent.ConfigSet(test.key, test.value); err != nil {
+				t.Fatalf("ConfigSet(%s, %s) = %v", test.key, test.value, err)
+			}
+			data, err := os.ReadFile(ConfigPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want map[string]any
+			if err = json.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if err = json.Unmarshal([]byte(test.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("config = %s, want %s", data, test.want)
+			}
+		})
+	}
+}
+
+func TestRedactedSettings(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		want   any
+	}{
+		{"secret is redacted", "c2VjcmV0", "<redacted>"},
+		{"empty secret is shown", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			object, err := redactedSettings(&Settings{SECRET: test.secret, HttpPort: ":8080"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if object["secret"] != test.want || object["http_port"] != ":8080" {
+				t.Fatalf("secret = %v, http_port = %v, want %v and :8080", object["secret"], object["http_port"], test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,408 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"main/lib/helpers"
+	"main/lib/jsonrpc"
+	"main/lib/log"
+	"main/lib/structs"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Control api served by service on control socket, see structs/rpc.go for methods
+
+const defaultTailLines = 100
+const maxTailLines = 10000
+
+type leaseKey struct{}
+
+// eventHub fans out events to subscribed control connections, slow subscribers lose events
+type eventHub struct {
+	lock        sync.Mutex
+	subscribers map[*jsonrpc.Conn]*eventSubscriber
+}
+
+type eventSubscriber struct {
+	types  []string
+	events chan *structs.RpcEventParams
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[*jsonrpc.Conn]*eventSubscriber)}
+}
+
+func (hub *eventHub) publish(eventType string, data map[string]any) {
+	event := &structs.RpcEventParams{Type: eventType, Time: time.Now(), Data: data}
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	for _, subscriber := range hub.subscribers {
+		if len(subscriber.types) > 0 && !helpers.Contains(subscriber.types, eventType) {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+		}
+	}
+}
+
+func (hub *eventHub) subscribe(conn *jsonrpc.Conn, types []string) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if subscriber, ok := hub.subscribers[conn]; ok {
+		subscriber.types = types
+		return
+	}
+	subscriber := &eventSubscriber{types: types, events: make(chan *structs.RpcEventParams, 256)}
+	hub.subscribers[conn] = subscriber
+	go func() {
+		for {
+			select {
+			case <-conn.Done():
+				hub.lock.Lock()
+				delete(hub.subscribers, conn)
+				hub.lock.Unlock()
+				return
+			case event := <-subscriber.events:
+				if conn.Notify(structs.RpcEvent, event) != nil {
+					_ = conn.Close()
+				}
+			}
+		}
+	}()
+}
+
+func (service *AgentServiceWrap) newControlServer() *jsonrpc.Server {
+	server := jsonrpc.NewServer()
+	server.OnClose = service.releaseConnLease
+	jsonrpc.Handle(server, structs.RpcLock, service.rpcLock)
+	jsonrpc.Handle(server, structs.RpcUnlock, service.rpcUnlock)
+	jsonrpc.Handle(server, structs.RpcRenew, service.rpcRenew)
+	jsonrpc.Handle(server, structs.RpcLockStatus, service.rpcLockStatus)
+	jsonrpc.Handle(server, structs.RpcLockBreak, service.rpcLockBreak)
+	jsonrpc.Handle(server, structs.RpcReconfigure, service.rpcReconfigure)
+	jsonrpc.Handle(server, structs.RpcReload, service.rpcReload)
+	jsonrpc.Handle(server, structs.RpcRun, service.rpcRun)
+	jsonrpc.Handle(server, structs.RpcSubscribe, service.rpcSubscribe)
+	jsonrpc.Handle(server, structs.RpcStatus, service.rpcStatus)
+	jsonrpc.Handle(server, structs.RpcTailLogs, service.rpcTailLogs)
+	jsonrpc.Handle(server, structs.RpcProxyAgents, service.rpcProxyAgents)
+	return server
+}
+
+// newReadOnlyControlServer serves tcp port, which is reachable from network without peer credentials,
+// so only methods which don't change service and don't run commands are exposed; logs are not,
+// as they contain command arguments, server responses and paths
+func (service *AgentServiceWrap) newReadOnlyControlServer() *jsonrpc.Server {
+	server := jsonrpc.NewServer()
+	jsonrpc.Handle(server, structs.RpcLockStatus, service.rpcLockStatus)
+	jsonrpc.Handle(server, structs.RpcStatus, service.rpcStatus)
+	return server
+}
+
+// selectCommand runs cli command inside service, commands share global flags of kingpin and AssumeYes,
+// so they never run at once
+func (service *AgentServiceWrap) selectCommand(args []string, assumeYes bool) error {
+	service.commandLock.Lock()
+	defer service.commandLock.Unlock()
+	AssumeYes = assumeYes
+	defer func() { AssumeYes = false }()
+	return SelectCommand(args, &service.Agent)
+}
+
+// connLease returns lease held by connection, lease which expired or was broken is not returned
+func (service *AgentServiceWrap) connLease(conn *jsonrpc.Conn) string {
+	value, ok := conn.Get(leaseKey{})
+	if !ok {
+		return ""
+	}
+	id, _ := value.(string)
+	if id == "" || !service.leases.held(id) {
+		return ""
+	}
+	return id
+}
+
+func (service *AgentServiceWrap) rpcLock(conn *jsonrpc.Conn, params *structs.RpcLockParams) (*structs.RpcLockResult, error) {
+	if service.connLease(conn) != "" {
+		return nil, errors.New("connection already holds lock")
+	}
+	held, err := service.leases.acquire(params.Owner, params.Ttl)
+	if err != nil {
+		return nil, err
+	}
+	conn.Set(leaseKey{}, held.id)
+	log.Log.Debug().Int("Pid", held.owner.Pid).Str("Command", held.owner.Command).Msg("Service locked")
+	service.events.publish(structs.EventLock, map[string]any{"locked": true, "owner": held.owner})
+	return &structs.RpcLockResult{LeaseId: held.id, AcquiredAt: held.acquiredAt, ExpiresAt: held.expiresAt}, nil
+}
+
+func (service *AgentServiceWrap) rpcRenew(conn *jsonrpc.Conn, params *structs.RpcRenewParams) (*structs.RpcRenewResult, error) {
+	if service.connLease(conn) != params.LeaseId {
+		return nil, ErrLockNotHeld
+	}
+	expiresAt, err := service.leases.renew(params.LeaseId)
+	if err != nil {
+		return nil, err
+	}
+	return &structs.RpcRenewResult{ExpiresAt: expiresAt}, nil
+}
+
+// onLeaseRelease runs on every lease release: unlock, disconnect, expiry and break
+func (service *AgentServiceWrap) onLeaseRelease(held *lease) {
+	service.FilesReload()
+	log.Log.Debug().Int("Pid", held.owner.Pid).Str("Command", held.owner.Command).Msg("Service unlocked")
+	service.events.publish(structs.EventLock, map[string]any{"locked": false, "owner": held.owner})
+}
+
+func (service *AgentServiceWrap) rpcUnlock(conn *jsonrpc.Conn, params *structs.RpcUnlockParams) (*structs.RpcEmpty, error) {
+	if service.connLease(conn) != params.LeaseId {
+		return nil, errors.New("lease is not held by connection")
+	}
+	conn.Set(leaseKey{}, "")
+	if err := service.leases.release(params.LeaseId); err != nil {
+		return nil, err
+	}
+	return &structs.RpcEmpty{}, nil
+}
+
+// releaseConnLease unlocks service when client disconnects without unlock
+func (service *AgentServiceWrap) releaseConnLease(conn *jsonrpc.Conn) {
+	if id := service.connLease(conn); id != "" {
+		log.Log.Warn().Msg("Control client disconnected, release its lock")
+		_ = service.leases.release(id)
+	}
+}
+
+func (service *AgentServiceWrap) rpcLockStatus(_ *jsonrpc.Conn, _ *structs.RpcEmpty) (*structs.RpcLockStatusResult, error) {
+	return service.leases.status(), nil
+}
+
+// rpcLockBreak releases lease of other client, e.g. of process stuck in operation,
+// lock held by task of service can't be broken
+func (service *AgentServiceWrap) rpcLockBreak(_ *jsonrpc.Conn, _ *structs.RpcEmpty) (*structs.RpcLockStatusResult, error) {
+	held, err := service.leases.breakLease()
+	if err != nil {
+		if status := service.leases.status(); status.Holder == structs.LockService {
+			return nil, errors.New("lock is held by service task, it can't be broken")
+		}
+		return nil, err
+	}
+	log.Log.Warn().Int("Pid", held.owner.Pid).Str("Command", held.owner.Command).Msg("Lock was broken")
+	return &structs.RpcLockStatusResult{Locked: true, Holder: structs.LockLease, Owner: held.owner,
+		AcquiredAt: timeRef(held.acquiredAt), ExpiresAt: timeRef(held.expiresAt)}, nil
+}
+
+// rpcReconfigure applies config file same way as config watcher does
+func (service *AgentServiceWrap) rpcReconfigure(_ *jsonrpc.Conn, _ *structs.RpcEmpty) (*structs.RpcEmpty, error) {
+	if err := service.reloadConfigFile("rpc"); err != nil {
+		return nil, err
+	}
+	return &structs.RpcEmpty{}, nil
+}
+
+func (service *AgentServiceWrap) rpcReload(_ *jsonrpc.Conn, _ *structs.RpcEmpty) (*structs.RpcReloadResult, error) {
+	service.FilesReload()
+	service.events.publish(structs.EventReload, map[string]any{"installed": len(service.Installed)})
+	return &structs.RpcReloadResult{Installed: len(service.Installed), StateVersion: service.FilesStateVersion()}, nil
+}
+
+// rpcRun runs cli command inside service and streams its log lines to caller as progress events
+func (service *AgentServiceWrap) rpcRun(conn *jsonrpc.Conn, params *structs.RpcRunParams) (*structs.RpcRunResult, error) {
+	if len(params.Args) == 0 {
+		return nil, &jsonrpc.Error{Code: jsonrpc.CodeInvalidParams, Message: "args must not be empty"}
+	}
+	result := &structs.RpcRunResult{}
+	run := func() error {
+		result.StartedAt = time.Now()
+		progress := make(chan map[string]any, 256)
+		streamed := make(chan struct{})
+		go func() {
+			defer close(streamed)
+			for line := range progress {
+				_ = conn.Notify(structs.RpcEvent, &structs.RpcEventParams{
+					Type: structs.EventProgress, Time: time.Now(), Data: line})
+			}
+		}()
+		stopStream := log.Follow(func(line map[string]any) {
+			select {
+			case progress <- line:
+			default:
+			}
+		})
+		stopCapture := log.Capture()
+		cmdErr := service.selectCommand(params.Args, params.AssumeYes)
+		result.FinishedAt = time.Now()
+		result.Logs = stopCapture()
+		stopStream()
+		close(progress)
+		<-streamed
+		return cmdErr
+	}
+	var err error
+	if service.connLease(conn) != "" {
+		err = run()
+	} else {
+		err = WithLock(service.lock, run)()
+	}
+	if errors.Is(err, ErrLockBusy) {
+		return nil, err
+	}
+	result.Status = structs.CommandDone
+	for _, line := range result.Logs {
+		if line["level"] == "error" || line["level"] == "fatal" {
+			result.Status = structs.CommandFailed
+		}
+	}
+	if err != nil {
+		result.Status = structs.CommandFailed
+		result.Error = err.Error()
+	}
+	return result, nil
+}
+
+func (service *AgentServiceWrap) rpcSubscribe(conn *jsonrpc.Conn, params *structs.RpcSubscribeParams) (*structs.RpcEmpty, error) {
+	service.events.subscribe(conn, params.Types)
+	return &structs.RpcEmpty{}, nil
+}
+
+func (service *AgentServiceWrap) rpcStatus(_ *jsonrpc.Conn, _ *structs.RpcEmpty) (*structs.LocalStatusGet, error) {
+	return service.LocalStatus(), nil
+}
+
+func (service *AgentServiceWrap) rpcTailLogs(_ *jsonrpc.Conn, params *structs.RpcTailLogsParams) (*structs.RpcTailLogsResult, error) {
+	count := params.Lines
+	if count <= 0 {
+		count = defaultTailLines
+	}
+	if count > maxTailLines {
+		count = maxTailLines
+	}
+	lines, err := helpers.TailLines(filepath.Join(service.Settings.LogDir, "pca.log"), count)
+	if err != nil {
+		return nil, err
+	}
+	result := &structs.RpcTailLogsResult{Lines: make([]map[string]any, 0, len(lines))}
+	for _, line := range lines {
+		entry := make(map[string]any)
+		if json.Unmarshal([]byte(line), &entry) != nil {
+			entry = map[string]any{"message": line}
+		}
+		result.Lines = append(result.Lines, entry)
+	}
+	return result, nil
+}
+
+// Control api clients
+
+func (a *Agent) DisplayServiceInfo() error {
+	status, err := a.RemoteStatus()
+	if err != nil {
+		return err
+	}
+	registered := "no"
+	if status.Registration.Registered && status.Registration.RegisteredAt != nil {
+		registered = status.Registration.RegisteredAt.Local().Format(time.RFC3339)
+	}
+	lastContact := "never"
+	if status.Control.LastSuccessAt != nil {
+		lastContact = status.Control.LastSuccessAt.Local().Format(time.RFC3339)
+	}
+	info := helpers.ConstructTable(&table.Row{"Version", "Started", "Registered", "Control", "Reachable", "Last contact", "Socket"})
+	info.AppendRow(table.Row{status.Version, status.StartedAt.Local().Format(time.RFC3339), registered,
+		status.Control.Endpoint, status.Control.Reachable, lastContact, status.Control.CommandsSocket})
+	info.Render()
+	return nil
+}
+
+func (a *Agent) DisplayServiceTasks(verbose bool) error {
+	status, err := a.RemoteStatus()
+	if err != nil {
+		return err
+	}
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Local().Format(time.RFC3339)
+	}
+	tasks := helpers.ConstructTable(&table.Row{"#", "Task", "Schedule", "Running", "Runs", "Errors", "Failing",
+		"Last run", "Next run", "Last error"})
+	for i, task := range status.Tasks {
+		tasks.AppendRow(table.Row{i + 1, task.Name, task.Schedule, task.Running, task.Runs, task.Errors,
+			task.ConsecutiveErrors, formatTime(task.LastRun), formatTime(task.NextRun), task.LastError})
+	}
+	tasks.Render()
+	if !verbose {
+		return nil
+	}
+	for _, task := range status.Tasks {
+		if len(task.History) == 0 {
+			continue
+		}
+		history := helpers.ConstructTable(&table.Row{task.Name, "Started", "Duration", "Error"})
+		for i, run := range task.History {
+			history.AppendRow(table.Row{i + 1, formatTime(run.StartedAt),
+				time.Duration(run.Duration * float64(time.Second)).Round(time.Millisecond), run.Error})
+		}
+		history.Render()
+	}
+	return nil
+}
+
+func (a *Agent) DisplayLockStatus() error {
+	status, err := a.RemoteLockStatus()
+	if err != nil {
+		return err
+	}
+	lockTable := helpers.ConstructTable(&table.Row{"Locked", "Holder", "Pid", "Command", "Acquired", "Expires"})
+	row := table.Row{status.Locked, status.Holder, "", "", "", ""}
+	if status.Owner != nil {
+		row[2], row[3] = status.Owner.Pid, status.Owner.Command
+	}
+	if status.AcquiredAt != nil {
+		row[4] = status.AcquiredAt.Local().Format(time.RFC3339)
+	}
+	if status.ExpiresAt != nil {
+		row[5] = status.ExpiresAt.Local().Format(time.RFC3339)
+	}
+	lockTable.AppendRow(row)
+	lockTable.Render()
+	return nil
+}
+
+func (service *AgentServiceWrap) rpcProxyAgents(_ *jsonrpc.Conn, _ *structs.RpcEmpty) (*structs.RpcProxyAgentsResult, error) {
+	return &structs.RpcProxyAgentsResult{Agents: service.downstream.Agents()}, nil
+}
+
+func (a *Agent) DisplayProxyAgents() error {
+	agents, err := a.RemoteProxyAgents()
+	if err != nil {
+		return err
+	}
+	agentsTable := helpers.ConstructTable(&table.Row{"Secret sha256", "Status", "Address", "Local address",
+		"Version", "First seen", "Last seen", "Requests", "Limited"})
+	for _, agent := range agents {
+		agentsTable.AppendRow(table.Row{agent.SecretSha256[:12], agent.Status, agent.Address, agent.LocalAddress,
+			agent.Version, agent.FirstSeen.Local().Format(time.RFC3339), agent.LastSeen.Local().Format(time.RFC3339),
+			agent.Requests, agent.Limited})
+	}
+	agentsTable.Render()
+	return nil
+}
+
+func (a *Agent) DisplayServiceLogs(lines int) error {
+	logs, err := a.RemoteTailLogs(lines)
+	if err != nil {
+		return err
+	}
+	for _, line := range logs {
+		fmt.Printf("%v %v %v\n", line["time"], line["level"], line["message"])
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package lib
+
+import (
+	"main/lib/structs"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testSettings keeps files of service in temporary dir
+func testSettings(t *testing.T) *Settings {
+	dir := t.TempDir()
+	settings := DefaultSettings()
+	settings.LockFile = path.Join(dir, "pca.lock")
+	settings.InfoDir = path.Join(dir, "install.d")
+	settings.SystemDir = path.Join(dir, "system")
+	return settings
+}
+
+func TestSelectCommandWhileServiceHoldsLockFile(t *testing.T) {
+	settings := testSettings(t)
+	fileLock, _, err := TryProcessLock(settings.LockFile, CurrentLockOwner())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileLock.Unlock()
+	service := NewAgentServiceWrap(NewAgent(settings, nil, nil))
+	service.fileLock = fileLock
+	if err = service.selectCommand([]string{"list"}, false); err != nil {
+		t.Fatalf("selectCommand(list) = %v", err)
+	}
+}
+
+func TestReadOnlyControlServerMethods(t *testing.T) {
+	service := NewAgentServiceWrap(NewAgent(testSettings(t), nil, nil))
+	methods := service.newReadOnlyControlServer().Methods()
+	sort.Strings(methods)
+	want := []string{structs.RpcLockStatus, structs.RpcStatus}
+	sort.Strings(want)
+	if !reflect.DeepEqual(methods, want) {
+		t.Fatalf("read only methods = %v, want %v", methods, want)
+	}
+}
@@ -0,0 +1,326 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"main/lib/helpers"
+	"main/lib/log"
+	"main/lib/structs"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Downstream agents of relay: agent is identified by sha256 of its SECRET (bearer token).
+// Requests are forwarded for agents registered through relay or approved by upstream. Before first request
+// of unknown agent relay asks upstream read only route with credentials of agent, only 2xx approves it.
+// Entries of agents never approved expire, and one address may hold limited number of them.
+
+// ProxyRateLimit is default rate of requests per second of one downstream agent, ProxyRateBurst is bucket size
+const (
+	ProxyRateLimit = 20
+	ProxyRateBurst = 100
+)
+
+// downstreamRecheck is how long denied agent is rejected without asking upstream again
+const downstreamRecheck = 10 * time.Minute
+
+// downstreamUnapprovedTtl is how long agent neither registered nor approved is remembered after last request
+const downstreamUnapprovedTtl = time.Hour
+
+// maxUnapprovedPerAddress limits agents neither registered nor approved from one address,
+// so random secrets can't grow registry
+const maxUnapprovedPerAddress = 16
+
+// maxDownstreamBuckets triggers pruning of idle rate limit buckets
+const maxDownstreamBuckets = 1024
+
+// downstreamSaveInterval limits writes of registry caused by last seen updates
+const downstreamSaveInterval = time.Minute
+
+const downstreamRegPath = "/api/v1/agent/reg"
+
+// tokenBucket allows rate requests per second with bursts up to burst requests
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func (bucket *tokenBucket) allow(rate float64, burst int, now time.Time) bool {
+	if bucket.updated.IsZero() {
+		bucket.tokens = float64(burst)
+	} else {
+		bucket.tokens = math.Min(float64(burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*rate)
+	}
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// pruneBuckets forgets buckets refilled to burst, they are equal to new ones
+func (registry *downstreamRegistry) pruneBuckets(now time.Time, rate float64) {
+	refill := time.Duration(float64(registry.settings.ProxyRateBurst) / rate * float64(time.Second))
+	for key, bucket := range registry.buckets {
+		if now.Sub(bucket.updated) > refill {
+			delete(registry.buckets, key)
+		}
+	}
+}
+
+// approved agents are registered through relay or approved by upstream
+func approved(agent *structs.DownstreamAgent) bool {
+	return agent.Status == structs.DownstreamRegistered || agent.Status == structs.DownstreamApproved
+}
+
+// expireUnapproved forgets agents never approved which were not seen for downstreamUnapprovedTtl, caller holds lock
+func (registry *downstreamRegistry) expireUnapproved(now time.Time) bool {
+	expired := false
+	for key, agent := range registry.agents {
+		if !approved(agent) && now.Sub(agent.LastSeen) > downstreamUnapprovedTtl {
+			delete(registry.agents, key)
+			delete(registry.buckets, key)
+			expired = true
+		}
+	}
+	return expired
+}
+
+// unapprovedFrom counts agents never approved of address, caller holds lock
+func (registry *downstreamRegistry) unapprovedFrom(address string) int {
+	count := 0
+	for _, agent := range registry.agents {
+		if agent.Address == address && !approved(agent) {
+			count++
+		}
+	}
+	return count
+}
+
+// downstreamVisit is admitted request of downstream agent, its outcome updates registry
+type downstreamVisit struct {
+	key   string
+	probe bool
+	reg   *structs.RestRegPost
+}
+
+type downstreamRegistry struct {
+	settings *Settings
+	lock     *sync.Mutex
+	loaded   bool
+	agents   map[string]*structs.DownstreamAgent
+	buckets  map[string]*tokenBucket
+	savedAt  time.Time
+}
+
+func newDownstreamRegistry(settings *Settings) *downstreamRegistry {
+	return &downstreamRegistry{
+		settings: settings,
+		lock:     &sync.Mutex{},
+		agents:   map[string]*structs.DownstreamAgent{},
+		buckets:  map[string]*tokenBucket{},
+	}
+}
+
+func (registry *downstreamRegistry) path() string {
+	return filepath.Join(registry.settings.SystemDir, "downstream.json")
+}
+
+// load reads registry once, caller holds lock
+func (registry *downstreamRegistry) load() {
+	if registry.loaded {
+		return
+	}
+	registry.loaded = true
+	if !helpers.FileExists(registry.path()) {
+		return
+	}
+	agents := make([]*structs.DownstreamAgent, 0)
+	if err := SafeReadJsonFile(registry.path(), &agents); err != nil {
+		log.Log.Error().Err(err).Msg("Can't read registry of downstream agents")
+		return
+	}
+	for _, agent := range agents {
+		registry.agents[agent.SecretSha256] = agent
+	}
+}
+
+// save writes registry, caller holds lock
+func (registry *downstreamRegistry) save() {
+	if err := SafeWriteJsonFile(registry.list(), nil, registry.path(), 0600); err != nil {
+		log.Log.Error().Err(err).Msg("Can't save registry of downstream agents")
+		return
+	}
+	registry.savedAt = time.Now()
+}
+
+func (registry *downstreamRegistry) list() []*structs.DownstreamAgent {
+	agents := make([]*structs.DownstreamAgent, 0, len(registry.agents))
+	for _, agent := range registry.agents {
+		copied := *agent
+		agents = append(agents, &copied)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].FirstSeen.Before(agents[j].FirstSeen) })
+	return agents
+}
+
+func (registry *downstreamRegistry) Agents() []*structs.DownstreamAgent {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.load()
+	return registry.list()
+}
+
+func bearerToken(req *http.Request) string {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func secretSha256(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func rejectDownstream(w http.ResponseWriter, req *http.Request, code int, msg string) {
+	log.Log.Warn().Str("Client", req.RemoteAddr).Int("Code", code).Msgf("Proxy request rejected: %s %s: %s",
+		req.Method, req.URL.Path, msg)
+	_ = WriteJsonResponse(w, code, map[string]any{"msg": msg})
+}
+
+// admit decides whether request is forwarded, rejected request is answered here,
+// reg is body of reg request
+func (registry *downstreamRegistry) admit(w http.ResponseWriter, req *http.Request, reg *structs.RestRegPost) (*downstreamVisit, bool) {
+	token := bearerToken(req)
+	visit := &downstreamVisit{reg: reg}
+	if token == "" && reg != nil {
+		token = reg.AgentSecret
+	}
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pca"`)
+		rejectDownstream(w, req, http.StatusUnauthorized, "agent secret is required")
+		return nil, false
+	}
+	visit.key = secretSha256(token)
+	address := clientIp(req).String()
+	now := time.Now()
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.load()
+	agent := registry.agents[visit.key]
+	if agent == nil {
+		if registry.expireUnapproved(now) {
+			registry.save()
+		}
+		if registry.unapprovedFrom(address) >= maxUnapprovedPerAddress {
+			metricDownstreamLimited.Inc()
+			rejectDownstream(w, req, http.StatusTooManyRequests, "too many unknown agents from "+address)
+			return nil, false
+		}
+	}
+	if rate := registry.settings.ProxyRateLimit; rate > 0 {
+		bucket, ok := registry.buckets[visit.key]
+		if !ok && len(registry.buckets) >= maxDownstreamBuckets {
+			registry.pruneBuckets(now, float64(rate))
+		}
+		if !ok {
+			bucket = &tokenBucket{}
+			registry.buckets[visit.key] = bucket
+		}
+		if !bucket.allow(float64(rate), registry.settings.ProxyRateBurst, now) {
+			if agent := registry.agents[visit.key]; agent != nil {
+				agent.Limited++
+			}
+			metricDownstreamLimited.Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(1/float64(rate)))))
+			rejectDownstream(w, req, http.StatusTooManyRequests, "rate limit exceeded")
+			return nil, false
+		}
+	}
+	if agent == nil {
+		agent = &structs.DownstreamAgent{SecretSha256: visit.key, FirstSeen: now}
+		registry.agents[visit.key] = agent
+	}
+	agent.Address = address
+	agent.LastSeen = now
+	agent.Requests++
+	if now.Sub(registry.savedAt) > downstreamSaveInterval {
+		registry.save()
+	}
+	switch {
+	case visit.reg != nil:
+		// registration is always forwarded, control server decides on it
+	case approved(agent):
+	case agent.Status == structs.DownstreamPending:
+		rejectDownstream(w, req, http.StatusForbidden, "agent approval is pending")
+		return nil, false
+	case agent.Status == structs.DownstreamDenied && now.Sub(agent.CheckedAt) < downstreamRecheck:
+		rejectDownstream(w, req, http.StatusForbidden, "agent is not approved by control server")
+		return nil, false
+	default:
+		agent.Status = structs.DownstreamPending
+		visit.probe = true
+	}
+	return visit, true
+}
+
+// observe registers agent by successful answer to reg forwarded through relay
+func (registry *downstreamRegistry) observe(visit *downstreamVisit, code int) {
+	if visit.reg == nil || code < 200 || code >= 300 {
+		return
+	}
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	agent := registry.agents[visit.key]
+	if agent == nil {
+		return
+	}
+	status := agent.Status
+	agent.Status = structs.DownstreamRegistered
+	agent.Version = visit.reg.Version
+	agent.System = visit.reg.System
+	agent.LocalAddress = visit.reg.LocalAddress
+	agent.CheckedAt = time.Now()
+	registry.changed(agent, status)
+}
+
+// decide sets status of agent by code of approval check: 2xx approves, 401 and 403 deny,
+// anything else including failed check (code 0) leaves agent unknown, returns whether agent is approved
+func (registry *downstreamRegistry) decide(visit *downstreamVisit, code int) bool {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	agent := registry.agents[visit.key]
+	if agent == nil {
+		return false
+	}
+	status := agent.Status
+	switch {
+	case code >= 200 && code < 300:
+		agent.Status = structs.DownstreamApproved
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		agent.Status = structs.DownstreamDenied
+	default:
+		agent.Status = ""
+	}
+	agent.CheckedAt = time.Now()
+	registry.changed(agent, status)
+	return agent.Status == structs.DownstreamApproved
+}
+
+// changed logs new status of agent and saves registry, caller holds lock
+func (registry *downstreamRegistry) changed(agent *structs.DownstreamAgent, status string) {
+	if agent.Status != status {
+		log.Log.Info().Str("Agent", agent.SecretSha256[:12]).Str("Address", agent.Address).
+			Str("Version", agent.Version).Msgf("Downstream agent is %s", agent.Status)
+	}
+	registry.save()
+}
@@ -0,0 +1,46 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketAllow(t *testing.T) {
+	type request struct {
+		at   time.Duration
+		want bool
+	}
+	tests := []struct {
+		name     string
+		rate     float64
+		burst    int
+		requests []request
+	}{
+		{"burst then limited", 1, 3, []request{
+			{0, true}, {0, true}, {0, true}, {0, false},
+		}},
+		{"refill at rate", 2, 1, []request{
+			{0, true}, {100 * time.Millisecond, false}, {500 * time.Millisecond, true}, {600 * time.Millisecond, false},
+		}},
+		{"partial tokens accumulate", 1, 1, []request{
+			{0, true}, {400 * time.Millisecond, false}, {800 * time.Millisecond, false}, {1200 * time.Millisecond, true},
+		}},
+		{"refill capped at burst", 10, 2, []request{
+			{0, true}, {0, true}, {time.Hour, true}, {time.Hour, true}, {time.Hour, false},
+		}},
+		{"zero burst", 1, 0, []request{
+			{0, false}, {time.Minute, false},
+		}},
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucket := &tokenBucket{}
+			for i, req := range test.requests {
+				if got := bucket.allow(test.rate, test.burst, start.Add(req.at)); got != req.want {
+					t.Fatalf("request %d at %s: allow() = %v, want %v", i, req.at, got, req.want)
+				}
+			}
+		})
+	}
+}
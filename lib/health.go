@@ -0,0 +1,273 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"main/lib/log"
+	"main/lib/structs"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultProbeTimeout = 5 * time.Second
+const defaultReadinessTimeout = 120 * time.Second
+
+// Probes
+
+// systemdUnitName matches valid unit names, unit of probe is given by control server
+var systemdUnitName = regexp.MustCompile(`^[A-Za-z0-9@._:-]+$`)
+
+// SystemdUnitState reads active state, sub state and restart counter of systemd unit
+func SystemdUnitState(unit string) (string, string, int, error) {
+	if !systemdUnitName.MatchString(unit) {
+		return "", "", 0, fmt.Errorf("invalid systemd unit name %q", unit)
+	}
+	var errOut bytes.Buffer
+	cmd := exec.Command("systemctl", "show", "--property=ActiveState,SubState,NRestarts", "--", unit)
+	cmd.Stderr = &errOut
+	out, err := cmd.Output()
+	if err != nil {
+		return "", "", 0, fmt.Errorf("systemctl show %s: %s %w", unit, strings.TrimSpace(errOut.String()), err)
+	}
+	var active, sub string
+	var restarts int
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "ActiveState":
+			active = value
+		case "SubState":
+			sub = value
+		case "NRestarts":
+			restarts, _ = strconv.Atoi(value)
+		}
+	}
+	return active, sub, restarts, nil
+}
+
+// RunProbe runs probe once, command probes run shell commands given by control server as root,
+// so they fail unless command_probes_enabled is set
+func RunProbe(settings *Settings, probe *structs.HealthProbe) *structs.ProbeResult {
+	timeout := defaultProbeTimeout
+	if probe.Timeout > 0 {
+		timeout = time.Duration(probe.Timeout) * time.Second
+	}
+	result := &structs.ProbeResult{Kind: probe.Kind, Target: probe.Target}
+	started := time.Now()
+	defer func() { result.Duration = time.Since(started).Milliseconds() }()
+	switch probe.Kind {
+	case structs.ProbeSystemd:
+		active, sub, _, err := SystemdUnitState(probe.Target)
+		if err != nil {
+			result.Message = err.Error()
+			return result
+		}
+		result.Healthy = active == "active"
+		result.Message = active + "/" + sub
+	case structs.ProbeHttp:
+		client := &http.Client{Timeout: timeout}
+		resp, err := client.Get(probe.Target)
+		if err != nil {
+			result.Message = err.Error()
+			return result
+		}
+		_ = resp.Body.Close()
+		result.Healthy = resp.StatusCode < 400
+		result.Message = resp.Status
+	case structs.ProbeTcp:
+		conn, err := net.DialTimeout("tcp", probe.Target, timeout)
+		if err != nil {
+			result.Message = err.Error()
+			return result
+		}
+		_ = conn.Close()
+		result.Healthy = true
+		result.Message = "connected"
+	case structs.ProbeCommand:
+		if !settings.CommandProbesEnabled {
+			result.Message = "command probes are disabled in settings (command_probes_enabled)"
+			return result
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, "bash", "-c", probe.Target).CombinedOutput()
+		result.Healthy = err == nil
+		result.Message = strings.TrimSpace(string(out))
+		if err != nil {
+			result.Message = strings.TrimSpace(err.Error() + " " + result.Message)
+		}
+	default:
+		result.Message = fmt.Sprintf("unknown probe kind %q", probe.Kind)
+	}
+	return result
+}
+
+// WaitReadiness runs readiness probes of software until all of them pass (for Hold seconds)
+// or readiness timeout expires, returns latest probe results
+func WaitReadiness(settings *Settings, software *structs.Software) ([]*structs.ProbeResult, error) {
+	results := make([]*structs.ProbeResult, len(software.Readiness))
+	if len(software.Readiness) == 0 {
+		return results, nil
+	}
+	timeout := defaultReadinessTimeout
+	if software.ReadinessTimeout > 0 {
+		timeout = time.Duration(software.ReadinessTimeout) * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	passingSince := make([]time.Time, len(software.Readiness))
+	passed := make([]bool, len(software.Readiness))
+	log.Log.Info().Msgf("Wait readiness of %s (%s)", software.Name, timeout)
+	for {
+		ready := true
+		for i, probe := range software.Readiness {
+			if passed[i] {
+				continue
+			}
+			results[i] = RunProbe(settings, probe)
+			if !results[i].Healthy {
+				passingSince[i] = time.Time{}
+				ready = false
+				continue
+			}
+			if passingSince[i].IsZero() {
+				passingSince[i] = time.Now()
+			}
+			if time.Since(passingSince[i]) >= time.Duration(probe.Hold)*time.Second {
+				passed[i] = true
+			} else {
+				ready = false
+			}
+		}
+		if ready {
+			log.Log.Info().Msgf("Software %s is ready", software.Name)
+			return results, nil
+		}
+		if time.Now().After(deadline) {
+			return results, fmt.Errorf("software %s not ready in %s", software.Name, timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Health
+
+// CheckSoftwareHealth checks systemd service of deb software or application files and runs software probes,
+// returns nil for software without anything to check
+func CheckSoftwareHealth(settings *Settings, info *SavedInfo, software *structs.Software) *structs.ServiceHealth {
+	if software.Build == nil || software.Build.FileSpec == nil || software.Build.FileSpec.Status != structs.Installed {
+		return nil
+	}
+	health := &structs.ServiceHealth{
+		PackageID:  info.Package.ID,
+		SoftwareID: software.ID,
+		Name:       software.Name,
+		Status:     structs.HealthHealthy,
+		Probes:     make([]*structs.ProbeResult, 0),
+		CheckedAt:  time.Now(),
+	}
+	checked := false
+	addProbe := func(result *structs.ProbeResult) {
+		health.Probes = append(health.Probes, result)
+		if !result.Healthy {
+			health.Status = structs.HealthFailing
+		}
+	}
+	if software.PackageInfo != nil {
+		if service := software.PackageInfo.ServiceInfo; service != nil && service.Name != "" {
+			checked = true
+			health.Unit = service.Name
+			active, sub, restarts, err := SystemdUnitState(service.Name)
+			health.ActiveState, health.SubState, health.Restarts = active, sub, restarts
+			if err != nil || active != "active" {
+				health.Status = structs.HealthFailing
+			}
+		}
+		if app := software.PackageInfo.AppInfo; app != nil && app.AppPath != "" {
+			checked = true
+			_, err := os.Stat(app.AppPath)
+			addProbe(&structs.ProbeResult{Kind: "path", Target: app.AppPath, Healthy: err == nil})
+		}
+		if autorun := software.PackageInfo.AutorunInfo; autorun != nil && autorun.Path != "" {
+			checked = true
+			_, err := os.Stat(autorun.Path)
+			addProbe(&structs.ProbeResult{Kind: "autorun", Target: autorun.Path, Healthy: err == nil})
+		}
+	}
+	for _, probe := range software.Probes {
+		checked = true
+		addProbe(RunProbe(settings, probe))
+	}
+	if !checked {
+		return nil
+	}
+	return health
+}
+
+// checkRestarts fails health of systemd service restarted since previous check, so crash loop
+// of service which is active at check time is noticed
+func (service *AgentServiceWrap) checkRestarts(health *structs.ServiceHealth) {
+	if health.Unit == "" {
+		return
+	}
+	previous, known := service.restarts[health.SoftwareID]
+	service.restarts[health.SoftwareID] = health.Restarts
+	if !known || health.Restarts <= previous {
+		return
+	}
+	health.Status = structs.HealthFailing
+	health.Probes = append(health.Probes, &structs.ProbeResult{
+		Kind:    "restarts",
+		Target:  health.Unit,
+		Message: fmt.Sprintf("restarted %d times since previous check", health.Restarts-previous),
+	})
+}
+
+// checkHealth reports health of all installed software and notifies about state changes
+func (service *AgentServiceWrap) checkHealth() error {
+	report := &structs.RestHealthPost{Services: make([]*structs.ServiceHealth, 0), CheckedAt: time.Now()}
+	installed := append([]*SavedInfo{}, service.Installed...)
+	for _, info := range installed {
+		for _, pi := range info.Package.PackageItems {
+			health := CheckSoftwareHealth(service.Settings, info, pi.Software)
+			if health == nil {
+				continue
+			}
+			service.checkRestarts(health)
+			report.Services = append(report.Services, health)
+			previous, known := service.health[health.SoftwareID]
+			service.health[health.SoftwareID] = health.Status
+			if previous == health.Status || (!known && health.Status == structs.HealthHealthy) {
+				continue
+			}
+			if !known {
+				previous = "unknown"
+			}
+			log.Log.Warn().Str("Task", "HealthCheck").
+				Msgf("Software %s changed state %s -> %s", health.Name, previous, health.Status)
+			notification := service.createNotification("health", map[string]any{
+				"software_id": health.SoftwareID,
+				"software":    health.Name,
+				"from":        previous,
+				"to":          health.Status,
+				"health":      health,
+			})
+			notification.PackageId = info.Package.ID
+			notification.UnitID = info.Unit.ID
+			service.ApiClient.Notify(notification)
+		}
+	}
+	if !service.ApiClient.PostHealth(report) {
+		log.Log.Warn().Str("Task", "HealthCheck").Msg("Health report was not sent")
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package lib
+
+import (
+	"main/lib/structs"
+	"strings"
+	"testing"
+)
+
+func TestSystemdProbeRejectsInvalidUnit(t *testing.T) {
+	tests := []struct {
+		name string
+		unit string
+	}{
+		{"empty", ""},
+		{"command separator", "x; touch /tmp/probed"},
+		{"substitution", "$(id)"},
+		{"space", "nginx --all"},
+		{"newline", "nginx\nid"},
+		{"path", "../nginx"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := RunProbe(DefaultSettings(), &structs.HealthProbe{Kind: structs.ProbeSystemd, Target: test.unit})
+			if result.Healthy || !strings.Contains(result.Message, "invalid systemd unit name") {
+				t.Fatalf("RunProbe(%q) = %+v, invalid unit name expected", test.unit, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"main/lib/helpers"
+	"main/lib/log"
+	"main/lib/structs"
+	"sync"
+	"time"
+)
+
+// Heartbeat
+
+// lastCommandSummary returns latest finished remote command without its logs
+func (a *Agent) lastCommandSummary() *structs.RestCommandResultPost {
+	history := a.FilesGetCommandsHistory()
+	if history == nil {
+		return nil
+	}
+	for i := len(history.Records) - 1; i >= 0; i-- {
+		if !history.Records[i].Finished() {
+			continue
+		}
+		summary := *history.Records[i].Result
+		summary.Logs = nil
+		return &summary
+	}
+	return nil
+}
+
+// CollectHeartbeat gathers host metrics, failed metrics are listed in Errors
+func (a *Agent) CollectHeartbeat(started time.Time) *structs.RestHeartbeatPost {
+	heartbeat := &structs.RestHeartbeatPost{
+		AgentVersion:   PcaVersion,
+		AgentUptime:    int64(time.Since(started).Seconds()),
+		Disks:          make([]*helpers.DiskStats, 0),
+		RebootRequired: helpers.RebootRequired(),
+		LastCommand:    a.lastCommandSummary(),
+		Errors:         make([]string, 0),
+		SentAt:         time.Now(),
+	}
+	uptime, err := helpers.HostUptime()
+	if err != nil {
+		heartbeat.Errors = append(heartbeat.Errors, "uptime: "+err.Error())
+	}
+	heartbeat.Uptime = int64(uptime.Seconds())
+	if heartbeat.CpuCount, err = helpers.CpuCount(); err != nil {
+		heartbeat.Errors = append(heartbeat.Errors, "cpu: "+err.Error())
+	}
+	if heartbeat.Load, err = helpers.LoadAverage(); err != nil {
+		heartbeat.Errors = append(heartbeat.Errors, "load: "+err.Error())
+	}
+	if heartbeat.Memory, err = helpers.Memory(); err != nil {
+		heartbeat.Errors = append(heartbeat.Errors, "memory: "+err.Error())
+	}
+	for _, dir := range []string{a.Settings.AppFolder, a.Settings.TmpDir, "/"} {
+		heartbeat.Disks = append(heartbeat.Disks, helpers.DiskUsage(dir))
+	}
+	return heartbeat
+}
+
+// controlState tracks reachability of control server by heartbeat results
+type controlState struct {
+	lock          sync.Mutex
+	lastCheckAt   time.Time
+	lastSuccessAt time.Time
+	reachable     bool
+}
+
+func (state *controlState) record(ok bool) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.lastCheckAt = time.Now()
+	state.reachable = ok
+	if ok {
+		state.lastSuccessAt = state.lastCheckAt
+	}
+}
+
+func (service *AgentServiceWrap) sendHeartbeat() error {
+	ok := service.ApiClient.PingServer(service.CollectHeartbeat(service.started))
+	service.control.record(ok)
+	if !ok {
+		log.Log.Warn().Str("Task", "Heartbeat").Msg("Heartbeat was not sent")
+	}
+	return nil
+}
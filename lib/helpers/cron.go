@@ -0,0 +1,164 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is parsed 5 fields cron expression: minute hour day-of-month month day-of-week
+type CronSchedule struct {
+	Expr    string
+	minute  uint64
+	hour    uint64
+	dom     uint64
+	month   uint64
+	dow     uint64
+	domStar bool
+	dowStar bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func ParseCron(expr string) (*CronSchedule, error) {
+	fullExpr := strings.TrimSpace(expr)
+	if macro, ok := cronMacros[fullExpr]; ok {
+		fullExpr = macro
+	}
+	fields := strings.Fields(fullExpr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: expected 5 fields, got %d", expr, len(fields))
+	}
+	schedule := &CronSchedule{Expr: expr}
+	var err error
+	bounds := []struct {
+		target   *uint64
+		min, max int
+	}{
+		{&schedule.minute, 0, 59},
+		{&schedule.hour, 0, 23},
+		{&schedule.dom, 1, 31},
+		{&schedule.month, 1, 12},
+		{&schedule.dow, 0, 7},
+	}
+	for i, bound := range bounds {
+		*bound.target, err = parseCronField(fields[i], bound.min, bound.max)
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %w", expr, err)
+		}
+	}
+	// 7 is sunday too
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+	schedule.domStar = fields[2] == "*"
+	schedule.dowStar = fields[4] == "*"
+	return schedule, nil
+}
+
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+		start, end := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err1, err2 error
+			start, err1 = strconv.Atoi(bounds[0])
+			end, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			value, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			start = value
+			if step == 1 {
+				end = value
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	if bits == 0 {
+		return 0, errors.New("empty field")
+	}
+	return bits, nil
+}
+
+func (c *CronSchedule) matchDay(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Match tells whether given time (minute precision) matches schedule
+func (c *CronSchedule) Match(t time.Time) bool {
+	return c.minute&(1<<uint(t.Minute())) != 0 &&
+		c.hour&(1<<uint(t.Hour())) != 0 &&
+		c.month&(1<<uint(t.Month())) != 0 &&
+		c.matchDay(t)
+}
+
+// Next returns first matching minute after given time, zero time if nothing matches in 5 years
+func (c *CronSchedule) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Prev returns last matching minute not after given time, zero time if it is older than lookBack
+func (c *CronSchedule) Prev(before time.Time, lookBack time.Duration) time.Time {
+	t := before.Truncate(time.Minute)
+	limit := t.Add(-lookBack)
+	for !t.Before(limit) {
+		if c.Match(t) {
+			return t
+		}
+		t = t.Add(-time.Minute)
+	}
+	return time.Time{}
+}
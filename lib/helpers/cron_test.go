@@ -0,0 +1,108 @@
+package helpers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+	}{
+		{"empty", ""},
+		{"four fields", "* * * *"},
+		{"six fields", "* * * * * *"},
+		{"minute out of range", "60 * * * *"},
+		{"hour out of range", "0 24 * * *"},
+		{"day of month zero", "0 0 0 * *"},
+		{"month out of range", "0 0 1 13 *"},
+		{"day of week out of range", "0 0 * * 8"},
+		{"zero step", "*/0 * * * *"},
+		{"reversed range", "5-1 * * * *"},
+		{"not a number", "a * * * *"},
+		{"unknown macro", "@often"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ParseCron(test.expr); err == nil {
+				t.Fatalf("ParseCron(%q) succeeded, error expected", test.expr)
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(value string) time.Time {
+		parsed, err := time.Parse("2006-01-02 15:04:05", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	tests := []struct {
+		name  string
+		expr  string
+		after string
+		want  string
+	}{
+		{"every quarter", "*/15 * * * *", "2024-01-01 10:07:00", "2024-01-01 10:15:00"},
+		{"strictly after matching minute", "0 3 * * *", "2024-01-01 03:00:00", "2024-01-02 03:00:00"},
+		{"seconds are truncated", "@hourly", "2024-01-01 10:59:30", "2024-01-01 11:00:00"},
+		{"range with step", "1-5/2 * * * *", "2024-01-01 10:01:00", "2024-01-01 10:03:00"},
+		{"list", "10,40 * * * *", "2024-01-01 10:11:00", "2024-01-01 10:40:00"},
+		{"sunday as 7", "0 0 * * 7", "2024-01-03 12:00:00", "2024-01-07 00:00:00"},
+		{"sunday as 0", "0 0 * * 0", "2024-01-03 12:00:00", "2024-01-07 00:00:00"},
+		{"day of month or day of week", "0 0 1,15 * 1", "2024-01-02 00:00:00", "2024-01-08 00:00:00"},
+		{"day of month and any day of week", "0 0 15 * *", "2024-01-02 00:00:00", "2024-01-15 00:00:00"},
+		{"leap day", "30 12 29 2 *", "2023-03-01 00:00:00", "2024-02-29 12:30:00"},
+		{"next year", "@yearly", "2024-06-01 00:00:00", "2025-01-01 00:00:00"},
+		{"never", "0 0 31 2 *", "2024-01-01 00:00:00", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := ParseCron(test.expr)
+			if err != nil {
+				t.Fatalf("ParseCron(%q): %v", test.expr, err)
+			}
+			next := schedule.Next(at(test.after))
+			if test.want == "" {
+				if !next.IsZero() {
+					t.Fatalf("Next() = %s, zero time expected", next)
+				}
+				return
+			}
+			if want := at(test.want); !next.Equal(want) {
+				t.Fatalf("Next(%s) = %s, want %s", test.after, next, want)
+			}
+			if !schedule.Match(next) {
+				t.Fatalf("Match(%s) = false for time returned by Next", next)
+			}
+		})
+	}
+}
+
+func TestCronPrev(t *testing.T) {
+	before := time.Date(2024, 1, 2, 3, 30, 45, 0, time.UTC)
+	tests := []struct {
+		name     string
+		expr     string
+		lookBack time.Duration
+		want     time.Time
+	}{
+		{"within look back", "0 3 * * *", 2 * time.Hour, time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)},
+		{"current minute", "30 3 * * *", time.Minute, time.Date(2024, 1, 2, 3, 30, 0, 0, time.UTC)},
+		{"older than look back", "0 3 * * *", 10 * time.Minute, time.Time{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := ParseCron(test.expr)
+			if err != nil {
+				t.Fatalf("ParseCron(%q): %v", test.expr, err)
+			}
+			if prev := schedule.Prev(before, test.lookBack); !prev.Equal(test.want) {
+				t.Fatalf("Prev() = %s, want %s", prev, test.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package helpers
 
 import (
+	"bytes"
+	"io"
 	"os"
 	"sync"
 	"syscall"
@@ -53,3 +55,41 @@ func FileExists(path string) bool {
 	}
 	return false
 }
+
+// TailLines reads last n lines of file without loading whole file
+func TailLines(path string, n int) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	const chunkSize = 64 * 1024
+	offset := stat.Size()
+	data := make([]byte, 0)
+	for offset > 0 && bytes.Count(data, []byte{'\n'}) <= n {
+		size := int64(chunkSize)
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+		chunk := make([]byte, size)
+		if _, err = file.ReadAt(chunk, offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+		data = append(chunk, data...)
+	}
+	lines := make([]string, 0, n)
+	for _, line := range bytes.Split(bytes.TrimRight(data, "\n"), []byte{'\n'}) {
+		if len(line) > 0 {
+			lines = append(lines, string(line))
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
@@ -0,0 +1,90 @@
+package helpers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const watchDirEvents = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_DELETE
+
+// WatchFile calls onChange when file is written, replaced or removed, until ctx is done.
+// Directory of file is watched, so file replaced by rename (editors, config management tools) is still seen.
+// Events are debounced, onChange is called once after series of writes
+func WatchFile(ctx context.Context, filename string, debounce time.Duration, onChange func()) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	// non blocking fd is served by runtime poller, so Close unblocks Read
+	events := os.NewFile(uintptr(fd), "inotify")
+	defer events.Close()
+	if _, err = syscall.InotifyAddWatch(fd, filepath.Dir(filename), watchDirEvents); err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = events.Close()
+	}()
+	changed := make(chan struct{}, 1)
+	go func() {
+		timer := time.NewTimer(debounce)
+		timer.Stop()
+		pending := false
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-changed:
+				timer.Reset(debounce)
+				pending = true
+			case <-timer.C:
+				if pending {
+					pending = false
+					onChange()
+				}
+			}
+		}
+	}()
+	name := filepath.Base(filename)
+	buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, readErr := events.Read(buffer)
+		if readErr != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return readErr
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + int(event.Len)
+			offset = nameEnd
+			if nameEnd > n {
+				break
+			}
+			eventName := string(trimNul(buffer[nameStart:nameEnd]))
+			if eventName != name {
+				continue
+			}
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func trimNul(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
@@ -0,0 +1,136 @@
+package helpers
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Host metrics are read from /proc, /sys and statfs, no external tools are used
+
+type MemoryStats struct {
+	TotalBytes     uint64 `json:"total_bytes"`
+	AvailableBytes uint64 `json:"available_bytes"`
+	SwapTotalBytes uint64 `json:"swap_total_bytes"`
+	SwapFreeBytes  uint64 `json:"swap_free_bytes"`
+}
+
+type DiskStats struct {
+	Path       string `json:"path"`
+	TotalBytes uint64 `json:"total_bytes"`
+	FreeBytes  uint64 `json:"free_bytes"`
+	Error      string `json:"error,omitempty"`
+}
+
+// HostUptime reads system uptime from /proc/uptime
+func HostUptime() (time.Duration, error) {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected /proc/uptime format")
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// LoadAverage reads 1, 5 and 15 minutes load average from /proc/loadavg
+func LoadAverage() ([3]float64, error) {
+	var load [3]float64
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return load, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return load, fmt.Errorf("unexpected /proc/loadavg format")
+	}
+	for i := range load {
+		load[i], err = strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return load, err
+		}
+	}
+	return load, nil
+}
+
+// CpuCount counts online cpus from /sys/devices/system/cpu/online (e.g. "0-3,6")
+func CpuCount() (int, error) {
+	data, err := os.ReadFile("/sys/devices/system/cpu/online")
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, part := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		start, end, isRange := strings.Cut(part, "-")
+		if !isRange {
+			count++
+			continue
+		}
+		from, err1 := strconv.Atoi(start)
+		to, err2 := strconv.Atoi(end)
+		if err1 != nil || err2 != nil {
+			return 0, fmt.Errorf("unexpected cpu range %q", part)
+		}
+		count += to - from + 1
+	}
+	return count, nil
+}
+
+// Memory reads memory usage from /proc/meminfo
+func Memory() (*MemoryStats, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stats := &MemoryStats{}
+	fields := map[string]*uint64{
+		"MemTotal":     &stats.TotalBytes,
+		"MemAvailable": &stats.AvailableBytes,
+		"SwapTotal":    &stats.SwapTotalBytes,
+		"SwapFree":     &stats.SwapFreeBytes,
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		target, ok := fields[key]
+		if !found || !ok {
+			continue
+		}
+		// values are in kB
+		kb, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("meminfo %s: %w", key, err)
+		}
+		*target = kb * 1024
+	}
+	return stats, scanner.Err()
+}
+
+// DiskUsage reads size of filesystem holding given path
+func DiskUsage(path string) *DiskStats {
+	stats := &DiskStats{Path: path}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		stats.Error = err.Error()
+		return stats
+	}
+	stats.TotalBytes = fs.Blocks * uint64(fs.Bsize)
+	stats.FreeBytes = fs.Bavail * uint64(fs.Bsize)
+	return stats
+}
+
+// RebootRequired tells whether package manager requested reboot
+func RebootRequired() bool {
+	return FileExists("/var/run/reboot-required")
+}
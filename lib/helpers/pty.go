@@ -0,0 +1,109 @@
+package helpers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+type winSize struct {
+	Rows   uint16
+	Cols   uint16
+	XPixel uint16
+	YPixel uint16
+}
+
+func ioctl(fd uintptr, request uintptr, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// OpenPty opens new pseudo terminal pair, returns master and slave ends
+func OpenPty() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var unlock int32 = 0
+	if err = ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	var ptyNum uint32
+	if err = ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&ptyNum))); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", ptyNum), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// SetPtySize sends window size of terminal to pty
+func SetPtySize(pty *os.File, rows uint16, cols uint16) error {
+	if rows == 0 || cols == 0 {
+		return errors.New("invalid terminal size")
+	}
+	ws := &winSize{Rows: rows, Cols: cols}
+	return ioctl(pty.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(ws)))
+}
+
+// StartInPty starts command with pty as controlling terminal, returns master end of pty
+func StartInPty(cmd *exec.Cmd) (*os.File, error) {
+	master, slave, err := OpenPty()
+	if err != nil {
+		return nil, err
+	}
+	defer slave.Close()
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	if err = cmd.Start(); err != nil {
+		master.Close()
+		return nil, err
+	}
+	return master, nil
+}
+
+// KillSession kills session of command started by StartInPty: process group of session leader
+// and every other process of session, as shell with job control runs background jobs in own groups
+func KillSession(leader int) error {
+	err := syscall.Kill(-leader, syscall.SIGKILL)
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+	for _, stat := range stats {
+		data, readErr := os.ReadFile(stat)
+		if readErr != nil {
+			continue
+		}
+		// command name may contain spaces, fields after it are state, ppid, pgrp and session
+		fields := strings.Fields(string(data[bytes.LastIndexByte(data, ')')+1:]))
+		if len(fields) < 4 || fields[3] != strconv.Itoa(leader) {
+			continue
+		}
+		if pid, convErr := strconv.Atoi(filepath.Base(filepath.Dir(stat))); convErr == nil {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+	return err
+}
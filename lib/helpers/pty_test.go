@@ -0,0 +1,62 @@
+package helpers
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// processAlive reports whether process exists and is not zombie
+func processAlive(pid int) bool {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestKillSession(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"background child", "sleep 100 & echo $!; wait"},
+		{"background job in own process group", "set -m; sleep 100 & echo $!; wait"},
+		{"nohup child", "nohup sleep 100 >/dev/null 2>&1 & echo $!; wait"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := exec.Command("sh", "-c", test.script)
+			pty, err := StartInPty(cmd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pty.Close()
+			line, err := bufio.NewReader(pty).ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			child, err := strconv.Atoi(strings.TrimSpace(line))
+			if err != nil {
+				t.Fatalf("child pid %q: %v", line, err)
+			}
+			if err = KillSession(cmd.Process.Pid); err != nil {
+				t.Fatalf("KillSession() = %v", err)
+			}
+			_ = cmd.Wait()
+			deadline := time.Now().Add(2 * time.Second)
+			for processAlive(child) && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if processAlive(child) {
+				_ = exec.Command("kill", "-9", strconv.Itoa(child)).Run()
+				t.Fatalf("child %d of session is alive", child)
+			}
+		})
+	}
+}
@@ -0,0 +1,415 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"main/lib/log"
+	"main/lib/metrics"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	taskRuns     = metrics.NewCounter("pca_task_runs_total", "Executions of agent service tasks.", "task")
+	taskErrors   = metrics.NewCounter("pca_task_errors_total", "Failed executions of agent service tasks.", "task")
+	taskLastRun  = metrics.NewGauge("pca_task_last_run_timestamp_seconds", "Unix time of last task execution.", "task")
+	taskDuration = metrics.NewHistogram("pca_task_duration_seconds", "Duration of agent service task executions.",
+		metrics.DefaultBuckets, "task")
+)
+
+const (
+	taskHistorySize       = 20
+	defaultMaxBackoff     = 10 * time.Minute
+	serviceTaskMinBackoff = time.Second
+)
+
+// TaskRun is one finished execution of task
+type TaskRun struct {
+	StartedAt time.Time `json:"started_at"`
+	Duration  float64   `json:"duration"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// TaskState is a snapshot of task execution shown by status api
+type TaskState struct {
+	Name              string    `json:"name"`
+	Timeout           float64   `json:"timeout"`
+	Schedule          string    `json:"schedule"`
+	Running           bool      `json:"running"`
+	Runs              int       `json:"runs"`
+	Errors            int       `json:"errors"`
+	ConsecutiveErrors int       `json:"consecutive_errors"`
+	LastRun           time.Time `json:"last_run"`
+	LastError         string    `json:"last_error"`
+	NextRun           time.Time `json:"next_run"`
+	History           []TaskRun `json:"history"`
+}
+
+// Task is unit of work run by Scheduler.
+// Task with Every or Cron runs periodically, task without them is service task (server, listener),
+// it runs until ctx is cancelled and is restarted with backoff when it fails
+type Task struct {
+	Name  string
+	Every time.Duration
+	// Cron is 5 fields cron expression, it is used instead of Every
+	Cron string
+	// Jitter spreads runs by random part of interval, 0.1 delays run up to 10% of Every
+	Jitter float64
+	// MaxBackoff limits delay after consecutive errors, interval doubles with every error
+	MaxBackoff time.Duration
+	// Deadline is longest expected run, longer run is reported by Stalled, 0 disables check
+	Deadline time.Duration
+	Run      func(ctx context.Context) error
+	// OnStop unblocks Run which does not watch ctx, e.g. closes listener
+	OnStop func()
+
+	cron      *CronSchedule
+	stateLock sync.Mutex
+	state     TaskState
+	// cancel and done are set when scheduler starts task, Restart stops task by them
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// WithoutContext adapts task function which finishes quickly and doesn't need cancellation
+func WithoutContext(f func() error) func(ctx context.Context) error {
+	return func(context.Context) error {
+		return f()
+	}
+}
+
+func (t *Task) schedule() string {
+	switch {
+	case t.cron != nil:
+		return t.cron.Expr
+	case t.Every > 0:
+		return "every " + t.Every.String()
+	}
+	return "service"
+}
+
+// nextDelay returns wait before next run, failed runs are delayed with exponential backoff
+func (t *Task) nextDelay(now time.Time, consecutiveErrors int) time.Duration {
+	if t.Every <= 0 && t.cron == nil {
+		return backoff(serviceTaskMinBackoff, consecutiveErrors, t.MaxBackoff)
+	}
+	var delay time.Duration
+	if t.cron != nil {
+		delay = t.cron.Next(now).Sub(now)
+	} else {
+		delay = t.Every
+	}
+	if consecutiveErrors > 0 && t.Every > 0 {
+		delay = backoff(t.Every, consecutiveErrors, t.MaxBackoff)
+	}
+	if t.Jitter > 0 && t.Every > 0 {
+		delay += time.Duration(rand.Float64() * t.Jitter * float64(t.Every))
+	}
+	return delay
+}
+
+func backoff(base time.Duration, consecutiveErrors int, maxBackoff time.Duration) time.Duration {
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	if maxBackoff < base {
+		maxBackoff = base
+	}
+	delay := base
+	for i := 1; i < consecutiveErrors && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+func (t *Task) exec(ctx context.Context) (err error) {
+	startedAt := time.Now()
+	taskRuns.Inc(t.Name)
+	taskLastRun.Set(float64(startedAt.Unix()), t.Name)
+	t.stateLock.Lock()
+	t.state.Running = true
+	t.state.Runs++
+	t.state.LastRun = startedAt
+	t.stateLock.Unlock()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+		duration := time.Since(startedAt)
+		taskDuration.Observe(duration.Seconds(), t.Name)
+		run := TaskRun{StartedAt: startedAt, Duration: duration.Seconds()}
+		t.stateLock.Lock()
+		t.state.Running = false
+		if err != nil && ctx.Err() == nil {
+			run.Error = err.Error()
+			t.state.Errors++
+			t.state.ConsecutiveErrors++
+			t.state.LastError = err.Error()
+		} else {
+			t.state.ConsecutiveErrors = 0
+		}
+		t.state.History = append(t.state.History, run)
+		if len(t.state.History) > taskHistorySize {
+			t.state.History = t.state.History[len(t.state.History)-taskHistorySize:]
+		}
+		t.stateLock.Unlock()
+		if run.Error != "" {
+			taskErrors.Inc(t.Name)
+			log.Log.Error().Str("Task", t.Name).Str("Error", run.Error).Msg("Exec failed")
+		}
+	}()
+	return t.Run(ctx)
+}
+
+func (t *Task) loop(ctx context.Context) {
+	log.Log.Debug().Str("Task", t.Name).Msg("Start task")
+	service := t.Every <= 0 && t.cron == nil
+	if service {
+		// service task starts immediately and is restarted only after failure
+		if t.exec(ctx) == nil || ctx.Err() != nil {
+			return
+		}
+	}
+	for {
+		t.stateLock.Lock()
+		delay := t.nextDelay(time.Now(), t.state.ConsecutiveErrors)
+		t.state.NextRun = time.Now().Add(delay)
+		t.stateLock.Unlock()
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Log.Debug().Str("Task", t.Name).Msg("Stopped")
+			return
+		case <-timer.C:
+		}
+		if t.exec(ctx) == nil && service {
+			return
+		}
+	}
+}
+
+func (t *Task) State() TaskState {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	state := t.state
+	state.Name = t.Name
+	state.Timeout = t.Every.Seconds()
+	state.Schedule = t.schedule()
+	state.History = append([]TaskRun(nil), t.state.History...)
+	if state.Running || (t.Every <= 0 && t.cron == nil && state.ConsecutiveErrors == 0) {
+		state.NextRun = time.Time{}
+	}
+	return state
+}
+
+// Scheduler runs tasks in own goroutines, Stop cancels them and waits for running executions
+type Scheduler struct {
+	lock   sync.Mutex
+	tasks  []*Task
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{tasks: make([]*Task, 0)}
+}
+
+func (t *Task) parseCron() error {
+	if t.Cron == "" {
+		return nil
+	}
+	schedule, err := ParseCron(t.Cron)
+	if err != nil {
+		return fmt.Errorf("task %s: %w", t.Name, err)
+	}
+	t.cron = schedule
+	return nil
+}
+
+// Add registers task before Start, cron expression of task is validated here
+func (s *Scheduler) Add(task *Task) error {
+	if err := task.parseCron(); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tasks = append(s.tasks, task)
+	return nil
+}
+
+func (s *Scheduler) Start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.cancel != nil {
+		return
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	for _, task := range s.tasks {
+		s.run(task)
+	}
+}
+
+// run starts task in own goroutine, it is called under lock of started scheduler
+func (s *Scheduler) run(task *Task) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	task.cancel = cancel
+	task.done = make(chan struct{})
+	go func() {
+		defer close(task.done)
+		task.loop(ctx)
+	}()
+}
+
+// halt cancels tasks and waits until they return or timeout passes,
+// tasks still running after timeout are reported in error
+func halt(tasks []*Task, timeout time.Duration) error {
+	for _, task := range tasks {
+		if task.cancel != nil {
+			task.cancel()
+		}
+		if task.OnStop != nil {
+			task.OnStop()
+		}
+	}
+	deadline := time.After(timeout)
+	for _, task := range tasks {
+		if task.done == nil {
+			continue
+		}
+		select {
+		case <-task.done:
+			continue
+		case <-deadline:
+		}
+		stuck := make([]string, 0)
+		for _, task := range tasks {
+			select {
+			case <-task.done:
+			default:
+				stuck = append(stuck, task.Name)
+			}
+		}
+		return errors.New("tasks not stopped in " + timeout.String() + ": " + strings.Join(stuck, ", "))
+	}
+	return nil
+}
+
+// Stop cancels tasks and waits until they return or timeout passes,
+// tasks still running after timeout are reported in error
+func (s *Scheduler) Stop(timeout time.Duration) error {
+	s.lock.Lock()
+	cancel := s.cancel
+	s.cancel = nil
+	tasks := s.tasks
+	s.lock.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	return halt(tasks, timeout)
+}
+
+// Restart stops tasks for which stale returns true and calls apply while they are stopped.
+// Then tasks are replaced by tasks of build: running task of same name which is not stale keeps running
+// with its state, other tasks of build are started and tasks missing in build are stopped
+func (s *Scheduler) Restart(stale func(name string) bool, apply func(), build func() []*Task,
+	timeout time.Duration) error {
+	s.lock.Lock()
+	stopped := make([]*Task, 0)
+	kept := make(map[string]*Task)
+	for _, task := range s.tasks {
+		if stale(task.Name) {
+			stopped = append(stopped, task)
+		} else {
+			kept[task.Name] = task
+		}
+	}
+	s.lock.Unlock()
+	problems := make([]string, 0)
+	if err := halt(stopped, timeout); err != nil {
+		problems = append(problems, err.Error())
+	}
+	apply()
+	tasks := build()
+	s.lock.Lock()
+	next := make([]*Task, 0, len(tasks))
+	for _, task := range tasks {
+		if current, ok := kept[task.Name]; ok {
+			next = append(next, current)
+			delete(kept, task.Name)
+			continue
+		}
+		if err := task.parseCron(); err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		next = append(next, task)
+		if s.cancel != nil {
+			s.run(task)
+		}
+	}
+	s.tasks = next
+	s.lock.Unlock()
+	removed := make([]*Task, 0, len(kept))
+	for _, task := range kept {
+		removed = append(removed, task)
+	}
+	if err := halt(removed, timeout); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Stalled lists periodic tasks which are overdue by more than grace (their loop is stuck)
+// or run longer than their Deadline, service tasks are not checked
+func (s *Scheduler) Stalled(grace time.Duration) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	stalled := make([]string, 0)
+	for _, task := range s.tasks {
+		if task.Every <= 0 && task.cron == nil {
+			continue
+		}
+		state := task.State()
+		overdue := !state.Running && !state.NextRun.IsZero() && now.Sub(state.NextRun) > grace
+		tooLong := state.Running && task.Deadline > 0 && now.Sub(state.LastRun) > task.Deadline
+		if overdue || tooLong {
+			stalled = append(stalled, task.Name)
+		}
+	}
+	return stalled
+}
+
+// Running lists tasks executing now, service tasks are not listed
+func (s *Scheduler) Running() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	running := make([]string, 0)
+	for _, task := range s.tasks {
+		if (task.Every > 0 || task.cron != nil) && task.State().Running {
+			running = append(running, task.Name)
+		}
+	}
+	return running
+}
+
+func (s *Scheduler) States() []TaskState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	states := make([]TaskState, 0, len(s.tasks))
+	for _, task := range s.tasks {
+		states = append(states, task.State())
+	}
+	return states
+}
@@ -0,0 +1,245 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name              string
+		base              time.Duration
+		consecutiveErrors int
+		maxBackoff        time.Duration
+		want              time.Duration
+	}{
+		{"no errors", time.Second, 0, time.Minute, time.Second},
+		{"first error", time.Second, 1, time.Minute, time.Second},
+		{"doubles", time.Second, 3, time.Minute, 4 * time.Second},
+		{"limited by max", time.Second, 10, 5 * time.Second, 5 * time.Second},
+		{"max below base", time.Minute, 3, time.Second, time.Minute},
+		{"default max", time.Minute, 20, 0, defaultMaxBackoff},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := backoff(test.base, test.consecutiveErrors, test.maxBackoff); got != test.want {
+				t.Fatalf("backoff() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTaskNextDelay(t *testing.T) {
+	now := time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)
+	hourly, err := ParseCron("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name              string
+		task              *Task
+		consecutiveErrors int
+		want              time.Duration
+	}{
+		{"interval", &Task{Every: 10 * time.Second}, 0, 10 * time.Second},
+		{"interval after errors", &Task{Every: 10 * time.Second}, 3, 40 * time.Second},
+		{"interval limited by max backoff", &Task{Every: 10 * time.Second, MaxBackoff: 15 * time.Second}, 3, 15 * time.Second},
+		{"cron", &Task{cron: hourly}, 0, 30 * time.Minute},
+		{"cron is not backed off", &Task{cron: hourly}, 3, 30 * time.Minute},
+		{"service task", &Task{}, 0, serviceTaskMinBackoff},
+		{"service task after errors", &Task{}, 4, 8 * serviceTaskMinBackoff},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.task.nextDelay(now, test.consecutiveErrors); got != test.want {
+				t.Fatalf("nextDelay() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTaskNextDelayJitter(t *testing.T) {
+	task := &Task{Every: 10 * time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if delay := task.nextDelay(time.Now(), 0); delay < task.Every || delay > 15*time.Second {
+			t.Fatalf("nextDelay() = %s, want between 10s and 15s", delay)
+		}
+	}
+}
+
+func TestSchedulerStop(t *testing.T) {
+	tests := []struct {
+		name    string
+		task    func(release chan struct{}) *Task
+		wantErr bool
+	}{
+		{"task watching context", func(chan struct{}) *Task {
+			return &Task{Name: "watcher", Run: func(ctx context.Context) error {
+				<-ctx.Done()
+				return nil
+			}}
+		}, false},
+		{"task unblocked by OnStop", func(release chan struct{}) *Task {
+			return &Task{Name: "listener", Run: func(context.Context) error {
+				<-release
+				return errors.New("listener closed")
+			}, OnStop: func() { close(release) }}
+		}, false},
+		{"periodic task", func(chan struct{}) *Task {
+			return &Task{Name: "periodic", Every: time.Hour, Run: WithoutContext(func() error { return nil })}
+		}, false},
+		{"stuck task", func(release chan struct{}) *Task {
+			return &Task{Name: "stuck", Run: func(context.Context) error {
+				<-release
+				return nil
+			}}
+		}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			release := make(chan struct{})
+			task := test.task(release)
+			scheduler := NewScheduler()
+			if err := scheduler.Add(task); err != nil {
+				t.Fatal(err)
+			}
+			scheduler.Start()
+			time.Sleep(20 * time.Millisecond)
+			err := scheduler.Stop(100 * time.Millisecond)
+			if test.wantErr {
+				if err == nil || !strings.Contains(err.Error(), task.Name) {
+					t.Fatalf("Stop() = %v, error naming %s expected", err, task.Name)
+				}
+				close(release)
+				return
+			}
+			if err != nil {
+				t.Fatalf("Stop() = %v", err)
+			}
+			if task.State().Running {
+				t.Fatal("task is running after Stop")
+			}
+		})
+	}
+}
+
+func TestSchedulerRestartsFailedServiceTask(t *testing.T) {
+	var runs int32
+	task := &Task{Name: "flaky", Run: func(ctx context.Context) error {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			return errors.New("failed to listen")
+		}
+		<-ctx.Done()
+		return nil
+	}}
+	scheduler := NewScheduler()
+	if err := scheduler.Add(task); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	deadline := time.Now().Add(3 * serviceTaskMinBackoff)
+	for atomic.LoadInt32(&runs) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := scheduler.Stop(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	state := task.State()
+	if state.Runs != 2 || state.Errors != 1 || state.ConsecutiveErrors != 0 {
+		t.Fatalf("state = %d runs, %d errors, %d consecutive errors, want 2, 1, 0",
+			state.Runs, state.Errors, state.ConsecutiveErrors)
+	}
+}
+
+func TestSchedulerAddRejectsInvalidCron(t *testing.T) {
+	err := NewScheduler().Add(&Task{Name: "broken", Cron: "* * *", Run: WithoutContext(func() error { return nil })})
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("Add() = %v, error naming task expected", err)
+	}
+}
+
+func TestSchedulerRestart(t *testing.T) {
+	var runs sync.Map
+	newTask := func(name string) *Task {
+		return &Task{Name: name, Run: func(ctx context.Context) error {
+			count, _ := runs.LoadOrStore(name, new(int32))
+			atomic.AddInt32(count.(*int32), 1)
+			<-ctx.Done()
+			return nil
+		}}
+	}
+	started := func(name string) int32 {
+		count, ok := runs.Load(name)
+		if !ok {
+			return 0
+		}
+		return atomic.LoadInt32(count.(*int32))
+	}
+	scheduler := NewScheduler()
+	for _, name := range []string{"kept", "stale", "removed"} {
+		if err := scheduler.Add(newTask(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scheduler.Start()
+	defer func() { _ = scheduler.Stop(time.Second) }()
+	time.Sleep(20 * time.Millisecond)
+	kept, removed := scheduler.tasks[0], scheduler.tasks[2]
+
+	applied := false
+	err := scheduler.Restart(func(name string) bool { return name == "stale" }, func() {
+		if state := scheduler.tasks[1].State(); state.Running {
+			t.Error("stale task is running while settings are applied")
+		}
+		applied = true
+	}, func() []*Task {
+		return []*Task{newTask("kept"), newTask("stale"), newTask("added")}
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !applied {
+		t.Fatal("apply was not called")
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	names := make([]string, 0)
+	for _, state := range scheduler.States() {
+		names = append(names, state.Name)
+	}
+	if got := strings.Join(names, ","); got != "kept,stale,added" {
+		t.Fatalf("tasks = %s, want kept,stale,added", got)
+	}
+	if scheduler.tasks[0] != kept {
+		t.Fatal("task which is not stale was replaced")
+	}
+	tests := []struct {
+		name    string
+		started int32
+	}{
+		{"kept", 1},
+		{"stale", 2},
+		{"added", 1},
+		{"removed", 1},
+	}
+	for _, test := range tests {
+		if got := started(test.name); got != test.started {
+			t.Errorf("%s started %d times, want %d", test.name, got, test.started)
+		}
+	}
+	select {
+	case <-removed.done:
+	default:
+		t.Error("task missing in build is running after Restart")
+	}
+	for _, state := range scheduler.States() {
+		if !state.Running {
+			t.Errorf("%s is not running after Restart", state.Name)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package helpers
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sd_notify protocol: service sends state lines to datagram socket given by systemd in NOTIFY_SOCKET
+
+const (
+	SdReady     = "READY=1"
+	SdReloading = "RELOADING=1"
+	SdStopping  = "STOPPING=1"
+	SdWatchdog  = "WATCHDOG=1"
+)
+
+// SdNotify sends state to systemd, returns false without error when service is not run by systemd
+func SdNotify(state string) (bool, error) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return false, nil
+	}
+	// abstract socket namespace
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SdNotifyStatus sends free form status shown by systemctl status
+func SdNotifyStatus(status string) {
+	_, _ = SdNotify("STATUS=" + status)
+}
+
+// SdWatchdogInterval returns WatchdogSec of unit, 0 when watchdog is disabled or is meant for other process
+func SdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
@@ -0,0 +1,75 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"main/lib/log"
+	"net"
+	"os"
+	"syscall"
+)
+
+// ListenUnixSocket listens on unix socket owned by root with given mode, stale socket file is removed
+func ListenUnixSocket(socketPath string, mode os.FileMode) (net.Listener, error) {
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chown(socketPath, 0, 0); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	if err = os.Chmod(socketPath, mode); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// PeerUid reads uid of process on other side of unix socket (SO_PEERCRED)
+func PeerUid(conn net.Conn) (uint32, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, fmt.Errorf("not a unix socket connection")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+	return cred.Uid, nil
+}
+
+// PeerCredListener accepts only connections from processes with allowed uid
+type PeerCredListener struct {
+	net.Listener
+	AllowedUids []uint32
+}
+
+func (l *PeerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uid, err := PeerUid(conn)
+		if err == nil && Contains(l.AllowedUids, uid) {
+			return conn, nil
+		}
+		log.Log.Warn().Err(err).Uint32("Uid", uid).Msg("Rejected control socket connection")
+		_ = conn.Close()
+	}
+}
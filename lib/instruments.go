@@ -0,0 +1,149 @@
+package lib
+
+import (
+	"bufio"
+	"errors"
+	"main/lib/metrics"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Prometheus metrics of agent service, exposed on /metrics
+
+var (
+	metricOperations = metrics.NewHistogram("pca_operation_duration_seconds",
+		"Duration of install, update and patch operations by outcome.", metrics.DefaultBuckets, "operation", "outcome")
+	metricDownloadBytes = metrics.NewCounter("pca_download_bytes_total",
+		"Bytes of builds downloaded from control server.")
+	metricDownloads = metrics.NewHistogram("pca_download_duration_seconds",
+		"Duration of build downloads by outcome.", metrics.DefaultBuckets, "outcome")
+	metricDownloadThroughput = metrics.NewGauge("pca_download_throughput_bytes_per_second",
+		"Throughput of last successful build download.")
+	metricChecksumFailures = metrics.NewCounter("pca_checksum_failures_total",
+		"Downloaded builds with invalid check sum.")
+	metricLogBufferDepth = metrics.NewGauge("pca_log_buffer_depth",
+		"Software log records waiting to be sent to control server.")
+	metricProxyRequests = metrics.NewHistogram("pca_proxy_request_duration_seconds",
+		"Latency of proxied requests by method and status code.", metrics.DefaultBuckets, "method", "code")
+	metricProxyCache = metrics.NewCounter("pca_proxy_cache_requests_total",
+		"Build downloads of downstream agents by cache result: hit, miss or bypass.", "result")
+	metricProxyCacheBytes = metrics.NewGauge("pca_proxy_cache_size_bytes",
+		"Size of builds in proxy cache.")
+	metricDownstreamLimited = metrics.NewCounter("pca_proxy_rate_limited_total",
+		"Requests of downstream agents rejected by rate limit.")
+	metricRemoteCommands = metrics.NewCounter("pca_remote_commands_total",
+		"Executed remote commands by policy rule command (other when rejected) and final status.", "command", "status")
+	metricAgentInfo = metrics.NewGauge("pca_agent_info",
+		"Agent version.", "version")
+	metricPackageInfo = metrics.NewGauge("pca_package_info",
+		"Installed packages.", "package_id", "package", "client", "product", "unit_id")
+	metricSoftwareInfo = metrics.NewGauge("pca_software_info",
+		"Installed software of packages.", "package_id", "software_id", "software", "branch", "version", "patch", "status")
+)
+
+var stateMetricsLock sync.Mutex
+
+func outcome(err error) string {
+	if err != nil {
+		return "failed"
+	}
+	return "success"
+}
+
+// observeOperation records duration and outcome of install, update or patch
+func observeOperation(operation string, started time.Time, err error) {
+	metricOperations.Observe(time.Since(started).Seconds(), operation, outcome(err))
+}
+
+func observeDownload(started time.Time, size int64, err error) {
+	elapsed := time.Since(started).Seconds()
+	metricDownloads.Observe(elapsed, outcome(err))
+	if err != nil {
+		return
+	}
+	metricDownloadBytes.Add(float64(size))
+	if elapsed > 0 {
+		metricDownloadThroughput.Set(float64(size) / elapsed)
+	}
+}
+
+// statusRecorder remembers response code and size written by wrapped handler,
+// flushing and hijacking are passed through for streamed and upgraded responses.
+// Code stays 0 when handler wrote nothing, e.g. client went away during upstream request
+type statusRecorder struct {
+	http.ResponseWriter
+	code    int
+	written int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code < http.StatusOK {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(data)
+	r.written += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	r.code = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func instrumentProxy(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next(recorder, req)
+		metricProxyRequests.Observe(time.Since(started).Seconds(), req.Method, strconv.Itoa(recorder.code))
+	}
+}
+
+// collectStateMetrics refreshes gauges computed from agent files
+func (service *AgentServiceWrap) collectStateMetrics() {
+	stateMetricsLock.Lock()
+	defer stateMetricsLock.Unlock()
+	metricAgentInfo.Set(1, PcaVersion)
+	if buffer := service.FilesGetLogsBuffer(); buffer != nil {
+		metricLogBufferDepth.Set(float64(len(buffer.Logs)))
+	}
+	metricPackageInfo.Reset()
+	metricSoftwareInfo.Reset()
+	service.FilesIterInstalled(func(info *SavedInfo) {
+		packageId := strconv.Itoa(info.Package.ID)
+		metricPackageInfo.Set(1, packageId, info.Package.Name,
+			info.Client.Name, info.Product.Name, strconv.Itoa(info.Unit.ID))
+		for _, pi := range info.Package.PackageItems {
+			status := ""
+			if pi.Software.Build != nil && pi.Software.Build.FileSpec != nil {
+				status = string(pi.Software.Build.FileSpec.Status)
+			}
+			metricSoftwareInfo.Set(1, packageId, strconv.Itoa(pi.Software.ID), pi.Software.Name,
+				pi.Software.Branch, pi.Software.Version, strconv.Itoa(pi.Software.Patch), status)
+		}
+	})
+}
@@ -0,0 +1,325 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// JSON-RPC 2.0 over stream connection, messages are newline delimited json objects.
+// Both sides may send notifications (requests without id), server uses them to stream events
+
+const Version = "2.0"
+
+// Error codes defined by specification
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	// CodeServerError is used for errors returned by method handlers
+	CodeServerError = -32000
+)
+
+var ErrClosed = errors.New("jsonrpc: connection closed")
+
+type Request struct {
+	JsonRpc string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+}
+
+type Response struct {
+	JsonRpc string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *Error           `json:"error,omitempty"`
+}
+
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("jsonrpc error %d: %s", e.Code, e.Message)
+}
+
+// message is union of request and response used to read any incoming frame
+type message struct {
+	JsonRpc string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *Error           `json:"error,omitempty"`
+}
+
+// Conn
+
+// Conn is one side of json-rpc connection
+type Conn struct {
+	rwc       io.ReadWriteCloser
+	decoder   *json.Decoder
+	writeLock sync.Mutex
+	closeOnce sync.Once
+	done      chan struct{}
+	values    sync.Map
+}
+
+func newConn(rwc io.ReadWriteCloser) *Conn {
+	return &Conn{rwc: rwc, decoder: json.NewDecoder(rwc), done: make(chan struct{})}
+}
+
+func (c *Conn) write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err = c.rwc.Write(append(data, '\n'))
+	return err
+}
+
+// Notify sends notification to other side
+func (c *Conn) Notify(method string, params any) error {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return c.write(&Request{JsonRpc: Version, Method: method, Params: raw})
+}
+
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		err = c.rwc.Close()
+	})
+	return err
+}
+
+// Done is closed when connection is closed
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Set stores value bound to connection, e.g. lease held by client
+func (c *Conn) Set(key any, value any) {
+	c.values.Store(key, value)
+}
+
+func (c *Conn) Get(key any) (any, bool) {
+	return c.values.Load(key)
+}
+
+// Server
+
+type handler func(conn *Conn, params json.RawMessage) (any, error)
+
+type Server struct {
+	handlers map[string]handler
+	// OnClose is called after client connection is closed
+	OnClose func(conn *Conn)
+}
+
+func NewServer() *Server {
+	return &Server{handlers: make(map[string]handler)}
+}
+
+// Handle registers typed method handler, params are decoded into P
+func Handle[P any, R any](server *Server, method string, f func(conn *Conn, params *P) (*R, error)) {
+	server.handlers[method] = func(conn *Conn, raw json.RawMessage) (any, error) {
+		params := new(P)
+		if len(raw) > 0 && string(raw) != "null" {
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(params); err != nil {
+				return nil, &Error{Code: CodeInvalidParams, Message: err.Error()}
+			}
+		}
+		return f(conn, params)
+	}
+}
+
+// Methods lists registered method names
+func (server *Server) Methods() []string {
+	methods := make([]string, 0, len(server.handlers))
+	for method := range server.handlers {
+		methods = append(methods, method)
+	}
+	return methods
+}
+
+// Serve accepts connections until listener is closed
+func (server *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go server.ServeConn(conn)
+	}
+}
+
+// ServeConn serves requests of one client, each request is handled in own goroutine
+// so long running calls do not block notifications and other calls
+func (server *Server) ServeConn(rwc io.ReadWriteCloser) {
+	conn := newConn(rwc)
+	var wg sync.WaitGroup
+	defer func() {
+		_ = conn.Close()
+		wg.Wait()
+		if server.OnClose != nil {
+			server.OnClose(conn)
+		}
+	}()
+	for {
+		var req Request
+		if err := conn.decoder.Decode(&req); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				_ = conn.write(&Response{JsonRpc: Version, Error: &Error{Code: CodeParseError, Message: err.Error()}})
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.handle(conn, &req)
+		}()
+	}
+}
+
+func (server *Server) handle(conn *Conn, req *Request) {
+	resp := &Response{JsonRpc: Version, Id: req.Id}
+	h, ok := server.handlers[req.Method]
+	switch {
+	case req.JsonRpc != Version || req.Method == "":
+		resp.Error = &Error{Code: CodeInvalidRequest, Message: "invalid request"}
+	case !ok:
+		resp.Error = &Error{Code: CodeMethodNotFound, Message: "method not found: " + req.Method}
+	default:
+		result, err := h(conn, req.Params)
+		if err != nil {
+			var rpcErr *Error
+			if !errors.As(err, &rpcErr) {
+				rpcErr = &Error{Code: CodeServerError, Message: err.Error()}
+			}
+			resp.Error = rpcErr
+		} else if resp.Result, err = json.Marshal(result); err != nil {
+			resp.Error = &Error{Code: CodeInternalError, Message: err.Error()}
+		}
+	}
+	// notifications get no response
+	if req.Id == nil {
+		return
+	}
+	_ = conn.write(resp)
+}
+
+// Client
+
+type Client struct {
+	*Conn
+	lock    sync.Mutex
+	nextId  int64
+	closed  bool
+	pending map[int64]chan *message
+	// OnNotify is called for notifications sent by server, it is called from reading goroutine
+	OnNotify func(method string, params json.RawMessage)
+}
+
+func NewClient(rwc io.ReadWriteCloser) *Client {
+	client := &Client{Conn: newConn(rwc), pending: make(map[int64]chan *message)}
+	go client.read()
+	return client
+}
+
+func Dial(network string, address string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+func (client *Client) read() {
+	defer func() {
+		_ = client.Close()
+		client.lock.Lock()
+		defer client.lock.Unlock()
+		client.closed = true
+		for id, ch := range client.pending {
+			close(ch)
+			delete(client.pending, id)
+		}
+	}()
+	for {
+		msg := &message{}
+		if err := client.decoder.Decode(msg); err != nil {
+			return
+		}
+		if msg.Method != "" {
+			if client.OnNotify != nil {
+				client.OnNotify(msg.Method, msg.Params)
+			}
+			continue
+		}
+		var id int64
+		if msg.Id == nil || json.Unmarshal(*msg.Id, &id) != nil {
+			continue
+		}
+		client.lock.Lock()
+		ch, ok := client.pending[id]
+		delete(client.pending, id)
+		client.lock.Unlock()
+		if ok {
+			ch <- msg
+		}
+	}
+}
+
+// Call invokes method and decodes its result into result (may be nil)
+func (client *Client) Call(method string, params any, result any) error {
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	ch := make(chan *message, 1)
+	client.lock.Lock()
+	if client.closed {
+		client.lock.Unlock()
+		return ErrClosed
+	}
+	client.nextId++
+	id := client.nextId
+	client.pending[id] = ch
+	client.lock.Unlock()
+	rawId := json.RawMessage(fmt.Sprint(id))
+	if err = client.write(&Request{JsonRpc: Version, Id: &rawId, Method: method, Params: rawParams}); err != nil {
+		client.lock.Lock()
+		delete(client.pending, id)
+		client.lock.Unlock()
+		return err
+	}
+	msg, ok := <-ch
+	if !ok {
+		return ErrClosed
+	}
+	if msg.Error != nil {
+		return msg.Error
+	}
+	if result == nil || len(msg.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(msg.Result, result)
+}
@@ -0,0 +1,194 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type echoParams struct {
+	Text string `json:"text"`
+}
+
+type echoResult struct {
+	Text string `json:"text"`
+}
+
+func newTestServer() *Server {
+	server := NewServer()
+	Handle(server, "echo", func(conn *Conn, params *echoParams) (*echoResult, error) {
+		return &echoResult{Text: params.Text}, nil
+	})
+	Handle(server, "announce", func(conn *Conn, params *echoParams) (*echoResult, error) {
+		if err := conn.Notify("announced", params); err != nil {
+			return nil, err
+		}
+		return &echoResult{Text: params.Text}, nil
+	})
+	Handle(server, "fail", func(conn *Conn, params *echoParams) (*echoResult, error) {
+		return nil, errors.New("failed")
+	})
+	Handle(server, "busy", func(conn *Conn, params *echoParams) (*echoResult, error) {
+		return nil, &Error{Code: 42, Message: "busy"}
+	})
+	return server
+}
+
+// rawConn serves test server on one end of pipe and returns the other end with decoder of responses
+func rawConn(t *testing.T) (net.Conn, *json.Decoder) {
+	client, server := net.Pipe()
+	go newTestServer().ServeConn(server)
+	t.Cleanup(func() { _ = client.Close() })
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client, json.NewDecoder(client)
+}
+
+func TestServerFrames(t *testing.T) {
+	tests := []struct {
+		name       string
+		frame      string
+		wantCode   int
+		wantResult string
+	}{
+		{"call", `{"jsonrpc":"2.0","id":1,"method":"echo","params":{"text":"hi"}}`, 0, `{"text":"hi"}`},
+		{"call without params", `{"jsonrpc":"2.0","id":2,"method":"echo"}`, 0, `{"text":""}`},
+		{"string id", `{"jsonrpc":"2.0","id":"a","method":"echo","params":null}`, 0, `{"text":""}`},
+		{"wrong version", `{"jsonrpc":"1.0","id":3,"method":"echo"}`, CodeInvalidRequest, ""},
+		{"missing method", `{"jsonrpc":"2.0","id":4}`, CodeInvalidRequest, ""},
+		{"unknown method", `{"jsonrpc":"2.0","id":5,"method":"missing"}`, CodeMethodNotFound, ""},
+		{"unknown params field", `{"jsonrpc":"2.0","id":6,"method":"echo","params":{"txt":"hi"}}`, CodeInvalidParams, ""},
+		{"wrong params type", `{"jsonrpc":"2.0","id":7,"method":"echo","params":[1]}`, CodeInvalidParams, ""},
+		{"handler error", `{"jsonrpc":"2.0","id":8,"method":"fail"}`, CodeServerError, ""},
+		{"handler rpc error", `{"jsonrpc":"2.0","id":9,"method":"busy"}`, 42, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, decoder := rawConn(t)
+			if _, err := io.WriteString(conn, test.frame+"\n"); err != nil {
+				t.Fatal(err)
+			}
+			var resp Response
+			if err := decoder.Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			var req Request
+			if err := json.Unmarshal([]byte(test.frame), &req); err != nil {
+				t.Fatal(err)
+			}
+			if resp.JsonRpc != Version {
+				t.Fatalf("jsonrpc = %q, want %q", resp.JsonRpc, Version)
+			}
+			if resp.Id == nil || string(*resp.Id) != string(*req.Id) {
+				t.Fatalf("id = %v, want %s", resp.Id, *req.Id)
+			}
+			if test.wantCode != 0 {
+				if resp.Error == nil || resp.Error.Code != test.wantCode {
+					t.Fatalf("error = %v, want code %d", resp.Error, test.wantCode)
+				}
+				return
+			}
+			if resp.Error != nil {
+				t.Fatalf("error = %v", resp.Error)
+			}
+			if string(resp.Result) != test.wantResult {
+				t.Fatalf("result = %s, want %s", resp.Result, test.wantResult)
+			}
+		})
+	}
+}
+
+func TestServerNotificationGetsNoResponse(t *testing.T) {
+	conn, decoder := rawConn(t)
+	frames := `{"jsonrpc":"2.0","method":"echo","params":{"text":"ignored"}}` + "\n" +
+		`{"jsonrpc":"2.0","id":10,"method":"echo","params":{"text":"hi"}}` + "\n"
+	if _, err := io.WriteString(conn, frames); err != nil {
+		t.Fatal(err)
+	}
+	var resp Response
+	if err := decoder.Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Id == nil || string(*resp.Id) != "10" {
+		t.Fatalf("first response id = %v, want 10", resp.Id)
+	}
+}
+
+func TestServerParseErrorClosesConnection(t *testing.T) {
+	conn, decoder := rawConn(t)
+	if _, err := io.WriteString(conn, "{not json\n"); err != nil {
+		t.Fatal(err)
+	}
+	var resp Response
+	if err := decoder.Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error == nil || resp.Error.Code != CodeParseError {
+		t.Fatalf("error = %v, want code %d", resp.Error, CodeParseError)
+	}
+	if resp.Id != nil {
+		t.Fatalf("id = %s, want null", *resp.Id)
+	}
+	if err := decoder.Decode(&resp); err != io.EOF {
+		t.Fatalf("read after parse error = %v, want EOF", err)
+	}
+}
+
+func TestClientCall(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	go newTestServer().ServeConn(serverSide)
+	client := NewClient(clientSide)
+	defer client.Close()
+	notifications := make(chan string, 1)
+	client.OnNotify = func(method string, params json.RawMessage) {
+		notifications <- method + " " + string(params)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		wantCode int
+	}{
+		{"echo", "echo", 0},
+		{"notify before result", "announce", 0},
+		{"method not found", "missing", CodeMethodNotFound},
+		{"server error", "fail", CodeServerError},
+		{"custom error", "busy", 42},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var result echoResult
+			err := client.Call(test.method, &echoParams{Text: "hi"}, &result)
+			if test.wantCode != 0 {
+				var rpcErr *Error
+				if !errors.As(err, &rpcErr) || rpcErr.Code != test.wantCode {
+					t.Fatalf("Call() = %v, want code %d", err, test.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Call() = %v", err)
+			}
+			if result.Text != "hi" {
+				t.Fatalf("result = %q, want hi", result.Text)
+			}
+		})
+	}
+
+	select {
+	case notification := <-notifications:
+		if want := `announced {"text":"hi"}`; notification != want {
+			t.Fatalf("notification = %s, want %s", notification, want)
+		}
+	default:
+		t.Fatal("notification was not received")
+	}
+
+	_ = serverSide.Close()
+	<-client.Done()
+	if err := client.Call("echo", nil, nil); err == nil {
+		t.Fatal("Call() after close succeeded, error expected")
+	}
+}
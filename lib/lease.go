@@ -0,0 +1,260 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"main/lib/log"
+	"main/lib/structs"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Operation lock: service lock is taken by control clients as lease with ttl renewed by heartbeat,
+// when service is down cli processes use flock on lock file, service holds it while running
+
+const LockLeaseTtl = 30
+const maxLockLeaseTtl = 10 * 60
+
+// serviceLockWait bounds wait for lock file on service start, it is below TimeoutStartSec of unit
+const serviceLockWait = 4 * time.Minute
+
+var ErrLockNotHeld = errors.New("lease is not held")
+
+var processStartedAt = time.Now()
+
+// lease is service lock held by control client
+type lease struct {
+	id         string
+	owner      *structs.LockOwner
+	acquiredAt time.Time
+	expiresAt  time.Time
+	ttl        time.Duration
+	timer      *time.Timer
+}
+
+type leaseLock struct {
+	lock    *sync.Mutex
+	mu      sync.Mutex
+	current *lease
+	// onRelease runs while service lock is still held, before it is unlocked
+	onRelease func(held *lease)
+}
+
+func newLeaseLock(lock *sync.Mutex) *leaseLock {
+	return &leaseLock{lock: lock}
+}
+
+func CurrentLockOwner() *structs.LockOwner {
+	return &structs.LockOwner{Pid: os.Getpid(), Command: strings.Join(os.Args, " "), StartedAt: processStartedAt}
+}
+
+func (ll *leaseLock) acquire(owner *structs.LockOwner, ttlSeconds int) (*lease, error) {
+	if ttlSeconds <= 0 {
+		ttlSeconds = LockLeaseTtl
+	}
+	if ttlSeconds > maxLockLeaseTtl {
+		ttlSeconds = maxLockLeaseTtl
+	}
+	if owner == nil {
+		owner = &structs.LockOwner{}
+	}
+	if !ll.lock.TryLock() {
+		ll.mu.Lock()
+		defer ll.mu.Unlock()
+		if ll.current != nil {
+			return nil, fmt.Errorf("%w: locked by pid %d (%s) since %s", ErrLockBusy,
+				ll.current.owner.Pid, ll.current.owner.Command, ll.current.acquiredAt.Format(time.RFC3339))
+		}
+		return nil, fmt.Errorf("%w: service task is running", ErrLockBusy)
+	}
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	now := time.Now()
+	held := &lease{id: uuid.NewString(), owner: owner, acquiredAt: now, ttl: time.Duration(ttlSeconds) * time.Second}
+	held.expiresAt = now.Add(held.ttl)
+	held.timer = time.AfterFunc(held.ttl, func() {
+		if ll.expire(held.id) {
+			log.Log.Warn().Int("Pid", owner.Pid).Str("Command", owner.Command).
+				Msg("Lock lease expired without heartbeat, lock released")
+		}
+	})
+	ll.current = held
+	return held, nil
+}
+
+func (ll *leaseLock) renew(id string) (time.Time, error) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	if ll.current == nil || ll.current.id != id {
+		return time.Time{}, ErrLockNotHeld
+	}
+	ll.current.expiresAt = time.Now().Add(ll.current.ttl)
+	ll.current.timer.Reset(ll.current.ttl)
+	return ll.current.expiresAt, nil
+}
+
+// expire releases lease whose timer fired, timer may fire while renew waits for mu,
+// then lease is renewed and kept
+func (ll *leaseLock) expire(id string) bool {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	if ll.current == nil || ll.current.id != id || time.Now().Before(ll.current.expiresAt) {
+		return false
+	}
+	return ll.releaseLocked(id) == nil
+}
+
+// release unlocks service if lease is current, never unlocks lock not held by lease
+func (ll *leaseLock) release(id string) error {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	return ll.releaseLocked(id)
+}
+
+// releaseLocked is release, caller holds mu
+func (ll *leaseLock) releaseLocked(id string) error {
+	if ll.current == nil || ll.current.id != id {
+		return ErrLockNotHeld
+	}
+	held := ll.current
+	held.timer.Stop()
+	ll.current = nil
+	if ll.onRelease != nil {
+		ll.onRelease(held)
+	}
+	ll.lock.Unlock()
+	return nil
+}
+
+// breakLease releases current lease whoever holds it
+func (ll *leaseLock) breakLease() (*lease, error) {
+	ll.mu.Lock()
+	held := ll.current
+	ll.mu.Unlock()
+	if held == nil {
+		return nil, ErrLockNotHeld
+	}
+	return held, ll.release(held.id)
+}
+
+func (ll *leaseLock) held(id string) bool {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	return ll.current != nil && ll.current.id == id
+}
+
+func (ll *leaseLock) status() *structs.RpcLockStatusResult {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	if ll.current != nil {
+		return &structs.RpcLockStatusResult{Locked: true, Holder: structs.LockLease, Owner: ll.current.owner,
+			AcquiredAt: timeRef(ll.current.acquiredAt), ExpiresAt: timeRef(ll.current.expiresAt)}
+	}
+	if ll.lock.TryLock() {
+		ll.lock.Unlock()
+		return &structs.RpcLockStatusResult{Locked: false, Holder: structs.LockFree}
+	}
+	return &structs.RpcLockStatusResult{Locked: true, Holder: structs.LockService}
+}
+
+// Lock file
+
+// processLock is flock on lock file, owner is written into file for lock status
+type processLock struct {
+	file *os.File
+}
+
+// TryProcessLock takes exclusive flock on lock file, returns owner written by holder when file is locked
+func TryProcessLock(lockPath string, owner *structs.LockOwner) (*processLock, *structs.LockOwner, error) {
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		holder := readLockOwner(file)
+		_ = file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, holder, ErrLockBusy
+		}
+		return nil, nil, err
+	}
+	data, _ := json.Marshal(owner)
+	if err = file.Truncate(0); err == nil {
+		_, err = file.WriteAt(data, 0)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, err
+	}
+	return &processLock{file: file}, nil, nil
+}
+
+// WaitProcessLock blocks until lock file is free or timeout expires, ErrLockBusy is returned on timeout
+func WaitProcessLock(lockPath string, owner *structs.LockOwner, timeout time.Duration) (*processLock, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		lock, holder, err := TryProcessLock(lockPath, owner)
+		if !errors.Is(err, ErrLockBusy) {
+			return lock, err
+		}
+		if time.Now().After(deadline) {
+			if holder != nil {
+				return nil, fmt.Errorf("%w: locked by pid %d (%s) for more than %s", ErrLockBusy,
+					holder.Pid, holder.Command, timeout)
+			}
+			return nil, fmt.Errorf("%w: not released in %s", ErrLockBusy, timeout)
+		}
+		if holder != nil {
+			log.Log.Warn().Int("Pid", holder.Pid).Str("Command", holder.Command).Msg("Wait for lock holder")
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func readLockOwner(file *os.File) *structs.LockOwner {
+	stat, err := file.Stat()
+	if err != nil || stat.Size() == 0 {
+		return nil
+	}
+	data := make([]byte, stat.Size())
+	if _, err = file.ReadAt(data, 0); err != nil {
+		return nil
+	}
+	owner := &structs.LockOwner{}
+	if json.Unmarshal(data, owner) != nil {
+		return nil
+	}
+	return owner
+}
+
+func (pl *processLock) Unlock() {
+	if pl == nil || pl.file == nil {
+		return
+	}
+	_ = pl.file.Truncate(0)
+	_ = syscall.Flock(int(pl.file.Fd()), syscall.LOCK_UN)
+	_ = pl.file.Close()
+	pl.file = nil
+}
+
+// ProcessLockStatus reports holder of lock file, lock of dead process is released by kernel
+func ProcessLockStatus(lockPath string) (*structs.RpcLockStatusResult, error) {
+	lock, holder, err := TryProcessLock(lockPath, &structs.LockOwner{})
+	if errors.Is(err, ErrLockBusy) {
+		status := &structs.RpcLockStatusResult{Locked: true, Holder: structs.LockProcess, Owner: holder}
+		if holder != nil {
+			status.AcquiredAt = timeRef(holder.StartedAt)
+		}
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lock.Unlock()
+	return &structs.RpcLockStatusResult{Locked: false, Holder: structs.LockFree}, nil
+}
@@ -1,34 +1,219 @@
 package log
 
 import (
+	"bytes"
+	"encoding/json"
 	"github.com/rs/zerolog"
 	"gopkg.in/natefinch/lumberjack.v2"
 	"io"
 	"os"
 	"path"
+	"runtime"
+	"strconv"
+	"sync"
 	"time"
 )
 
 var (
-	Log = zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}).
+	capture = &captureWriter{sinks: make(map[int]*captureSink), scopes: make(map[uint64]uint64)}
+	file    = &fileWriter{}
+
+	Log = zerolog.New(io.MultiWriter(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}, file, capture)).
 		Level(zerolog.DebugLevel).
 		With().
 		Timestamp().
 		Logger()
 )
 
-func OverrideLogger(debug bool, dir string) {
-	mw := io.MultiWriter(&lumberjack.Logger{
+// captureSink receives lines of goroutines of its scope, scope 0 receives lines of every goroutine
+type captureSink struct {
+	scope uint64
+	write func(line map[string]any)
+}
+
+// captureWriter copies json log lines (info and above) to every active Capture and Subscribe sink.
+// Scope of Capture is goroutine which started it and goroutines started from it by Go, zerolog writes
+// in goroutine of caller, so scope of line is known in Write
+type captureWriter struct {
+	lock   sync.Mutex
+	nextId int
+	sinks  map[int]*captureSink
+	// scopes maps goroutine id to scope it logs to
+	scopes map[uint64]uint64
+}
+
+// goroutineId reads id of current goroutine from header of its stack trace
+func goroutineId() uint64 {
+	buf := make([]byte, 64)
+	buf = bytes.TrimPrefix(buf[:runtime.Stack(buf, false)], []byte("goroutine "))
+	if end := bytes.IndexByte(buf, ' '); end > 0 {
+		buf = buf[:end]
+	}
+	id, _ := strconv.ParseUint(string(buf), 10, 64)
+	return id
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	if len(cw.sinks) == 0 {
+		return len(p), nil
+	}
+	line := make(map[string]any)
+	if err := json.Unmarshal(p, &line); err != nil {
+		return len(p), nil
+	}
+	if line[zerolog.LevelFieldName] == zerolog.LevelDebugValue || line[zerolog.LevelFieldName] == zerolog.LevelTraceValue {
+		return len(p), nil
+	}
+	var scope uint64
+	if len(cw.scopes) != 0 {
+		scope = cw.scopes[goroutineId()]
+	}
+	for _, sink := range cw.sinks {
+		if sink.scope == 0 || sink.scope == scope {
+			sink.write(line)
+		}
+	}
+	return len(p), nil
+}
+
+func (cw *captureWriter) add(sink *captureSink) int {
+	id := cw.nextId
+	cw.nextId++
+	cw.sinks[id] = sink
+	if sink.scope != 0 {
+		cw.scopes[sink.scope] = sink.scope
+	}
+	return id
+}
+
+// remove deletes sink, goroutines of its scope are forgotten with last sink of scope
+func (cw *captureWriter) remove(id int) {
+	scope := cw.sinks[id].scope
+	delete(cw.sinks, id)
+	if scope == 0 {
+		return
+	}
+	for _, sink := range cw.sinks {
+		if sink.scope == scope {
+			return
+		}
+	}
+	for goroutine, goroutineScope := range cw.scopes {
+		if goroutineScope == scope {
+			delete(cw.scopes, goroutine)
+		}
+	}
+}
+
+// Capture collects structured log lines of calling goroutine and goroutines started from it by Go
+// until returned func is called, returned func gives collected lines
+func Capture() func() []map[string]any {
+	lines := make([]map[string]any, 0)
+	stop := Follow(func(line map[string]any) {
+		lines = append(lines, line)
+	})
+	return func() []map[string]any {
+		stop()
+		return lines
+	}
+}
+
+// Follow calls sink for structured log lines of calling goroutine and goroutines started from it by Go
+// until returned func is called, sink is called under writer lock and must not block
+func Follow(sink func(line map[string]any)) func() {
+	scope := goroutineId()
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	id := capture.add(&captureSink{scope: scope, write: sink})
+	return func() {
+		capture.lock.Lock()
+		defer capture.lock.Unlock()
+		capture.remove(id)
+	}
+}
+
+// Subscribe calls sink for every structured log line until returned func is called,
+// sink is called under writer lock and must not block
+func Subscribe(sink func(line map[string]any)) func() {
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	id := capture.add(&captureSink{write: sink})
+	return func() {
+		capture.lock.Lock()
+		defer capture.lock.Unlock()
+		capture.remove(id)
+	}
+}
+
+// Go starts fn in new goroutine which logs to Capture and Follow of calling goroutine
+func Go(fn func()) {
+	capture.lock.Lock()
+	scope, scoped := capture.scopes[goroutineId()]
+	capture.lock.Unlock()
+	if !scoped {
+		go fn()
+		return
+	}
+	go func() {
+		id := goroutineId()
+		capture.lock.Lock()
+		capture.scopes[id] = scope
+		capture.lock.Unlock()
+		defer func() {
+			capture.lock.Lock()
+			if capture.scopes[id] == scope {
+				delete(capture.scopes, id)
+			}
+			capture.lock.Unlock()
+		}()
+		fn()
+	}()
+}
+
+// fileWriter writes log lines to pca.log of current log dir, nothing is written until dir is set
+type fileWriter struct {
+	lock sync.Mutex
+	dir  string
+	out  *lumberjack.Logger
+}
+
+func (fw *fileWriter) Write(p []byte) (int, error) {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	if fw.out == nil {
+		return len(p), nil
+	}
+	return fw.out.Write(p)
+}
+
+// open switches log file to dir, file of previous dir is closed
+func (fw *fileWriter) open(dir string) {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	if fw.out != nil && fw.dir == dir {
+		return
+	}
+	if fw.out != nil {
+		_ = fw.out.Close()
+	}
+	fw.dir = dir
+	fw.out = &lumberjack.Logger{
 		Filename:   path.Join(dir, "pca.log"),
 		MaxBackups: 5,   // files
 		MaxSize:    100, // megabytes
 		MaxAge:     7,   // days
-	}, zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339})
-	Log = zerolog.New(mw).Level(zerolog.DebugLevel).
-		With().
-		Timestamp().
-		Logger()
-	if !debug {
+	}
+}
+
+// OverrideLogger sets level and log dir, Log itself is not replaced, so it may be called while
+// other goroutines log, log file is reopened only when dir changes
+func OverrideLogger(debug bool, dir string) {
+	if debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
 		zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	}
+	file.open(dir)
 }
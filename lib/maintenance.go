@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"main/lib/helpers"
+	"main/lib/log"
+	"main/lib/structs"
+	"sync"
+	"time"
+)
+
+// Maintenance windows
+
+// PackagePolicy returns update policy set on control server, local policy when server has none
+func (a *Agent) PackagePolicy(info *SavedInfo) *structs.UpdatePolicy {
+	return effectivePolicy(a.ApiClient.GetPackagePolicy(info.Package.ID), info)
+}
+
+func effectivePolicy(remote *structs.UpdatePolicy, info *SavedInfo) *structs.UpdatePolicy {
+	if remote != nil && remote.Mode != "" {
+		return remote
+	}
+	return info.Policy
+}
+
+// policyCache keeps policies fetched from control server, maintenance task checks windows every minute
+// but fetches policy of package once per fetch interval
+type policyCache struct {
+	lock     *sync.Mutex
+	policies map[int]*cachedPolicy
+}
+
+type cachedPolicy struct {
+	policy    *structs.UpdatePolicy
+	fetchedAt time.Time
+}
+
+func newPolicyCache() *policyCache {
+	return &policyCache{lock: &sync.Mutex{}, policies: make(map[int]*cachedPolicy)}
+}
+
+// get returns cached policy of package, fetch is called when it is older than ttl
+func (cache *policyCache) get(packageId int, now time.Time, ttl time.Duration,
+	fetch func(packageId int) *structs.UpdatePolicy) *structs.UpdatePolicy {
+	cache.lock.Lock()
+	cached, ok := cache.policies[packageId]
+	cache.lock.Unlock()
+	if ok && now.Sub(cached.fetchedAt) < ttl {
+		return cached.policy
+	}
+	policy := fetch(packageId)
+	cache.lock.Lock()
+	cache.policies[packageId] = &cachedPolicy{policy: policy, fetchedAt: now}
+	cache.lock.Unlock()
+	return policy
+}
+
+// maintenancePolicy returns policy of package, remote policy is refreshed on commands fetch interval
+func (service *AgentServiceWrap) maintenancePolicy(info *SavedInfo, now time.Time) *structs.UpdatePolicy {
+	ttl := time.Duration(service.Settings.CommandsTimeout) * time.Second
+	if ttl <= 0 {
+		ttl = CommandsTimeout * time.Second
+	}
+	return effectivePolicy(service.policies.get(info.Package.ID, now, ttl, service.ApiClient.GetPackagePolicy), info)
+}
+
+func (a *Agent) SetPackagePolicy(packageId int, policy *structs.UpdatePolicy) error {
+	err := policy.Validate()
+	if err != nil {
+		return err
+	}
+	info := helpers.Find(a.Installed, func(i *SavedInfo) bool {
+		return i.Package.ID == packageId
+	})
+	if info == nil {
+		return fmt.Errorf("package %d not installed", packageId)
+	}
+	(*info).Policy = policy
+	a.FilesSerializeInstallation()
+	log.Log.Info().Msgf("Policy of %s set to %s", (*info).Package.Name, policy.Mode)
+	return nil
+}
+
+func (a *Agent) DisplayPolicies() {
+	t := helpers.ConstructTable(&table.Row{"#", "Package", "Mode", "Schedule", "Duration", "Timezone", "Next window"})
+	now := time.Now()
+	a.FilesIterInstalled(func(info *SavedInfo) {
+		policy := a.PackagePolicy(info)
+		if policy == nil {
+			policy = &structs.UpdatePolicy{Mode: structs.PolicyManual}
+		}
+		next := ""
+		if policy.Mode != structs.PolicyManual {
+			nextWindow, err := policy.NextWindow(now)
+			if err != nil {
+				next = err.Error()
+			} else {
+				next = nextWindow.Format(time.RFC3339)
+			}
+		}
+		t.AppendRow(table.Row{info.Package.InnerIndex,
+			fmt.Sprintf("%s\n(package id: %d)", info.Package.Name, info.Package.ID),
+			policy.Mode, policy.Schedule, time.Duration(policy.Duration) * time.Minute, policy.Timezone, next})
+		t.AppendSeparator()
+	})
+	t.Render()
+}
+
+// maintainPackage applies policy to package without prompts
+func (a *Agent) maintainPackage(info *SavedInfo, policy *structs.UpdatePolicy) (bool, error) {
+	defer func() { a.Tmp = nil }()
+	switch policy.Mode {
+	case structs.PolicyAutoUpdate:
+		return a.updatePackage(info, true)
+	case structs.PolicyAutoPatch:
+		changed := false
+		for _, pi := range info.Package.PackageItems {
+			patched, err := a.patchInstalledSoftware(info, pi.Software, true)
+			if err != nil {
+				return changed, err
+			}
+			changed = changed || patched
+		}
+		return changed, nil
+	}
+	return false, nil
+}
+
+// applyMaintenance applies automatic policies of packages whose maintenance window is open,
+// each window is applied once
+func (service *AgentServiceWrap) applyMaintenance() error {
+	now := time.Now()
+	installed := append([]*SavedInfo{}, service.Installed...)
+	for _, info := range installed {
+		policy := service.maintenancePolicy(info, now)
+		if policy == nil || policy.Mode == structs.PolicyManual {
+			continue
+		}
+		if err := policy.Validate(); err != nil {
+			log.Log.Warn().Err(err).Str("Task", "AutoMaintenance").Msgf("Invalid policy of %s", info.Package.Name)
+			continue
+		}
+		windowStart, err := policy.Window(now)
+		if err != nil || windowStart.IsZero() || info.LastWindow.Equal(windowStart) {
+			continue
+		}
+		log.Log.Info().Str("Task", "AutoMaintenance").
+			Msgf("Maintenance window of %s opened at %s, apply %s", info.Package.Name, windowStart, policy.Mode)
+		var changed bool
+		var maintainErr error
+		lockErr := WithLock(service.lock, func() error {
+			service.Tmp = info
+			notification := service.createNotification("maintenance")
+			changed, maintainErr = service.maintainPackage(info, policy)
+			context := map[string]any{"mode": policy.Mode, "window": windowStart, "changed": changed}
+			if maintainErr != nil {
+				context["error"] = maintainErr.Error()
+			}
+			notification.Context = MergeMaps(context)
+			service.ApiClient.Notify(notification)
+			// window is saved with package, so restart of service does not apply it again
+			info.LastWindow = windowStart
+			service.FilesSerializeInstallation()
+			return nil
+		})()
+		if errors.Is(lockErr, ErrLockBusy) {
+			log.Log.Info().Str("Task", "AutoMaintenance").Msg("Service is busy, retry later")
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package lib
+
+import (
+	"main/lib/structs"
+	"testing"
+	"time"
+)
+
+func TestPolicyCacheRefreshesOnTtl(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		packageId int
+		at        time.Duration
+		wantFetch bool
+	}{
+		{"first get fetches", 1, 0, true},
+		{"cached within ttl", 1, 59 * time.Second, false},
+		{"other package fetches", 2, 59 * time.Second, true},
+		{"refreshed after ttl", 1, time.Minute, true},
+		{"cached after refresh", 1, 90 * time.Second, false},
+	}
+	cache := newPolicyCache()
+	fetches := 0
+	fetch := func(packageId int) *structs.UpdatePolicy {
+		fetches++
+		return &structs.UpdatePolicy{Mode: structs.PolicyAutoPatch}
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := fetches
+			policy := cache.get(test.packageId, start.Add(test.at), time.Minute, fetch)
+			if fetched := fetches > before; fetched != test.wantFetch {
+				t.Fatalf("fetched = %v, want %v", fetched, test.wantFetch)
+			}
+			if policy == nil || policy.Mode != structs.PolicyAutoPatch {
+				t.Fatalf("policy = %+v, want cached policy", policy)
+			}
+		})
+	}
+}
+
+func TestEffectivePolicy(t *testing.T) {
+	local := &structs.UpdatePolicy{Mode: structs.PolicyAutoUpdate}
+	remote := &structs.UpdatePolicy{Mode: structs.PolicyAutoPatch}
+	tests := []struct {
+		name   string
+		remote *structs.UpdatePolicy
+		local  *structs.UpdatePolicy
+		want   *structs.UpdatePolicy
+	}{
+		{"remote wins", remote, local, remote},
+		{"no remote", nil, local, local},
+		{"remote without mode", &structs.UpdatePolicy{}, local, local},
+		{"none", nil, nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := effectivePolicy(test.remote, &SavedInfo{Policy: test.local}); got != test.want {
+				t.Fatalf("effectivePolicy() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Minimal prometheus text exposition (version 0.0.4) registry: counters, gauges and histograms with labels
+
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+type series struct {
+	labels  []string
+	value   float64
+	buckets []uint64 // histogram only
+	count   uint64
+}
+
+type family struct {
+	lock       sync.Mutex
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	bounds     []float64
+	series     map[string]*series
+}
+
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", f.name, len(f.labelNames), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: append([]string{}, values...)}
+		if f.kind == "histogram" {
+			s.buckets = make([]uint64, len(f.bounds))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) reset() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.series = make(map[string]*series)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, extra[0]+`="`+labelEscaper.Replace(extra[1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (f *family) write(w io.Writer) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labelNames, s.labels), formatValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range f.bounds {
+			cumulative += s.buckets[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labelNames, s.labels, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labelNames, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(f.labelNames, s.labels), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(f.labelNames, s.labels), s.count)
+	}
+}
+
+// Registry
+
+type Registry struct {
+	lock     sync.Mutex
+	families []*family
+	onScrape []func()
+}
+
+var Default = &Registry{}
+
+func (r *Registry) register(name string, help string, kind string, labels []string) *family {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, f := range r.families {
+		if f.name == name {
+			panic("metric " + name + " already registered")
+		}
+	}
+	f := &family{name: name, help: help, kind: kind, labelNames: labels, series: make(map[string]*series)}
+	r.families = append(r.families, f)
+	return f
+}
+
+// OnScrape registers hook called before every exposition, used to refresh gauges computed from state
+func (r *Registry) OnScrape(hook func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.onScrape = append(r.onScrape, hook)
+}
+
+func (r *Registry) Write(w io.Writer) {
+	r.lock.Lock()
+	hooks := append([]func(){}, r.onScrape...)
+	families := append([]*family{}, r.families...)
+	r.lock.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+	for _, f := range families {
+		f.write(w)
+	}
+}
+
+func (r *Registry) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		r.Write(w)
+	}
+}
+
+// Counter
+
+type Counter struct{ f *family }
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	return &Counter{Default.register(name, help, "counter", labels)}
+}
+
+func (c *Counter) Add(v float64, labels ...string) {
+	c.f.lock.Lock()
+	defer c.f.lock.Unlock()
+	c.f.get(labels).value += v
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Gauge
+
+type Gauge struct{ f *family }
+
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	return &Gauge{Default.register(name, help, "gauge", labels)}
+}
+
+func (g *Gauge) Set(v float64, labels ...string) {
+	g.f.lock.Lock()
+	defer g.f.lock.Unlock()
+	g.f.get(labels).value = v
+}
+
+func (g *Gauge) Add(v float64, labels ...string) {
+	g.f.lock.Lock()
+	defer g.f.lock.Unlock()
+	g.f.get(labels).value += v
+}
+
+// Reset drops all label combinations, used for info gauges rebuilt on scrape
+func (g *Gauge) Reset() {
+	g.f.reset()
+}
+
+// Histogram
+
+type Histogram struct{ f *family }
+
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	f := Default.register(name, help, "histogram", labels)
+	f.bounds = append([]float64{}, buckets...)
+	sort.Float64s(f.bounds)
+	return &Histogram{f}
+}
+
+func (h *Histogram) Observe(v float64, labels ...string) {
+	h.f.lock.Lock()
+	defer h.f.lock.Unlock()
+	s := h.f.get(labels)
+	for i, bound := range h.f.bounds {
+		if v <= bound {
+			s.buckets[i]++
+			break
+		}
+	}
+	s.count++
+	s.value += v
+}
@@ -1,17 +1,27 @@
 package lib
 
 import (
+	"errors"
+	"fmt"
 	"main/lib/helpers"
+	"main/lib/jsonrpc"
 	"main/lib/log"
 	"main/lib/structs"
-	"net/rpc"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const commandsHistorySize = 200
+
+// commandsHistoryLock guards read-modify-write of commands history file between service tasks
+var commandsHistoryLock = &sync.Mutex{}
+
 // File Watcher
 
 type FilesWatcherMixin struct {
@@ -19,6 +29,9 @@ type FilesWatcherMixin struct {
 	Installed []*SavedInfo
 	Tmp       *SavedInfo
 	CommandId *int
+
+	// stateVersion is bumped on every change of installed packages, it is pointer as mixin is copied by wraps
+	stateVersion *atomic.Uint64
 }
 
 type SavedInfo struct {
@@ -26,25 +39,70 @@ type SavedInfo struct {
 	Client  *structs.Client  `json:"client" groups:"local"`
 	Product *structs.Product `json:"product" groups:"local"`
 	Package *structs.Package `json:"package" groups:"local"`
+
+	Policy *structs.UpdatePolicy `json:"policy" groups:"local"`
+	// LastWindow is start of last maintenance window applied to package, each window is applied once
+	LastWindow time.Time `json:"last_window" groups:"local"`
 }
 
 type LogBufferFile struct {
 	Logs []*structs.RestLogPost `json:"logs"`
 }
 
+type CommandRecord struct {
+	Result       *structs.RestCommandResultPost `json:"result"`
+	Acknowledged bool                           `json:"acknowledged"`
+}
+
+// Finished is true when command reached final state and may be reported
+func (record *CommandRecord) Finished() bool {
+	return record.Result.Status != structs.CommandReceived && record.Result.Status != structs.CommandRunning
+}
+
+var ErrCommandNotReceived = errors.New("command is not in received state")
+
+// CommandsHistoryFile is a journal of remote commands, commands are stored before execution.
+// MaxTrimmedId remembers the newest command dropped from journal, server ids only grow,
+// so ids not greater than it were already executed
+type CommandsHistoryFile struct {
+	Records      []*CommandRecord `json:"records"`
+	MaxTrimmedId int              `json:"max_trimmed_id"`
+}
+
+// Known tells whether command with given id was ever received
+func (history *CommandsHistoryFile) Known(cmdId int) bool {
+	if cmdId <= history.MaxTrimmedId {
+		return true
+	}
+	for _, record := range history.Records {
+		if record.Result.CmdTriggerId == cmdId {
+			return true
+		}
+	}
+	return false
+}
+
 func (fw *FilesWatcherMixin) FilesReload() {
 	fw.FilesLoadInstalled()
 }
 
 func (fw *FilesWatcherMixin) FilesLoadInstalled() {
+	installed := make([]*SavedInfo, 0)
 	files, _ := os.ReadDir(fw.Settings.InfoDir)
 	for _, file := range files {
 		if !file.IsDir() && strings.Contains(file.Name(), ".json") {
 			installation := &SavedInfo{}
 			SafeReadJsonFile(path.Join(fw.Settings.InfoDir, file.Name()), installation)
-			fw.Installed = append(fw.Installed, installation)
+			installed = append(installed, installation)
 		}
 	}
+	fw.Installed = installed
+	fw.stateVersion.Add(1)
+}
+
+// FilesStateVersion changes every time installed packages are loaded or saved
+func (fw *FilesWatcherMixin) FilesStateVersion() uint64 {
+	return fw.stateVersion.Load()
 }
 
 func (fw *FilesWatcherMixin) FilesAddInstallation(client *structs.Client, product *structs.Product, pkg *structs.Package, unit *structs.Unit) {
@@ -64,6 +122,7 @@ func (fw *FilesWatcherMixin) FilesForgetPackage(packageId int) {
 		}
 		return true
 	})
+	fw.stateVersion.Add(1)
 }
 
 func (fw *FilesWatcherMixin) filesUpdateInnerIndexes() {
@@ -100,10 +159,11 @@ func (fw *FilesWatcherMixin) FilesGetInfoByPackageID(packageId int) *structs.Pac
 }
 
 func (fw *FilesWatcherMixin) FilesSerializeInstallation() {
-	if fw.Tmp != nil {
+	if fw.Tmp != nil && !helpers.Contains(fw.Installed, fw.Tmp) {
 		fw.Installed = append(fw.Installed, fw.Tmp)
 	}
 	fw.filesUpdateInnerIndexes()
+	fw.stateVersion.Add(1)
 	for _, inst := range fw.Installed {
 		fileName := path.Join(fw.Settings.InfoDir, inst.Package.Name+".json")
 		err := os.WriteFile(fileName, make([]byte, 0), 0666)
@@ -129,6 +189,31 @@ func (fw *FilesWatcherMixin) FilesClearTmp() {
 	}
 }
 
+// RegistrationFile is written after successful registration on control server
+type RegistrationFile struct {
+	RegisteredAt time.Time `json:"registered_at"`
+	ControlIp    string    `json:"control_ip"`
+	LocalAddress string    `json:"local_address"`
+}
+
+func (fw *FilesWatcherMixin) FilesStoreRegistration(registration *RegistrationFile) error {
+	fileName := filepath.Join(fw.Settings.SystemDir, "registration.json")
+	return SafeWriteJsonFile(registration, nil, fileName, 0644)
+}
+
+// FilesGetRegistration returns nil if agent was never registered
+func (fw *FilesWatcherMixin) FilesGetRegistration() *RegistrationFile {
+	fileName := filepath.Join(fw.Settings.SystemDir, "registration.json")
+	if !helpers.FileExists(fileName) {
+		return nil
+	}
+	registration := &RegistrationFile{}
+	if err := SafeReadJsonFile(fileName, registration); err != nil {
+		return nil
+	}
+	return registration
+}
+
 func (fw *FilesWatcherMixin) FilesStoreLogInBuffer(logData *structs.RestLogPost) {
 	fileName := filepath.Join(fw.Settings.LogDir, "soft.log.json")
 	dataBuffer := fw.FilesGetLogsBuffer()
@@ -164,30 +249,169 @@ func (fw *FilesWatcherMixin) FilesClearLogsBuffer() error {
 	return nil
 }
 
+func (fw *FilesWatcherMixin) FilesGetCommandsHistory() *CommandsHistoryFile {
+	fileName := filepath.Join(fw.Settings.SystemDir, "commands.json")
+	history := &CommandsHistoryFile{Records: make([]*CommandRecord, 0)}
+	readErr := SafeReadJsonFile(fileName, history)
+	if readErr != nil {
+		log.Log.Warn().Err(readErr).Msg("Can't read commands history")
+		return nil
+	}
+	return history
+}
+
+// FilesUpdateCommandsHistory applies change to commands history and drops oldest reported records
+func (fw *FilesWatcherMixin) FilesUpdateCommandsHistory(change func(history *CommandsHistoryFile) error) error {
+	commandsHistoryLock.Lock()
+	defer commandsHistoryLock.Unlock()
+	history := fw.FilesGetCommandsHistory()
+	if history == nil {
+		return errors.New("commands history unavailable")
+	}
+	err := change(history)
+	if err != nil {
+		return err
+	}
+	overflow := len(history.Records) - commandsHistorySize
+	history.Records = helpers.Filter(history.Records, func(record *CommandRecord) bool {
+		if overflow > 0 && record.Acknowledged {
+			overflow--
+			if record.Result.CmdTriggerId > history.MaxTrimmedId {
+				history.MaxTrimmedId = record.Result.CmdTriggerId
+			}
+			return false
+		}
+		return true
+	})
+	fileName := filepath.Join(fw.Settings.SystemDir, "commands.json")
+	return SafeWriteJsonFile(history, nil, fileName, 0666)
+}
+
+// FilesReceiveCommand journals new command, fails if command with same id was received before
+func (fw *FilesWatcherMixin) FilesReceiveCommand(cmd *structs.RestCommandGet) error {
+	return fw.FilesUpdateCommandsHistory(func(history *CommandsHistoryFile) error {
+		if history.Known(cmd.ID) {
+			return fmt.Errorf("command %d already received", cmd.ID)
+		}
+		history.Records = append(history.Records, &CommandRecord{Result: &structs.RestCommandResultPost{
+			CmdTriggerId: cmd.ID,
+			Command:      cmd.Command,
+			Status:       structs.CommandReceived,
+		}})
+		return nil
+	})
+}
+
+// FilesStartCommandRecord replaces journaled command by result only while command is still received,
+// so command resumed after restart or delivered twice runs once
+func (fw *FilesWatcherMixin) FilesStartCommandRecord(result *structs.RestCommandResultPost) error {
+	return fw.FilesUpdateCommandsHistory(func(history *CommandsHistoryFile) error {
+		for i, existed := range history.Records {
+			if existed.Result.CmdTriggerId != result.CmdTriggerId {
+				continue
+			}
+			if existed.Result.Status != structs.CommandReceived {
+				return fmt.Errorf("%w: command %d is %s", ErrCommandNotReceived, result.CmdTriggerId, existed.Result.Status)
+			}
+			history.Records[i] = &CommandRecord{Result: result}
+			return nil
+		}
+		return fmt.Errorf("%w: command %d is not journaled", ErrCommandNotReceived, result.CmdTriggerId)
+	})
+}
+
+func (fw *FilesWatcherMixin) FilesStoreCommandRecord(record *CommandRecord) error {
+	return fw.FilesUpdateCommandsHistory(func(history *CommandsHistoryFile) error {
+		for i, existed := range history.Records {
+			if existed.Result.CmdTriggerId == record.Result.CmdTriggerId {
+				history.Records[i] = record
+				return nil
+			}
+		}
+		history.Records = append(history.Records, record)
+		return nil
+	})
+}
+
+func (fw *FilesWatcherMixin) FilesAckCommandRecord(cmdId int) error {
+	return fw.FilesUpdateCommandsHistory(func(history *CommandsHistoryFile) error {
+		for _, record := range history.Records {
+			if record.Result.CmdTriggerId == cmdId {
+				record.Acknowledged = true
+			}
+		}
+		return nil
+	})
+}
+
 // RPC Client
 
 type RpcClientMixin struct {
-	RpcClient *rpc.Client
+	RpcClient *jsonrpc.Client
+	LockFile  string
+	leaseId   string
+	stopRenew chan struct{}
+	fileLock  *processLock
 }
 
+// RemoteLock takes lease on service lock and renews it until unlock,
+// when service is down lock file guards against concurrent cli processes
 func (rpc *RpcClientMixin) RemoteLock() {
-	if rpc.RpcClient != nil {
-		var status int
-		err := rpc.RpcClient.Call(ServiceName+".RpcLock", status, &status)
+	owner := CurrentLockOwner()
+	if rpc.RpcClient == nil {
+		if rpc.LockFile == "" {
+			return
+		}
+		fileLock, holder, err := TryProcessLock(rpc.LockFile, owner)
+		if errors.Is(err, ErrLockBusy) && holder != nil {
+			log.Log.Fatal().Int("Pid", holder.Pid).Str("Command", holder.Command).
+				Msgf("Locked by other process since %s", holder.StartedAt.Local().Format(time.RFC3339))
+		}
 		if err != nil {
-			rpc.RemoteUnlock()
 			log.Log.Fatal().Err(err).Msg("remoteLock() fails")
 		}
+		rpc.fileLock = fileLock
+		return
+	}
+	result := &structs.RpcLockResult{}
+	err := rpc.RpcClient.Call(structs.RpcLock, &structs.RpcLockParams{Owner: owner, Ttl: LockLeaseTtl}, result)
+	if err != nil {
+		log.Log.Fatal().Err(err).Msg("remoteLock() fails")
+	}
+	rpc.leaseId = result.LeaseId
+	rpc.stopRenew = make(chan struct{})
+	go rpc.renewLease(rpc.leaseId, rpc.stopRenew)
+}
+
+// renewLease is heartbeat of lease, service releases lease which is not renewed within ttl
+func (rpc *RpcClientMixin) renewLease(leaseId string, stop chan struct{}) {
+	ticker := time.NewTicker(LockLeaseTtl * time.Second / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := rpc.RpcClient.Call(structs.RpcRenew, &structs.RpcRenewParams{LeaseId: leaseId}, nil)
+			if err != nil {
+				log.Log.Error().Err(err).Msg("Can't renew lock lease")
+			}
+		}
 	}
 }
 
 func (rpc *RpcClientMixin) RemoteUnlock() {
-	var status int
-	if rpc.RpcClient != nil {
-		err := rpc.RpcClient.Call(ServiceName+".RpcUnlock", &status, &status)
+	if rpc.fileLock != nil {
+		rpc.fileLock.Unlock()
+		rpc.fileLock = nil
+	}
+	if rpc.RpcClient != nil && rpc.leaseId != "" {
+		close(rpc.stopRenew)
+		err := rpc.RpcClient.Call(structs.RpcUnlock, &structs.RpcUnlockParams{LeaseId: rpc.leaseId}, nil)
 		if err != nil {
-			log.Log.Fatal().Err(err).Msg("remoteUnlock() fails")
+			log.Log.Error().Err(err).Msg("remoteUnlock() fails")
 		}
+		rpc.leaseId = ""
 	}
 }
 
@@ -198,13 +422,68 @@ func (rpc *RpcClientMixin) WithRemoteLock(f func()) {
 	return
 }
 
+// RemoteLockStatus asks service for lock holder, when service is down reports holder of lock file
+func (rpc *RpcClientMixin) RemoteLockStatus() (*structs.RpcLockStatusResult, error) {
+	if rpc.RpcClient == nil {
+		return ProcessLockStatus(rpc.LockFile)
+	}
+	status := &structs.RpcLockStatusResult{}
+	return status, rpc.RpcClient.Call(structs.RpcLockStatus, &structs.RpcEmpty{}, status)
+}
+
+// RemoteLockBreak releases lease of other process, lock file can't be broken
+// as it is released by kernel when holder exits, only stale owner info is cleared
+func (rpc *RpcClientMixin) RemoteLockBreak() (*structs.RpcLockStatusResult, error) {
+	if rpc.RpcClient != nil {
+		broken := &structs.RpcLockStatusResult{}
+		return broken, rpc.RpcClient.Call(structs.RpcLockBreak, &structs.RpcEmpty{}, broken)
+	}
+	status, err := ProcessLockStatus(rpc.LockFile)
+	if err != nil {
+		return nil, err
+	}
+	if status.Locked {
+		owner := "unknown process"
+		if status.Owner != nil {
+			owner = fmt.Sprintf("pid %d", status.Owner.Pid)
+		}
+		return nil, fmt.Errorf("lock file is held by live %s, stop it to release lock", owner)
+	}
+	return status, nil
+}
+
 func (rpc *RpcClientMixin) RemoteReconfigure() {
 	if rpc.RpcClient != nil {
-		var status int
-		err := rpc.RpcClient.Call("Agent.RpcReconfigure", &status, &status)
+		err := rpc.RpcClient.Call(structs.RpcReconfigure, &structs.RpcEmpty{}, nil)
 		if err != nil {
 			rpc.RemoteUnlock()
 			log.Log.Fatal().Err(err).Msg("RpcReconfigure failed")
 		}
 	}
 }
+
+func (rpc *RpcClientMixin) RemoteStatus() (*structs.LocalStatusGet, error) {
+	if rpc.RpcClient == nil {
+		return nil, errors.New("service is not running")
+	}
+	status := &structs.LocalStatusGet{}
+	return status, rpc.RpcClient.Call(structs.RpcStatus, &structs.RpcEmpty{}, status)
+}
+
+func (rpc *RpcClientMixin) RemoteProxyAgents() ([]*structs.DownstreamAgent, error) {
+	if rpc.RpcClient == nil {
+		return nil, errors.New("service is not running")
+	}
+	result := &structs.RpcProxyAgentsResult{}
+	err := rpc.RpcClient.Call(structs.RpcProxyAgents, &structs.RpcEmpty{}, result)
+	return result.Agents, err
+}
+
+func (rpc *RpcClientMixin) RemoteTailLogs(lines int) ([]map[string]any, error) {
+	if rpc.RpcClient == nil {
+		return nil, errors.New("service is not running")
+	}
+	result := &structs.RpcTailLogsResult{}
+	err := rpc.RpcClient.Call(structs.RpcTailLogs, &structs.RpcTailLogsParams{Lines: lines}, result)
+	return result.Lines, err
+}
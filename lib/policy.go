@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"github.com/alecthomas/kingpin/v2"
+	"main/lib/helpers"
+	"main/lib/log"
+	"regexp"
+	"strings"
+)
+
+// Remote commands policy
+
+// FlagRule constrains value of allowed flag, empty rule allows any value
+type FlagRule struct {
+	Pattern string   `json:"pattern"`
+	Values  []string `json:"values"`
+}
+
+// CommandRule allows one subcommand (full command, like "soft config") with listed flags only
+type CommandRule struct {
+	Command        string               `json:"command"`
+	Flags          map[string]*FlagRule `json:"flags"`
+	ImpliesConfirm bool                 `json:"implies_confirm"`
+}
+
+type CommandsPolicy struct {
+	Rules []*CommandRule `json:"rules"`
+}
+
+var ErrCommandDenied = errors.New("command denied by policy")
+
+func DefaultCommandsPolicy() *CommandsPolicy {
+	id := &FlagRule{Pattern: "^-?[0-9]+$"}
+	return &CommandsPolicy{Rules: []*CommandRule{
+		{Command: "version"},
+		{Command: "reg"},
+		{Command: "list", Flags: map[string]*FlagRule{"verbose": {}}},
+		{Command: "install", Flags: map[string]*FlagRule{"client": id, "product": id, "package": id}},
+		{Command: "update", Flags: map[string]*FlagRule{"package": id, "inner-index": id}, ImpliesConfirm: true},
+		{Command: "patch", Flags: map[string]*FlagRule{"software": id}, ImpliesConfirm: true},
+		{Command: "soft config", Flags: map[string]*FlagRule{"software": id}},
+	}}
+}
+
+// LoadCommandsPolicy reads policy file, any read error means deny all
+func LoadCommandsPolicy(filePath string) (*CommandsPolicy, error) {
+	if !helpers.FileExists(filePath) {
+		return nil, fmt.Errorf("policy file %s not found", filePath)
+	}
+	policy := &CommandsPolicy{}
+	err := SafeReadJsonFile(filePath, policy)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range policy.Rules {
+		for name, flagRule := range rule.Flags {
+			if flagRule == nil || flagRule.Pattern == "" {
+				continue
+			}
+			if _, reErr := regexp.Compile(flagRule.Pattern); reErr != nil {
+				return nil, fmt.Errorf("rule %s, flag %s: %w", rule.Command, name, reErr)
+			}
+		}
+	}
+	return policy, nil
+}
+
+// Check validates command arguments against policy and returns matched rule
+func (p *CommandsPolicy) Check(args []string) (*CommandRule, error) {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "@") {
+			return nil, fmt.Errorf("%w: argument files are not allowed", ErrCommandDenied)
+		}
+	}
+	ctx, err := Commander.ParseContext(args)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCommandDenied, err.Error())
+	}
+	if ctx.SelectedCommand == nil {
+		return nil, fmt.Errorf("%w: command not specified", ErrCommandDenied)
+	}
+	fullCommand := ctx.SelectedCommand.FullCommand()
+	rule := helpers.Find(p.Rules, func(r *CommandRule) bool {
+		return r.Command == fullCommand
+	})
+	if rule == nil {
+		return nil, fmt.Errorf("%w: %s is not allowed", ErrCommandDenied, fullCommand)
+	}
+	for _, element := range ctx.Elements {
+		switch clause := element.Clause.(type) {
+		case *kingpin.FlagClause:
+			name := clause.Model().Name
+			flagRule, allowed := (*rule).Flags[name]
+			if !allowed {
+				return nil, fmt.Errorf("%w: flag --%s is not allowed for %s", ErrCommandDenied, name, fullCommand)
+			}
+			if !flagRule.allows(*element.Value) {
+				return nil, fmt.Errorf("%w: value %q is not allowed for --%s", ErrCommandDenied, *element.Value, name)
+			}
+		case *kingpin.ArgClause:
+			return nil, fmt.Errorf("%w: positional arguments are not allowed", ErrCommandDenied)
+		}
+	}
+	log.Log.Debug().Str("command", fullCommand).Msg("Command allowed by policy")
+	return *rule, nil
+}
+
+func (r *FlagRule) allows(value string) bool {
+	if r == nil {
+		return true
+	}
+	if len(r.Values) != 0 && !helpers.Contains(r.Values, value) {
+		return false
+	}
+	if r.Pattern != "" {
+		return regexp.MustCompile(r.Pattern).MatchString(value)
+	}
+	return true
+}
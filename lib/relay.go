@@ -0,0 +1,272 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"main/lib/log"
+	"main/lib/structs"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Relay of downstream agents: requests under /proxy/ are forwarded to control server, or with AsProxy
+// to next relay which expects /proxy/ prefix, so chain of any length keeps prefix until its last relay.
+// One reverse proxy and transport serve all requests, bodies are streamed except of reg, which gets
+// SECRET of relay appended to proxy_info. Hop records of chain are described in trace.go.
+
+const (
+	relayPrefix = "/proxy"
+	// maxRegBody limits reg body, it is decoded in memory
+	maxRegBody = 1 << 20
+)
+
+type relay struct {
+	service   *AgentServiceWrap
+	transport *http.Transport
+	proxy     *httputil.ReverseProxy
+	cache     *buildCache
+}
+
+// relayBodyKey carries rewritten body of reg from ServeHTTP to director
+type relayBodyKey struct{}
+
+func newRelay(service *AgentServiceWrap) *relay {
+	r := &relay{service: service, transport: service.upstreamTransport()}
+	r.proxy = &httputil.ReverseProxy{
+		Director:      r.direct,
+		Transport:     r.transport,
+		FlushInterval: -1,
+		ErrorHandler:  r.fail,
+	}
+	r.cache = service.proxyBuildCache()
+	return r
+}
+
+// proxyBuildCache returns build cache of relay, it is created once per cache dir and shared by relays
+// of restarted tasks, so fetches still running keep their files
+func (service *AgentServiceWrap) proxyBuildCache() *buildCache {
+	if service.Settings.ProxyCacheSize <= 0 {
+		return nil
+	}
+	service.tasksLock.Lock()
+	defer service.tasksLock.Unlock()
+	maxBytes := int64(service.Settings.ProxyCacheSize) << 20
+	if service.buildCache == nil || service.buildCache.dir != service.Settings.ProxyCacheDir {
+		service.buildCache = newBuildCache(service.Settings.ProxyCacheDir, maxBytes)
+	} else {
+		service.buildCache.resize(maxBytes)
+	}
+	return service.buildCache
+}
+
+// upstreamUrl is address of control server or next relay requests of downstream agents are proxied to
+func (service *AgentServiceWrap) upstreamUrl() *url.URL {
+	u, _ := url.Parse(fmt.Sprintf("%s://%s%s",
+		service.Settings.NetInfo.Protocol,
+		service.Settings.NetInfo.ControlIp,
+		service.Settings.NetInfo.ControlPort))
+	return u
+}
+
+// upstreamTransport is shared by proxied requests and build cache, upstream is verified like by rest client
+func (service *AgentServiceWrap) upstreamTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	config, err := UpstreamTlsConfig(service.Settings.NetInfo)
+	if err != nil {
+		log.Log.Error().Err(err).Msg("Invalid tls settings of upstream, system roots are used")
+		config = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	transport.TLSClientConfig = config
+	transport.ResponseHeaderTimeout = time.Minute
+	transport.MaxIdleConnsPerHost = 32
+	return transport
+}
+
+// upstreamPath keeps /proxy/ prefix only when upstream is relay too
+func (r *relay) upstreamPath(path string) string {
+	if r.service.Settings.NetInfo.AsProxy {
+		return path
+	}
+	return strings.TrimPrefix(path, relayPrefix)
+}
+
+func (r *relay) direct(req *http.Request) {
+	upstream := r.service.upstreamUrl()
+	req.URL.Scheme = upstream.Scheme
+	req.URL.Host = upstream.Host
+	req.URL.Path = r.upstreamPath(req.URL.Path)
+	req.URL.RawPath = ""
+	req.Host = upstream.Host
+	if body, ok := req.Context().Value(relayBodyKey{}).([]byte); ok {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// explicitly disable User-Agent so it's not set to default value
+		req.Header.Set("User-Agent", "")
+	}
+}
+
+// relayErrorCode maps transport errors to 504 on timeout and 502 otherwise
+func relayErrorCode(err error) int {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func (r *relay) fail(w http.ResponseWriter, req *http.Request, err error) {
+	if errors.Is(req.Context().Err(), context.Canceled) {
+		// downstream is gone, nobody reads response
+		log.Log.Debug().Err(err).Msgf("Proxy request %s canceled by client", req.URL.Path)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	code := relayErrorCode(err)
+	log.Log.Error().Err(err).Int("Code", code).Msgf("Proxy request %s %s failed", req.Method, req.URL.Path)
+	_ = WriteJsonResponse(w, code, map[string]any{"msg": http.StatusText(code)})
+}
+
+// rewriteReg appends SECRET of relay to proxy_info, so control server knows chain of relays of agent.
+// Only proxy_info of body is replaced, fields unknown to this version are passed as sent by agent
+func (r *relay) rewriteReg(body []byte, reg *structs.RestRegPost) ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	proxyInfo := make(map[int]string, len(reg.ProxyInfo)+1)
+	next := 0
+	for key, secret := range reg.ProxyInfo {
+		proxyInfo[key] = secret
+		if key >= next {
+			next = key + 1
+		}
+	}
+	proxyInfo[next] = r.service.Settings.SECRET
+	encoded, err := json.Marshal(proxyInfo)
+	if err != nil {
+		return nil, err
+	}
+	fields["proxy_info"] = encoded
+	return json.Marshal(fields)
+}
+
+// decodeRegBody returns reg body as sent by agent and decoded
+func decodeRegBody(req *http.Request) ([]byte, *structs.RestRegPost, error) {
+	defer req.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxRegBody))
+	if err != nil {
+		return nil, nil, err
+	}
+	reg := &structs.RestRegPost{}
+	if err = json.Unmarshal(body, reg); err != nil {
+		return nil, nil, err
+	}
+	return body, reg, nil
+}
+
+// probe asks upstream read only route with credentials of downstream agent, 0 is returned when upstream
+// did not answer. Upstream relay checks agent by its own probe before answering
+func (r *relay) probe(req *http.Request) int {
+	target := r.service.upstreamUrl()
+	target.Path = r.upstreamPath(relayPrefix + traceControlPath)
+	check, err := upstreamRequest(req.Context(), http.MethodGet, target, req)
+	if err != nil {
+		return 0
+	}
+	client := &http.Client{Transport: r.transport, Timeout: traceTimeout}
+	resp, err := client.Do(check)
+	if err != nil {
+		log.Log.Warn().Err(err).Str("Client", req.RemoteAddr).Msg("Approval check of downstream agent failed")
+		return 0
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxRegBody))
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func (r *relay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	started := time.Now()
+	path := strings.TrimPrefix(req.URL.Path, relayPrefix)
+	var reg *structs.RestRegPost
+	if path == downstreamRegPath && req.Method == http.MethodPost {
+		body, decoded, err := decodeRegBody(req)
+		if err == nil {
+			body, err = r.rewriteReg(body, decoded)
+		}
+		if err != nil {
+			rejectDownstream(w, req, http.StatusBadRequest, "invalid reg body: "+err.Error())
+			return
+		}
+		reg = decoded
+		req = req.WithContext(context.WithValue(req.Context(), relayBodyKey{}, body))
+	}
+	hops := ParseHops(req.Header.Get(HopsHeader))
+	own := AgentId(r.service.Settings)
+	for _, hop := range hops {
+		if hop.Agent == own {
+			rejectDownstream(w, req, http.StatusLoopDetected, "relay loop: "+req.Header.Get(HopsHeader))
+			return
+		}
+	}
+	if len(hops) >= maxRelayHops {
+		rejectDownstream(w, req, http.StatusLoopDetected, "too many relays")
+		return
+	}
+	visit, ok := r.service.downstream.admit(w, req, reg)
+	if !ok {
+		return
+	}
+	req.Header.Set(HopsHeader, appendHop(req.Header.Get(HopsHeader),
+		&structs.ProxyHop{Agent: own, Address: clientIp(req).String(), At: started}))
+	if visit.probe {
+		code := r.probe(req)
+		if !r.service.downstream.decide(visit, code) {
+			if code == 0 || code >= 500 {
+				rejectDownstream(w, req, http.StatusBadGateway, "approval check of agent failed")
+			} else {
+				rejectDownstream(w, req, http.StatusForbidden, "agent is not approved by control server")
+			}
+			return
+		}
+	}
+	recorder := &statusRecorder{ResponseWriter: w}
+	cached := false
+	observed := 0
+	defer func() {
+		if observed == 0 {
+			observed = recorder.code
+		}
+		r.service.downstream.observe(visit, observed)
+		log.Log.Info().Str("Client", req.RemoteAddr).Str("Agent", visit.key[:12]).Str("Method", req.Method).
+			Str("Path", path).Int("Code", recorder.code).Int64("Bytes", recorder.written).Bool("Cache", cached).
+			Dur("Duration", time.Since(started)).Msg("Proxy request")
+	}()
+	if path == tracePath && req.Method == http.MethodGet {
+		observed = r.trace(recorder, req)
+		return
+	}
+	if match := buildDownloadPath.FindStringSubmatch(path); match != nil && r.cache != nil &&
+		(req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		buildId, _ := strconv.Atoi(match[1])
+		target := r.service.upstreamUrl()
+		target.Path = r.upstreamPath(req.URL.Path)
+		target.RawQuery = req.URL.RawQuery
+		if cached = r.cache.serveBuild(recorder, req, buildId, target, r.transport); cached {
+			return
+		}
+	}
+	r.proxy.ServeHTTP(recorder, req)
+}
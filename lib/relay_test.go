@@ -0,0 +1,57 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRewriteRegKeepsUnknownFields(t *testing.T) {
+	r := &relay{service: &AgentServiceWrap{Agent: Agent{FilesWatcherMixin: FilesWatcherMixin{
+		Settings: &Settings{SECRET: "relay"}}}}}
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"first relay", `{"agent_secret":"agent","version":"1.0"}`,
+			`{"agent_secret":"agent","version":"1.0","proxy_info":{"0":"relay"}}`},
+		{"next relay", `{"agent_secret":"agent","proxy_info":{"0":"edge","3":"middle"}}`,
+			`{"agent_secret":"agent","proxy_info":{"0":"edge","3":"middle","4":"relay"}}`},
+		{"unknown fields", `{"agent_secret":"agent","features":["shell"],"hardware":{"cpus":4}}`,
+			`{"agent_secret":"agent","features":["shell"],"hardware":{"cpus":4},"proxy_info":{"0":"relay"}}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+			body, reg, err := decodeRegBody(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rewritten, err := r.rewriteReg(body, reg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want map[string]any
+			if err = json.Unmarshal(rewritten, &got); err != nil {
+				t.Fatal(err)
+			}
+			if err = json.Unmarshal([]byte(test.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("rewritten reg = %s, want %s", rewritten, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeRegBodyRejectsInvalidBody(t *testing.T) {
+	for _, body := range []string{"", "[]", `{"proxy_info":"edge"}`, `{"agent_secret":"a"} {}`} {
+		if _, _, err := decodeRegBody(httptest.NewRequest("POST", "/", strings.NewReader(body))); err == nil {
+			t.Fatalf("decodeRegBody(%q) succeeded, error expected", body)
+		}
+	}
+}
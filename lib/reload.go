@@ -0,0 +1,267 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"main/lib/helpers"
+	"main/lib/log"
+	"main/lib/structs"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Config reload: config file is watched by service, valid config is applied in place
+// and kept as last known good, invalid config is rejected and service keeps previous one
+
+const configReloadDebounce = 500 * time.Millisecond
+
+var ErrInvalidSettings = errors.New("invalid settings")
+
+// secretSettings are masked in logged diffs
+var secretSettings = []string{"secret", "token_sha256"}
+
+func lastGoodConfigPath() string {
+	return ConfigPath + ".last-good"
+}
+
+// ReadSettingsFile reads settings over defaults, unlike LoadSettings it rejects broken json and unknown keys
+func ReadSettingsFile(filename string) (*Settings, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	settings := DefaultSettings()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(settings); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSettings, err.Error())
+	}
+	return settings, nil
+}
+
+// CheckSettingsFile reads and validates config file
+func CheckSettingsFile(filename string) error {
+	settings, err := ReadSettingsFile(filename)
+	if err != nil {
+		return err
+	}
+	return ValidateSettings(settings)
+}
+
+// settingChange is one changed key of settings, nested keys are joined with dot
+type settingChange struct {
+	Key string
+	Old any
+	New any
+}
+
+func flattenSettings(prefix string, value any, flat map[string]any) {
+	// empty object has no keys, removal of its keys is reported by keys of other side
+	if object, ok := value.(map[string]any); ok {
+		for key, nested := range object {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			flattenSettings(key, nested, flat)
+		}
+		return
+	}
+	flat[prefix] = value
+}
+
+func settingsDiff(before *Settings, after *Settings) []settingChange {
+	toFlat := func(settings *Settings) map[string]any {
+		flat := make(map[string]any)
+		data, _ := json.Marshal(settings)
+		object := make(map[string]any)
+		_ = json.Unmarshal(data, &object)
+		flattenSettings("", object, flat)
+		return flat
+	}
+	oldFlat, newFlat := toFlat(before), toFlat(after)
+	keys := make([]string, 0)
+	for key := range oldFlat {
+		keys = append(keys, key)
+	}
+	for key := range newFlat {
+		if _, ok := oldFlat[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	changes := make([]settingChange, 0)
+	for _, key := range keys {
+		if reflect.DeepEqual(oldFlat[key], newFlat[key]) {
+			continue
+		}
+		change := settingChange{Key: key, Old: oldFlat[key], New: newFlat[key]}
+		for _, secret := range secretSettings {
+			if key == secret || strings.HasSuffix(key, "."+secret) {
+				change.Old, change.New = "***", "***"
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// applyGlobalSettings applies settings kept outside of Settings struct
+func applyGlobalSettings(settings *Settings) {
+	RunFlags = settings.PkgFlags[RunPkgManager]
+	*DEBUG = settings.DEBUG
+	log.OverrideLogger(*DEBUG, settings.LogDir)
+}
+
+// storeLastGoodConfig keeps copy of config file which was applied successfully
+func storeLastGoodConfig() {
+	data, err := os.ReadFile(ConfigPath)
+	if err != nil {
+		return
+	}
+	if current, readErr := os.ReadFile(lastGoodConfigPath()); readErr == nil && bytes.Equal(current, data) {
+		return
+	}
+	if err = os.WriteFile(lastGoodConfigPath(), data, 0600); err != nil {
+		log.Log.Warn().Err(err).Msg("Can't store last good config")
+	}
+}
+
+// reconfigure validates settings and restarts tasks, settings are applied in place while tasks are stopped,
+// so rest client and tasks see new values and no task reads them during copy
+func (service *AgentServiceWrap) reconfigure(settings *Settings, source string) error {
+	if err := ValidateSettings(settings); err != nil {
+		return err
+	}
+	service.reconfigureLock.Lock()
+	defer service.reconfigureLock.Unlock()
+	current := service.Settings
+	if service.pendingSettings != nil {
+		current = service.pendingSettings
+	}
+	changes := settingsDiff(current, settings)
+	storeLastGoodConfig()
+	if len(changes) == 0 {
+		log.Log.Debug().Str("Source", source).Msg("Config is not changed")
+		return nil
+	}
+	for _, change := range changes {
+		log.Log.Info().Str("Source", source).Str("Key", change.Key).
+			Interface("Old", change.Old).Interface("New", change.New).Msg("Config changed")
+	}
+	scheduled := service.pendingSettings != nil
+	service.pendingSettings = settings
+	log.Log.Info().Str("Source", source).Int("Changes", len(changes)).Msg("Service is reconfigured")
+	service.events.publish(structs.EventReload, map[string]any{"source": source, "changes": len(changes)})
+	// restart waits for running tasks, so caller does not wait for it,
+	// restart already scheduled and not started yet applies latest settings
+	if !scheduled {
+		go service.restartTasks()
+	}
+	return nil
+}
+
+// taskSettings lists top level settings tasks are built from or read while they run,
+// change of setting not listed here (secret, net_info, dirs, log, pkg_flags) restarts every task
+var taskSettings = map[string][]string{
+	"HttpServer": {"http_port", "http_bind", "http_allow", "http_tls", "http_clients",
+		"proxy_cache_dir", "proxy_cache_size", "proxy_rate_limit", "proxy_rate_burst"},
+	"RpcServer":    {"rpc_socket"},
+	"RpcTcpServer": {"rpc_port", "rpc_tcp_enabled"},
+	"CommandsSocket": {"remote_commands_enabled", "commands_socket_enabled",
+		"remote_shell_enabled", "shell_path", "shell_idle_timeout", "shell_max_session"},
+	"CommandsWorker": {"remote_commands_enabled", "commands_policy_path",
+		"remote_shell_enabled", "shell_path", "shell_idle_timeout", "shell_max_session"},
+	"AutoResultPost":    {"remote_commands_enabled"},
+	"AutoFetchCommands": {"remote_commands_enabled", "commands_timeout"},
+	"Heartbeat":         {"heartbeat_timeout"},
+	"HealthCheck":       {"health_check_timeout", "command_probes_enabled"},
+	"AutoMaintenance":   {"commands_timeout"},
+}
+
+// staleTasks returns names of tasks which depend on changed settings, all is true when every task is stale
+func staleTasks(changes []settingChange) (stale map[string]bool, all bool) {
+	stale = make(map[string]bool)
+	for _, change := range changes {
+		key, _, _ := strings.Cut(change.Key, ".")
+		known := false
+		for task, keys := range taskSettings {
+			for _, taskKey := range keys {
+				if taskKey == key {
+					stale[task] = true
+					known = true
+				}
+			}
+		}
+		if !known {
+			return nil, true
+		}
+	}
+	return stale, false
+}
+
+// applyChangedSettings copies top level settings of changes from settings to current
+func applyChangedSettings(current *Settings, settings *Settings, changes []settingChange) {
+	target, source := reflect.ValueOf(current).Elem(), reflect.ValueOf(settings).Elem()
+	for _, change := range changes {
+		key, _, _ := strings.Cut(change.Key, ".")
+		field, ok := structFieldByJson(target, key)
+		if !ok {
+			continue
+		}
+		value, _ := structFieldByJson(source, key)
+		field.Set(value)
+	}
+}
+
+func (service *AgentServiceWrap) applySettings(settings *Settings) {
+	*service.Settings = *settings
+	applyGlobalSettings(service.Settings)
+	service.ApiClient.Reconfigure()
+	service.FilesReload()
+}
+
+// reloadConfigFile applies config file, invalid file is logged and last good config stays in effect
+func (service *AgentServiceWrap) reloadConfigFile(source string) error {
+	settings, err := EffectiveSettings()
+	if err == nil {
+		err = service.reconfigure(settings, source)
+	}
+	if err != nil {
+		log.Log.Error().Err(err).Str("Source", source).
+			Msgf("Config %s rejected, last good config is kept", ConfigPath)
+	}
+	return err
+}
+
+// useLastGoodConfig replaces invalid settings service was started with by last good config
+func (service *AgentServiceWrap) useLastGoodConfig() {
+	err := CheckSettingsFile(ConfigPath)
+	if err == nil {
+		storeLastGoodConfig()
+		return
+	}
+	log.Log.Error().Err(err).Msgf("Config %s is invalid", ConfigPath)
+	settings, readErr := ReadSettingsFile(lastGoodConfigPath())
+	if readErr == nil {
+		readErr = ApplyEnvOverrides(settings)
+	}
+	if readErr != nil || ValidateSettings(settings) != nil {
+		log.Log.Warn().Msg("No valid last good config, service runs with invalid config")
+		return
+	}
+	service.applySettings(settings)
+	log.Log.Warn().Msgf("Service runs with last good config %s", lastGoodConfigPath())
+}
+
+func (service *AgentServiceWrap) watchConfig(ctx context.Context) error {
+	log.Log.Info().Msgf("Watch config %s", ConfigPath)
+	return helpers.WatchFile(ctx, ConfigPath, configReloadDebounce, func() {
+		_ = service.reloadConfigFile("file")
+	})
+}
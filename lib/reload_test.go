@@ -0,0 +1,56 @@
+package lib
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestStaleTasks(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    []string
+		want    []string
+		wantAll bool
+	}{
+		{"listener", []string{"http_port"}, []string{"HttpServer"}, false},
+		{"nested key", []string{"http_allow.api"}, []string{"HttpServer"}, false},
+		{"shared setting", []string{"commands_timeout"}, []string{"AutoFetchCommands", "AutoMaintenance"}, false},
+		{"several settings", []string{"heartbeat_timeout", "rpc_socket"}, []string{"Heartbeat", "RpcServer"}, false},
+		{"global setting", []string{"heartbeat_timeout", "net_info.control_ip"}, nil, true},
+		{"secret", []string{"secret"}, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes := make([]settingChange, 0)
+			for _, key := range test.keys {
+				changes = append(changes, settingChange{Key: key})
+			}
+			stale, all := staleTasks(changes)
+			if all != test.wantAll {
+				t.Fatalf("staleTasks() all = %v, want %v", all, test.wantAll)
+			}
+			if all {
+				return
+			}
+			got := make([]string, 0)
+			for task := range stale {
+				got = append(got, task)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("staleTasks() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestApplyChangedSettings(t *testing.T) {
+	current := &Settings{HttpPort: ":80", HeartbeatTimeout: 60, HttpAllow: map[string][]string{"api": {"127.0.0.1/32"}}}
+	settings := &Settings{HttpPort: ":8080", HeartbeatTimeout: 30, HttpAllow: map[string][]string{"api": {"10.0.0.0/8"}}}
+	applyChangedSettings(current, settings, []settingChange{{Key: "http_port"}, {Key: "http_allow.api"}})
+	want := &Settings{HttpPort: ":8080", HeartbeatTimeout: 60, HttpAllow: map[string][]string{"api": {"10.0.0.0/8"}}}
+	if !reflect.DeepEqual(current, want) {
+		t.Fatalf("settings = %+v, want %+v", current, want)
+	}
+}
@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/go-resty/resty/v2"
@@ -10,6 +11,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var DisplayTraceDebug = false
@@ -26,9 +28,29 @@ func NewRestClient(settings *Settings) *RestClient {
 	client.client.SetAuthToken(settings.SECRET)
 	client.client.SetBaseURL(settings.NetInfo.Protocol + "://" + host)
 	client.client.SetOutputDirectory(settings.TmpDir)
+	client.applyTls()
 	return client
 }
 
+// applyTls verifies control server by ca_file or pinned cert_sha256 of net_info
+func (rest *RestClient) applyTls() {
+	config, err := UpstreamTlsConfig(rest.settings.NetInfo)
+	if err != nil {
+		log.Log.Error().Err(err).Msg("Invalid tls settings of control server, system roots are used")
+		config = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	rest.client.SetTLSClientConfig(config)
+}
+
+// Reconfigure applies changed settings to http client
+func (rest *RestClient) Reconfigure() {
+	rest.Host = rest.settings.NetInfo.ControlIp + rest.settings.NetInfo.ControlPort
+	rest.client.SetAuthToken(rest.settings.SECRET)
+	rest.client.SetBaseURL(rest.settings.NetInfo.Protocol + "://" + rest.Host)
+	rest.client.SetOutputDirectory(rest.settings.TmpDir)
+	rest.applyTls()
+}
+
 // Helpers
 
 func (rest *RestClient) handleResponseInfo(response *resty.Response, err error) bool {
@@ -51,22 +73,22 @@ func (rest *RestClient) handleResponseInfo(response *resty.Response, err error)
 		return true
 	}
 	if DisplayTraceDebug {
-		log.Log.Debug().Msgf("  Body       :\n", response)
-		log.Log.Debug().Msgf("  Time       :", response.Time())
-		log.Log.Debug().Msgf("  Proto      :", response.Proto())
-		log.Log.Debug().Msgf("  Received At:", response.ReceivedAt())
+		log.Log.Debug().Msgf("  Body       : %v", response)
+		log.Log.Debug().Msgf("  Time       : %v", response.Time())
+		log.Log.Debug().Msgf("  Proto      : %v", response.Proto())
+		log.Log.Debug().Msgf("  Received At: %v", response.ReceivedAt())
 		ti := response.Request.TraceInfo()
-		log.Log.Debug().Msgf("  DNSLookup     :", ti.DNSLookup)
-		log.Log.Debug().Msgf("  ConnTime      :", ti.ConnTime)
-		log.Log.Debug().Msgf("  TCPConnTime   :", ti.TCPConnTime)
-		log.Log.Debug().Msgf("  TLSHandshake  :", ti.TLSHandshake)
-		log.Log.Debug().Msgf("  ServerTime    :", ti.ServerTime)
-		log.Log.Debug().Msgf("  ResponseTime  :", ti.ResponseTime)
-		log.Log.Debug().Msgf("  TotalTime     :", ti.TotalTime)
-		log.Log.Debug().Msgf("  IsConnReused  :", ti.IsConnReused)
-		log.Log.Debug().Msgf("  IsConnWasIdle :", ti.IsConnWasIdle)
-		log.Log.Debug().Msgf("  ConnIdleTime  :", ti.ConnIdleTime)
-		log.Log.Debug().Msgf("  RequestAttempt:", ti.RequestAttempt)
+		log.Log.Debug().Msgf("  DNSLookup     : %v", ti.DNSLookup)
+		log.Log.Debug().Msgf("  ConnTime      : %v", ti.ConnTime)
+		log.Log.Debug().Msgf("  TCPConnTime   : %v", ti.TCPConnTime)
+		log.Log.Debug().Msgf("  TLSHandshake  : %v", ti.TLSHandshake)
+		log.Log.Debug().Msgf("  ServerTime    : %v", ti.ServerTime)
+		log.Log.Debug().Msgf("  ResponseTime  : %v", ti.ResponseTime)
+		log.Log.Debug().Msgf("  TotalTime     : %v", ti.TotalTime)
+		log.Log.Debug().Msgf("  IsConnReused  : %v", ti.IsConnReused)
+		log.Log.Debug().Msgf("  IsConnWasIdle : %v", ti.IsConnWasIdle)
+		log.Log.Debug().Msgf("  ConnIdleTime  : %v", ti.ConnIdleTime)
+		log.Log.Debug().Msgf("  RequestAttempt: %v", ti.RequestAttempt)
 	}
 	return false
 
@@ -113,9 +135,11 @@ func (rest *RestClient) DownloadSelfUpdate() *structs.Software {
 
 // ApiCalls
 
-func (rest *RestClient) PingServer() bool {
+func (rest *RestClient) PingServer(heartbeat *structs.RestHeartbeatPost) bool {
 	resp, err := rest.client.R().
 		SetError(&structs.ApiInconsistencyContext{}).
+		SetAuthToken(rest.settings.SECRET).
+		SetBody(heartbeat).
 		Post(rest.prxRoute("/api/v1/agent/ping"))
 	return !rest.handleResponseInfo(resp, err)
 }
@@ -128,6 +152,40 @@ func (rest *RestClient) Reg(dto *structs.RestRegPost) bool {
 	return !rest.handleResponseInfo(resp, err)
 }
 
+// ProxyTrace shows path to control server, through chain of relays when AsProxy is set
+func (rest *RestClient) ProxyTrace() (*structs.ProxyTrace, error) {
+	origin := &structs.ProxyHop{Agent: AgentId(rest.settings), At: time.Now()}
+	if !rest.settings.NetInfo.AsProxy {
+		trace := &structs.ProxyTrace{Hops: []*structs.ProxyHop{origin}, Control: rest.client.HostURL}
+		resp, err := rest.client.R().Get(traceControlPath)
+		origin.UpstreamMs = milliseconds(time.Since(origin.At))
+		if err != nil {
+			trace.ControlError = err.Error()
+		} else {
+			trace.ControlStatus = resp.StatusCode()
+		}
+		return trace, nil
+	}
+	resp, err := rest.client.R().
+		SetHeader(HopsHeader, formatHop(origin)).
+		SetResult(&structs.ProxyTrace{}).
+		Get(rest.prxRoute(tracePath))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return nil, fmt.Errorf("relay responded %s: %s", resp.Status(), resp.String())
+	}
+	trace := resp.Result().(*structs.ProxyTrace)
+	for _, hop := range trace.Hops {
+		if hop.Agent == origin.Agent {
+			hop.UpstreamMs = milliseconds(time.Since(origin.At))
+			break
+		}
+	}
+	return trace, nil
+}
+
 func (rest *RestClient) GetAllClients() []*structs.Client {
 	req := rest.client.R().
 		SetError(&structs.ApiInconsistencyContext{}).
@@ -192,6 +250,21 @@ func (rest *RestClient) GetSoftwareLatestPatch(softwareId int) *structs.Software
 	return resp.Result().(*structs.Software)
 }
 
+func (rest *RestClient) GetPackagePolicy(packageId int) *structs.UpdatePolicy {
+	req := rest.client.R().
+		SetError(&structs.ApiInconsistencyContext{}).
+		SetResult(&structs.UpdatePolicy{})
+	resp, err := req.Get(rest.prxRoute(fmt.Sprintf("/api/v1/agent/package/%d/policy", packageId)))
+	fail := rest.handleResponseInfo(resp, err)
+	if fail {
+		return nil
+	}
+	if resp.String() == "null" {
+		return nil
+	}
+	return resp.Result().(*structs.UpdatePolicy)
+}
+
 func (rest *RestClient) unpackHeaders(head http.Header, to *structs.HttpFileInfo) *structs.HttpFileInfo {
 	to.Range = structs.FileRangeFromHeader(head.Get("Content-Range"))
 	to.Digest = structs.FileDigestFromHeader(head.Get("Digest"))
@@ -260,6 +333,24 @@ func (rest *RestClient) GetCommand() *structs.RestCommandGet {
 	return resp.Result().(*structs.RestCommandGet)
 }
 
+func (rest *RestClient) PostCommandResult(result *structs.RestCommandResultPost) bool {
+	resp, err := rest.client.R().
+		SetError(&structs.ApiInconsistencyContext{}).
+		SetAuthToken(rest.settings.SECRET).
+		SetBody(result).
+		Post(rest.prxRoute(fmt.Sprintf("/api/v1/agent/cmd/%d/result", result.CmdTriggerId)))
+	return !rest.handleResponseInfo(resp, err)
+}
+
+func (rest *RestClient) PostHealth(health *structs.RestHealthPost) bool {
+	resp, err := rest.client.R().
+		SetError(&structs.ApiInconsistencyContext{}).
+		SetAuthToken(rest.settings.SECRET).
+		SetBody(health).
+		Post(rest.prxRoute("/api/v1/agent/health"))
+	return !rest.handleResponseInfo(resp, err)
+}
+
 // Future
 
 func (rest *RestClient) PostLogData(logData []*structs.RestLogPost) bool {
@@ -271,17 +362,31 @@ func (rest *RestClient) PostLogData(logData []*structs.RestLogPost) bool {
 	return !rest.handleResponseInfo(resp, err)
 }
 
-func (rest *RestClient) OpenWebsocket() (*websocket.Conn, error) {
+func (rest *RestClient) openWebsocket(route string) (*websocket.Conn, error) {
 	wsProtocol := rest.settings.NetInfo.Protocol
 	wsProtocol = strings.Replace(wsProtocol, "http", "ws", 1)
 	conf, err := websocket.NewConfig(
-		wsProtocol+"://"+rest.Host+rest.prxRoute("/api/v1/agent/shell/open"),
-		rest.settings.NetInfo.Protocol+"://"+rest.Host+rest.prxRoute("/api/v1/agent/shell/open"))
-	log.Log.Debug().Msgf("%s", conf)
+		wsProtocol+"://"+rest.Host+rest.prxRoute(route),
+		rest.settings.NetInfo.Protocol+"://"+rest.Host+rest.prxRoute(route))
+	if err != nil {
+		return nil, err
+	}
+	log.Log.Debug().Msgf("%s", conf.Location)
 	conf.Header.Set("Authorization", "Bearer "+rest.settings.SECRET)
+	if conf.TlsConfig, err = UpstreamTlsConfig(rest.settings.NetInfo); err != nil {
+		return nil, err
+	}
 	client, err := websocket.DialConfig(conf)
 	if err != nil {
 		return nil, err
 	}
 	return client, err
 }
+
+func (rest *RestClient) OpenWebsocket(sessionId int) (*websocket.Conn, error) {
+	return rest.openWebsocket(fmt.Sprintf("/api/v1/agent/shell/open?session=%d", sessionId))
+}
+
+func (rest *RestClient) OpenCommandsWebsocket() (*websocket.Conn, error) {
+	return rest.openWebsocket("/api/v1/agent/cmd/ws")
+}
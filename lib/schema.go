@@ -0,0 +1,354 @@
+package lib
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Settings schema: keys are json names joined with dot (net_info.protocol, http_allow.api),
+// every rule checks value of one key, keys without rule accept any value of field type
+
+var ErrUnknownSetting = errors.New("unknown setting")
+
+type settingRule struct {
+	Key   string
+	Check func(value any) error
+}
+
+var settingsSchema = []*settingRule{
+	{"http_port", checkListenAddress},
+	{"http_bind", checkOptionalIp},
+	{"http_allow", checkHttpAllow},
+	{"http_tls", checkHttpTls},
+	{"http_clients", checkHttpClients},
+	{"rpc_port", checkListenAddress},
+	{"rpc_socket", checkAbsolutePath},
+	{"lock_file", checkAbsolutePath},
+	{"info_dir", checkAbsolutePath},
+	{"system_dir", checkAbsolutePath},
+	{"app_folder", checkAbsolutePath},
+	{"tmp_dir", checkAbsolutePath},
+	{"log_dir", checkAbsolutePath},
+	{"net_info", checkRequired},
+	{"net_info.protocol", checkOneOf("http", "https")},
+	{"net_info.control_ip", checkHost},
+	{"net_info.control_port", checkOptionalPort},
+	{"net_info.ca_file", checkOptionalPath},
+	{"net_info.cert_sha256", checkFingerprint},
+	{"proxy_cache_dir", checkAbsolutePath},
+	{"proxy_cache_size", checkNonNegative},
+	{"proxy_rate_limit", checkNonNegative},
+	{"proxy_rate_burst", checkPositive},
+	{"commands_policy_path", checkAbsolutePath},
+	{"commands_timeout", checkPositive},
+	{"health_check_timeout", checkNonNegative},
+	{"heartbeat_timeout", checkNonNegative},
+	{"shell_path", checkAbsolutePath},
+	{"shell_idle_timeout", checkPositive},
+	{"shell_max_session", checkPositive},
+}
+
+func checkRequired(value any) error {
+	if value == nil || reflect.ValueOf(value).IsZero() {
+		return errors.New("is required")
+	}
+	return nil
+}
+
+func checkAbsolutePath(value any) error {
+	path, _ := value.(string)
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%q is not absolute path", path)
+	}
+	return nil
+}
+
+func checkOptionalPath(value any) error {
+	if path, _ := value.(string); path == "" {
+		return nil
+	}
+	return checkAbsolutePath(value)
+}
+
+func checkFingerprint(value any) error {
+	fingerprint, _ := value.(string)
+	if fingerprint == "" {
+		return nil
+	}
+	sum, err := hex.DecodeString(normalizeFingerprint(fingerprint))
+	if err != nil || len(sum) != 32 {
+		return errors.New("must be sha256 hex of certificate")
+	}
+	return nil
+}
+
+func checkPort(port string) error {
+	number, err := strconv.Atoi(port)
+	if err != nil || number < 1 || number > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// checkListenAddress accepts [host]:port
+func checkListenAddress(value any) error {
+	address, _ := value.(string)
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host != "" && net.ParseIP(host) == nil && checkHost(host) != nil {
+		return fmt.Errorf("invalid host %q", host)
+	}
+	return checkPort(port)
+}
+
+// checkOptionalPort accepts empty value or :port appended to control host
+func checkOptionalPort(value any) error {
+	port, _ := value.(string)
+	if port == "" {
+		return nil
+	}
+	if !strings.HasPrefix(port, ":") {
+		return fmt.Errorf("%q must start with colon", port)
+	}
+	return checkPort(port[1:])
+}
+
+func checkOptionalIp(value any) error {
+	ip, _ := value.(string)
+	if ip != "" && net.ParseIP(ip) == nil {
+		return fmt.Errorf("%q is not ip address", ip)
+	}
+	return nil
+}
+
+// checkHost accepts host name or ip without scheme and path
+func checkHost(value any) error {
+	host, _ := value.(string)
+	if host == "" {
+		return errors.New("is required")
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return fmt.Errorf("invalid host %q", host)
+		}
+		for _, c := range label {
+			if !(c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+				return fmt.Errorf("invalid host %q", host)
+			}
+		}
+	}
+	return nil
+}
+
+func checkOneOf(allowed ...string) func(value any) error {
+	return func(value any) error {
+		text, _ := value.(string)
+		for _, option := range allowed {
+			if text == option {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q must be one of %s", text, strings.Join(allowed, ", "))
+	}
+}
+
+func checkPositive(value any) error {
+	if number, _ := value.(int); number <= 0 {
+		return errors.New("must be positive")
+	}
+	return nil
+}
+
+func checkNonNegative(value any) error {
+	if number, _ := value.(int); number < 0 {
+		return errors.New("must not be negative (0 disables)")
+	}
+	return nil
+}
+
+func checkHttpAllow(value any) error {
+	allow, _ := value.(map[string][]string)
+	groups := []string{RouteGroupProxy, RouteGroupLog, RouteGroupApp, RouteGroupApi, RouteGroupMetrics}
+	for group, cidrs := range allow {
+		if err := checkOneOf(groups...)(group); err != nil {
+			return fmt.Errorf("route group %w", err)
+		}
+		for _, cidr := range cidrs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+				return fmt.Errorf("%s: invalid address %q", group, cidr)
+			}
+		}
+	}
+	return nil
+}
+
+func checkHttpTls(value any) error {
+	tlsSettings, _ := value.(*HttpTlsSettings)
+	if tlsSettings == nil || tlsSettings.CertFile == "" && tlsSettings.KeyFile == "" {
+		return nil
+	}
+	if tlsSettings.SelfSigned {
+		return errors.New("self_signed excludes cert_file and key_file")
+	}
+	if tlsSettings.CertFile == "" || tlsSettings.KeyFile == "" {
+		return errors.New("cert_file and key_file must be set together")
+	}
+	for _, path := range []string{tlsSettings.CertFile, tlsSettings.KeyFile, tlsSettings.ClientCAFile} {
+		if path != "" && !filepath.IsAbs(path) {
+			return fmt.Errorf("%q is not absolute path", path)
+		}
+	}
+	return nil
+}
+
+func checkHttpClients(value any) error {
+	clients, _ := value.(map[string]*HttpClientAuth)
+	for extKey, client := range clients {
+		if client == nil {
+			continue
+		}
+		if client.TokenSha256 != "" {
+			sum, err := hex.DecodeString(client.TokenSha256)
+			if err != nil || len(sum) != 32 {
+				return fmt.Errorf("%s: token_sha256 must be sha256 hex", extKey)
+			}
+		}
+	}
+	return nil
+}
+
+func ValidateSettings(settings *Settings) error {
+	problems := make([]string, 0)
+	for _, rule := range settingsSchema {
+		value, err := GetSetting(settings, rule.Key)
+		if err == nil {
+			err = rule.Check(value)
+		}
+		if err != nil {
+			problems = append(problems, rule.Key+": "+err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%w: %s", ErrInvalidSettings, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// settingValue finds field or map entry by dotted key, nil pointers on the way are allocated when create is set
+func settingValue(settings *Settings, key string, create bool) (reflect.Value, error) {
+	current := reflect.ValueOf(settings).Elem()
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		for current.Kind() == reflect.Pointer {
+			if current.IsNil() {
+				if !create {
+					return reflect.Value{}, nil
+				}
+				current.Set(reflect.New(current.Type().Elem()))
+			}
+			current = current.Elem()
+		}
+		switch current.Kind() {
+		case reflect.Struct:
+			field, ok := structFieldByJson(current, part)
+			if !ok {
+				return reflect.Value{}, fmt.Errorf("%w: %s", ErrUnknownSetting, strings.Join(parts[:i+1], "."))
+			}
+			current = field
+		case reflect.Map:
+			if i != len(parts)-1 && current.Type().Elem().Kind() != reflect.Pointer {
+				return reflect.Value{}, fmt.Errorf("%w: %s", ErrUnknownSetting, key)
+			}
+			if current.IsNil() {
+				if !create {
+					return reflect.Value{}, nil
+				}
+				current.Set(reflect.MakeMap(current.Type()))
+			}
+			mapKey := reflect.ValueOf(part)
+			entry := current.MapIndex(mapKey)
+			if !entry.IsValid() {
+				if !create {
+					return reflect.Value{}, nil
+				}
+				entry = reflect.New(current.Type().Elem()).Elem()
+				if entry.Kind() == reflect.Pointer {
+					entry.Set(reflect.New(entry.Type().Elem()))
+				}
+				current.SetMapIndex(mapKey, entry)
+			}
+			if i == len(parts)-1 {
+				// map entries are not addressable, they are returned as copy and set back by SetSetting
+				return current.MapIndex(mapKey), nil
+			}
+			current = entry
+		default:
+			return reflect.Value{}, fmt.Errorf("%w: %s", ErrUnknownSetting, key)
+		}
+	}
+	return current, nil
+}
+
+func structFieldByJson(value reflect.Value, name string) (reflect.Value, bool) {
+	valueType := value.Type()
+	for i := 0; i < valueType.NumField(); i++ {
+		tag := strings.Split(valueType.Field(i).Tag.Get("json"), ",")[0]
+		if tag == name {
+			return value.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// GetSetting returns value of dotted key, nil when some parent is not set
+func GetSetting(settings *Settings, key string) (any, error) {
+	value, err := settingValue(settings, key, false)
+	if err != nil || !value.IsValid() {
+		return nil, err
+	}
+	return value.Interface(), nil
+}
+
+// SetSetting parses text as json value of key type, plain text is accepted for string keys
+func SetSetting(settings *Settings, key string, text string) error {
+	parts := strings.Split(key, ".")
+	value, err := settingValue(settings, key, true)
+	if err != nil {
+		return err
+	}
+	parsed := reflect.New(value.Type())
+	if err = json.Unmarshal([]byte(text), parsed.Interface()); err != nil {
+		if value.Kind() != reflect.String {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		parsed.Elem().SetString(text)
+	}
+	if value.CanSet() {
+		value.Set(parsed.Elem())
+		return nil
+	}
+	// last part is map key
+	parent, err := settingValue(settings, strings.Join(parts[:len(parts)-1], "."), true)
+	if err != nil {
+		return err
+	}
+	for parent.Kind() == reflect.Pointer {
+		parent = parent.Elem()
+	}
+	parent.SetMapIndex(reflect.ValueOf(parts[len(parts)-1]), parsed.Elem())
+	return nil
+}
@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSetSetting(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		text    string
+		want    any
+		wantErr bool
+		unknown bool
+	}{
+		{"bool", "debug", "true", true, false, false},
+		{"plain string", "http_port", "8080", "8080", false, false},
+		{"json string", "secret", `"quoted"`, "quoted", false, false},
+		{"int", "commands_timeout", "30", 30, false, false},
+		{"nil struct pointer is allocated", "net_info.control_ip", "10.0.0.1", "10.0.0.1", false, false},
+		{"struct", "http_tls", `{"self_signed":true}`, &HttpTlsSettings{SelfSigned: true}, false, false},
+		{"map entry", "pkg_flags.apt", "-y", "-y", false, false},
+		{"map slice entry", "http_allow.admin", `["10.0.0.0/8"]`, []string{"10.0.0.0/8"}, false, false},
+		{"map pointer entry field", "http_clients.ci.token_sha256", "abc", "abc", false, false},
+		{"invalid int", "commands_timeout", "soon", nil, true, false},
+		{"invalid bool", "debug", "maybe", nil, true, false},
+		{"unknown key", "missing", "1", nil, true, true},
+		{"unknown nested key", "net_info.missing", "1", nil, true, true},
+		{"key below scalar", "debug.value", "1", nil, true, true},
+		{"key below map value", "pkg_flags.apt.extra", "1", nil, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := &Settings{}
+			err := SetSetting(settings, test.key, test.text)
+			if test.wantErr {
+				if err == nil || errors.Is(err, ErrUnknownSetting) != test.unknown {
+					t.Fatalf("SetSetting(%s, %s) = %v, unknown setting error %v expected", test.key, test.text, err, test.unknown)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SetSetting(%s, %s) = %v", test.key, test.text, err)
+			}
+			got, err := GetSetting(settings, test.key)
+			if err != nil {
+				t.Fatalf("GetSetting(%s) = %v", test.key, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("GetSetting(%s) = %#v, want %#v", test.key, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSetSettingKeepsSiblings(t *testing.T) {
+	settings := &Settings{
+		NetInfo:     &NetSettings{Protocol: "https", ControlIp: "old"},
+		HttpClients: map[string]*HttpClientAuth{"ci": {TokenSha256: "abc"}},
+	}
+	if err := SetSetting(settings, "net_info.control_ip", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetSetting(settings, "http_clients.ci.cert_cn", "runner"); err != nil {
+		t.Fatal(err)
+	}
+	if want := (NetSettings{Protocol: "https", ControlIp: "new"}); *settings.NetInfo != want {
+		t.Fatalf("net_info = %+v, want %+v", *settings.NetInfo, want)
+	}
+	if want := (HttpClientAuth{TokenSha256: "abc", CertCN: "runner"}); *settings.HttpClients["ci"] != want {
+		t.Fatalf("http_clients.ci = %+v, want %+v", *settings.HttpClients["ci"], want)
+	}
+}
+
+func TestGetSetting(t *testing.T) {
+	settings := &Settings{
+		HttpPort:  "8080",
+		PkgFlags:  map[string]string{"apt": "-y"},
+		HttpAllow: map[string][]string{},
+	}
+	tests := []struct {
+		name    string
+		key     string
+		want    any
+		wantErr bool
+	}{
+		{"field", "http_port", "8080", false},
+		{"zero field", "commands_timeout", 0, false},
+		{"map", "pkg_flags", map[string]string{"apt": "-y"}, false},
+		{"map entry", "pkg_flags.apt", "-y", false},
+		{"missing map entry", "pkg_flags.yum", nil, false},
+		{"nil parent", "net_info.control_ip", nil, false},
+		{"nil map parent", "http_clients.ci.token_sha256", nil, false},
+		{"unknown key", "missing", nil, true},
+		{"unknown key below nil parent", "http_tls.missing", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := GetSetting(settings, test.key)
+			if test.wantErr {
+				if !errors.Is(err, ErrUnknownSetting) {
+					t.Fatalf("GetSetting(%s) = %v, want %v", test.key, err, ErrUnknownSetting)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetSetting(%s) = %v", test.key, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("GetSetting(%s) = %#v, want %#v", test.key, got, test.want)
+			}
+		})
+	}
+	if settings.NetInfo != nil || settings.HttpClients != nil || len(settings.HttpAllow) != 0 {
+		t.Fatal("GetSetting allocated missing parents")
+	}
+}
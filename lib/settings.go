@@ -11,16 +11,23 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strings"
 )
 
 const PcaVersion = "1.2.3" // do not change! Changes automatically in CI
 const ServiceDescription = "abt-tech packages agent"
 const ServiceName = "pca"
 const CommandsTimeout = 60
+const HealthCheckTimeout = 60
+const HeartbeatTimeout = 30
+const ShellIdleTimeout = 15 * 60
+const TasksShutdownTimeout = 30
+const ShellMaxSession = 4 * 60 * 60
 
 var (
 	DEBUG                = helpers.FalsePtr()
 	ServiceDependencies  = []string{}
+	HomePath             = "/opt/abt/pca"
 	ConfigPath           = ""
 	RrcDns               = ":38845"
 	HttpDns              = ":38844"
@@ -56,52 +63,74 @@ func FindPackageSystem() {
 
 }
 
-func ConfigurePaths() {
-	homePath := "/opt/abt/pca"
-	ConfigPath = filepath.Join(homePath, "config.json")
-	systemPath := filepath.Join(homePath, "system")
-	logsPath := filepath.Join(systemPath, "logs")
-	AppFolder := filepath.Join(systemPath, "apps")
-	rootPath := path.Dir(ConfigPath)
-	installPath := path.Join(rootPath, "install.d")
-	tmpPath := path.Join(systemPath, "tmp")
-
-	helpers.FileExists(rootPath)
-	for _, _path := range []string{rootPath,
-		installPath,
-		AppFolder,
-		tmpPath,
-		logsPath} {
-		if !helpers.FileExists(_path) {
-			HandleRoot()
+// ConfigurePaths resolves agent home and config file: --home/--config flags, then PCA_HOME/PCA_CONFIG,
+// then default home. Flags are read from args before command line is parsed, because settings are loaded first
+func ConfigurePaths(args []string) {
+	if home := os.Getenv(EnvHome); home != "" {
+		HomePath = home
+	}
+	ConfigPath = os.Getenv(EnvConfig)
+	if home := globalFlag(args, "home"); home != "" {
+		HomePath = home
+	}
+	if config := globalFlag(args, "config"); config != "" {
+		ConfigPath = config
+	}
+	if ConfigPath == "" {
+		ConfigPath = filepath.Join(HomePath, "config.json")
+	}
+	HomePath, _ = filepath.Abs(HomePath)
+	ConfigPath, _ = filepath.Abs(ConfigPath)
+	ensureDirs(HomePath, path.Dir(ConfigPath))
+}
+
+// globalFlag finds value of --name value or --name=value
+func globalFlag(args []string, name string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
 		}
-		err := os.MkdirAll(_path, os.ModeDir|os.ModePerm)
-		if err != nil {
-			log.Log.Fatal().Err(err).Msg("Can't create pca dirs, try admin permissions")
+		if arg == "--"+name && i+1 < len(args) {
+			return args[i+1]
+		}
+		if value := strings.TrimPrefix(arg, "--"+name+"="); value != arg {
+			return value
 		}
 	}
+	return ""
+}
 
-	logFile := path.Join(logsPath, "pca.log")
-	if !helpers.FileExists(logFile) {
-		err := os.WriteFile(logFile, make([]byte, 0), 0666)
+func ensureDirs(dirs ...string) {
+	for _, dir := range dirs {
+		if !helpers.FileExists(dir) {
+			HandleRoot()
+		}
+		err := os.MkdirAll(dir, os.ModeDir|os.ModePerm)
 		if err != nil {
-			log.Log.Fatal().Err(err).Msg("Can't create log file, try admin permissions")
+			log.Log.Fatal().Err(err).Msg("Can't create pca dirs, try admin permissions")
 		}
 	}
 }
 
 func DefaultSettings() *Settings {
 	return &Settings{
-		DEBUG:     false,
-		SECRET:    uuid.NewString(),
-		HttpPort:  HttpDns,
-		RpcPort:   RrcDns,
-		InfoDir:   path.Join(path.Dir(ConfigPath), "install.d"),
-		SystemDir: path.Join(path.Dir(ConfigPath), "system"),
-		TmpDir:    path.Join(path.Dir(ConfigPath), "system", "tmp"),
-		AppFolder: path.Join(path.Dir(ConfigPath), "system", "apps"),
-		LogDir:    path.Join(path.Dir(ConfigPath), "system", "logs"),
-		PkgFlags:  DefaultPkgFlags,
+		DEBUG:          false,
+		SECRET:         uuid.NewString(),
+		HttpPort:       HttpDns,
+		HttpBind:       "",
+		RpcPort:        RrcDns,
+		RpcSocket:      path.Join(HomePath, "pca.sock"),
+		LockFile:       path.Join(HomePath, "pca.lock"),
+		InfoDir:        path.Join(HomePath, "install.d"),
+		SystemDir:      path.Join(HomePath, "system"),
+		TmpDir:         path.Join(HomePath, "system", "tmp"),
+		AppFolder:      path.Join(HomePath, "system", "apps"),
+		LogDir:         path.Join(HomePath, "system", "logs"),
+		ProxyCacheDir:  path.Join(HomePath, "system", "cache"),
+		ProxyCacheSize: ProxyCacheSize,
+		ProxyRateLimit: ProxyRateLimit,
+		ProxyRateBurst: ProxyRateBurst,
+		PkgFlags:       DefaultPkgFlags,
 		NetInfo: &NetSettings{
 			Protocol:    "https",
 			ControlIp:   "release.a-7.tech",
@@ -109,7 +138,18 @@ func DefaultSettings() *Settings {
 			AsProxy:     false,
 		},
 		RemoteCommandsEnabled: true,
+		CommandsSocketEnabled: true,
+		CommandsPolicyPath:    path.Join(HomePath, "policy.json"),
 		CommandsTimeout:       CommandsTimeout,
+		HealthCheckTimeout:    HealthCheckTimeout,
+		CommandProbesEnabled:  false,
+		HeartbeatTimeout:      HeartbeatTimeout,
+		RemoteShellEnabled:    false,
+		ShellPath:             "/bin/bash",
+		ShellIdleTimeout:      ShellIdleTimeout,
+		ShellMaxSession:       ShellMaxSession,
+		HttpAllow:             map[string][]string{},
+		HttpClients:           map[string]*HttpClientAuth{},
 	}
 }
 
@@ -118,22 +158,60 @@ type NetSettings struct {
 	ControlIp   string `json:"control_ip"`
 	ControlPort string `json:"control_port"`
 	AsProxy     bool   `json:"as_proxy"`
+	CaFile      string `json:"ca_file"`
+	CertSha256  string `json:"cert_sha256"`
+}
+
+// HttpTlsSettings enables https on local http server, ClientCAFile enables mTLS for applications,
+// SelfSigned generates certificate when CertFile is not given
+type HttpTlsSettings struct {
+	CertFile     string `json:"cert_file"`
+	KeyFile      string `json:"key_file"`
+	ClientCAFile string `json:"client_ca_file"`
+	SelfSigned   bool   `json:"self_signed"`
+}
+
+// HttpClientAuth is credentials of application with some ExternalKey: sha256 hex of bearer token
+// and/or common name of client certificate (ExternalKey itself when empty)
+type HttpClientAuth struct {
+	TokenSha256 string `json:"token_sha256"`
+	CertCN      string `json:"cert_cn"`
 }
 
 type Settings struct {
-	DEBUG                 bool              `json:"debug"`
-	SECRET                string            `json:"secret"`
-	HttpPort              string            `json:"http_port"`
-	RpcPort               string            `json:"rpc_port"`
-	InfoDir               string            `json:"info_dir"`
-	SystemDir             string            `json:"system_dir"`
-	AppFolder             string            `json:"app_folder"`
-	TmpDir                string            `json:"tmp_dir"`
-	LogDir                string            `json:"log_dir"`
-	PkgFlags              map[string]string `json:"pkg_flags"`
-	NetInfo               *NetSettings      `json:"net_info"`
-	RemoteCommandsEnabled bool              `json:"remote_commands_enabled"`
-	CommandsTimeout       int               `json:"commands_timeout"`
+	DEBUG                 bool                       `json:"debug"`
+	SECRET                string                     `json:"secret"`
+	HttpPort              string                     `json:"http_port"`
+	HttpBind              string                     `json:"http_bind"`
+	HttpAllow             map[string][]string        `json:"http_allow"`
+	HttpTls               *HttpTlsSettings           `json:"http_tls"`
+	HttpClients           map[string]*HttpClientAuth `json:"http_clients"`
+	RpcPort               string                     `json:"rpc_port"`
+	RpcSocket             string                     `json:"rpc_socket"`
+	RpcTcpEnabled         bool                       `json:"rpc_tcp_enabled"`
+	LockFile              string                     `json:"lock_file"`
+	InfoDir               string                     `json:"info_dir"`
+	SystemDir             string                     `json:"system_dir"`
+	AppFolder             string                     `json:"app_folder"`
+	TmpDir                string                     `json:"tmp_dir"`
+	LogDir                string                     `json:"log_dir"`
+	PkgFlags              map[string]string          `json:"pkg_flags"`
+	NetInfo               *NetSettings               `json:"net_info"`
+	ProxyCacheDir         string                     `json:"proxy_cache_dir"`
+	ProxyCacheSize        int                        `json:"proxy_cache_size"`
+	ProxyRateLimit        int                        `json:"proxy_rate_limit"`
+	ProxyRateBurst        int                        `json:"proxy_rate_burst"`
+	RemoteCommandsEnabled bool                       `json:"remote_commands_enabled"`
+	CommandsSocketEnabled bool                       `json:"commands_socket_enabled"`
+	CommandsPolicyPath    string                     `json:"commands_policy_path"`
+	CommandsTimeout       int                        `json:"commands_timeout"`
+	HealthCheckTimeout    int                        `json:"health_check_timeout"`
+	CommandProbesEnabled  bool                       `json:"command_probes_enabled"`
+	HeartbeatTimeout      int                        `json:"heartbeat_timeout"`
+	RemoteShellEnabled    bool                       `json:"remote_shell_enabled"`
+	ShellPath             string                     `json:"shell_path"`
+	ShellIdleTimeout      int                        `json:"shell_idle_timeout"`
+	ShellMaxSession       int                        `json:"shell_max_session"`
 }
 
 func LoadSettings() *Settings {
@@ -144,13 +222,30 @@ func LoadSettings() *Settings {
 		os.WriteFile(ConfigPath, make([]byte, 0), 0666)
 		SafeWriteJsonFile(settings, nil, ConfigPath, 0666)
 	}
+	envErr := ApplyEnvOverrides(settings)
+	ensureDirs(settings.SystemDir, settings.InfoDir, settings.AppFolder, settings.TmpDir, settings.LogDir)
 	softLogFile := filepath.Join(settings.LogDir, "soft.log.json")
 	if !helpers.FileExists(softLogFile) {
 		os.WriteFile(softLogFile, make([]byte, 0), 0666)
 		SafeWriteJsonFile(&LogBufferFile{Logs: make([]*structs.RestLogPost, 0)}, nil, softLogFile, 0666)
 	}
-	RunFlags = settings.PkgFlags[RunPkgManager]
-	*DEBUG = settings.DEBUG
-	log.OverrideLogger(*DEBUG, settings.LogDir)
+	if !helpers.FileExists(settings.CommandsPolicyPath) {
+		SafeWriteJsonFile(DefaultCommandsPolicy(), nil, settings.CommandsPolicyPath, 0644)
+	}
+	commandsFile := filepath.Join(settings.SystemDir, "commands.json")
+	if !helpers.FileExists(commandsFile) {
+		SafeWriteJsonFile(&CommandsHistoryFile{Records: make([]*CommandRecord, 0)}, nil, commandsFile, 0666)
+	}
+	applyGlobalSettings(settings)
+	if envErr != nil {
+		log.Log.Warn().Err(envErr).Msg("Environment overrides are not applied")
+	}
+	err := CheckSettingsFile(ConfigPath)
+	if err == nil {
+		err = ValidateSettings(settings)
+	}
+	if err != nil {
+		log.Log.Warn().Err(err).Msgf("Config %s is invalid, check it with pca config validate", ConfigPath)
+	}
 	return settings
 }
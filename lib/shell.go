@@ -0,0 +1,165 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"main/lib/helpers"
+	"main/lib/log"
+	"main/lib/structs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Remote shell
+
+type shellAuditRecord struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Data      string    `json:"data"`
+}
+
+// shellAudit writes transcript of remote shell session as json lines
+type shellAudit struct {
+	lock    sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func newShellAudit(dir string, sessionId int) (*shellAudit, error) {
+	err := os.MkdirAll(dir, os.ModeDir|0700)
+	if err != nil {
+		return nil, err
+	}
+	fileName := filepath.Join(dir, fmt.Sprintf("%d_%s.jsonl", sessionId, time.Now().Format("20060102T150405")))
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &shellAudit{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (audit *shellAudit) Write(direction string, data []byte) {
+	audit.lock.Lock()
+	defer audit.lock.Unlock()
+	err := audit.encoder.Encode(&shellAuditRecord{Time: time.Now(), Direction: direction, Data: string(data)})
+	if err != nil {
+		log.Log.Warn().Err(err).Msg("Failed to write shell audit")
+	}
+}
+
+func (audit *shellAudit) Close() {
+	_ = audit.file.Close()
+}
+
+// RemoteShellProcess spawns login shell in pty and relays it to control server websocket session
+func (a *Agent) RemoteShellProcess(session *structs.RestShellSessionGet) error {
+	if !a.Settings.RemoteShellEnabled {
+		return errors.New("remote shell is disabled in settings (remote_shell_enabled)")
+	}
+	audit, err := newShellAudit(filepath.Join(a.Settings.LogDir, "shell"), session.ID)
+	if err != nil {
+		return err
+	}
+	defer audit.Close()
+
+	ws, wsError := a.ApiClient.OpenWebsocket(session.ID)
+	if wsError != nil {
+		log.Log.Error().Err(wsError).Msg("Unable to start websocket session ")
+		return wsError
+	}
+	defer ws.Close()
+
+	cmd := exec.Command(a.Settings.ShellPath, "-l")
+	cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+	cmd.Dir = "/"
+	pty, err := helpers.StartInPty(cmd)
+	if err != nil {
+		return err
+	}
+	defer pty.Close()
+	if session.Rows != 0 && session.Cols != 0 {
+		_ = helpers.SetPtySize(pty, session.Rows, session.Cols)
+	}
+	log.Log.Info().Int("SessionId", session.ID).Msgf("Remote shell session started (pid %d)", cmd.Process.Pid)
+	audit.Write("start", []byte(fmt.Sprintf("session %d pid %d", session.ID, cmd.Process.Pid)))
+
+	maxSession := time.AfterFunc(time.Duration(a.Settings.ShellMaxSession)*time.Second, func() {
+		log.Log.Warn().Int("SessionId", session.ID).Msg("Remote shell session reached max length")
+		audit.Write("timeout", []byte("max session length reached"))
+		_ = helpers.KillSession(cmd.Process.Pid)
+	})
+	defer maxSession.Stop()
+
+	go a.remoteShellRead(ws, pty, cmd, session, audit)
+
+	buf := make([]byte, 4096)
+	for {
+		n, readErr := pty.Read(buf)
+		if n > 0 {
+			audit.Write("out", buf[:n])
+			sendErr := websocket.JSON.Send(ws, &structs.WsShellFrame{Type: "stdout", Data: buf[:n]})
+			if sendErr != nil {
+				_ = helpers.KillSession(cmd.Process.Pid)
+				break
+			}
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	waitErr := cmd.Wait()
+	exitCode := 0
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	_ = websocket.JSON.Send(ws, &structs.WsShellFrame{Type: "exit", Code: exitCode})
+	audit.Write("exit", []byte(fmt.Sprintf("code %d", exitCode)))
+	log.Log.Info().Int("SessionId", session.ID).Int("code", exitCode).Msg("Remote shell session finished")
+	if waitErr != nil && exitCode == -1 {
+		return waitErr
+	}
+	return nil
+}
+
+// remoteShellRead relays stdin and resize frames to pty until client disconnects or idles
+func (a *Agent) remoteShellRead(ws *websocket.Conn, pty *os.File, cmd *exec.Cmd,
+	session *structs.RestShellSessionGet, audit *shellAudit) {
+	defer func() { _ = helpers.KillSession(cmd.Process.Pid) }()
+	idle := time.Duration(a.Settings.ShellIdleTimeout) * time.Second
+	for {
+		err := ws.SetReadDeadline(time.Now().Add(idle))
+		if err != nil {
+			return
+		}
+		var frame structs.WsShellFrame
+		err = websocket.JSON.Receive(ws, &frame)
+		if err != nil {
+			var netErr interface{ Timeout() bool }
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				log.Log.Warn().Int("SessionId", session.ID).Msg("Remote shell session idle timeout")
+				audit.Write("timeout", []byte("idle timeout"))
+			}
+			return
+		}
+		switch frame.Type {
+		case "stdin":
+			audit.Write("in", frame.Data)
+			_, err = pty.Write(frame.Data)
+			if err != nil {
+				return
+			}
+		case "resize":
+			err = helpers.SetPtySize(pty, frame.Rows, frame.Cols)
+			if err != nil {
+				log.Log.Debug().Err(err).Int("SessionId", session.ID).Msg("Resize failed")
+			}
+		case "exit":
+			return
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package lib
+
+import (
+	_ "embed"
+	"fmt"
+	"main/lib/helpers"
+	"main/lib/structs"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Local read-only api
+
+//go:embed openapi.json
+var openApiDocument []byte
+
+func timeRef(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// readOnly rejects non GET requests
+func readOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			_ = WriteJsonResponse(w, http.StatusMethodNotAllowed, map[string]any{"msg": "method not allowed"})
+			return
+		}
+		next(w, req)
+	}
+}
+
+// withStateETag answers 304 when client has current state of installed packages,
+// etag changes on every FilesReload and installation save
+func (service *AgentServiceWrap) withStateETag(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		etag := fmt.Sprintf(`"%x-%d"`, service.started.UnixNano(), service.FilesStateVersion())
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+		if match := req.Header.Get("If-None-Match"); match != "" && (match == etag || match == "*") {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		next(w, req)
+	}
+}
+
+// pathId parses numeric id following prefix, e.g. /v1/packages/12
+func pathId(req *http.Request, prefix string) (int, error) {
+	return strconv.Atoi(strings.Trim(strings.TrimPrefix(req.URL.Path, prefix), "/"))
+}
+
+func (service *AgentServiceWrap) LocalStatus() *structs.LocalStatusGet {
+	status := &structs.LocalStatusGet{
+		Version:      PcaVersion,
+		StartedAt:    service.started,
+		Registration: &structs.LocalRegistrationGet{},
+		Control: &structs.LocalControlGet{
+			Endpoint:       service.ApiClient.client.BaseURL,
+			CommandsSocket: service.commands.Connected(),
+		},
+		Tasks: service.TaskStates(),
+	}
+	if registration := service.FilesGetRegistration(); registration != nil {
+		status.Registration.Registered = true
+		status.Registration.RegisteredAt = timeRef(registration.RegisteredAt)
+	}
+	service.control.lock.Lock()
+	status.Control.Reachable = service.control.reachable
+	status.Control.LastCheckAt = timeRef(service.control.lastCheckAt)
+	status.Control.LastSuccessAt = timeRef(service.control.lastSuccessAt)
+	service.control.lock.Unlock()
+	return status
+}
+
+func (service *AgentServiceWrap) StatusRoute() http.HandlerFunc {
+	return readOnly(func(w http.ResponseWriter, req *http.Request) {
+		_ = WriteJsonResponse(w, http.StatusOK, service.LocalStatus())
+	})
+}
+
+func (service *AgentServiceWrap) PackagesRoute() http.HandlerFunc {
+	return readOnly(service.withStateETag(func(w http.ResponseWriter, req *http.Request) {
+		packages := make([]*SavedInfo, 0, len(service.Installed))
+		service.FilesIterInstalled(func(info *SavedInfo) {
+			packages = append(packages, info)
+		})
+		_ = WriteJsonResponse(w, http.StatusOK, map[string]any{"items": packages, "total": len(packages)})
+	}))
+}
+
+func (service *AgentServiceWrap) PackageRoute() http.HandlerFunc {
+	return readOnly(service.withStateETag(func(w http.ResponseWriter, req *http.Request) {
+		packageId, err := pathId(req, "/v1/packages/")
+		if err != nil {
+			_ = WriteJsonResponse(w, http.StatusBadRequest, map[string]any{"msg": "invalid package id"})
+			return
+		}
+		info := helpers.Find(service.Installed, func(i *SavedInfo) bool {
+			return i.Package.ID == packageId
+		})
+		if info == nil {
+			_ = WriteJsonResponse(w, http.StatusNotFound, map[string]any{"msg": "package not installed"})
+			return
+		}
+		_ = WriteJsonResponse(w, http.StatusOK, *info)
+	}))
+}
+
+func (service *AgentServiceWrap) SoftwareRoute() http.HandlerFunc {
+	return readOnly(service.withStateETag(func(w http.ResponseWriter, req *http.Request) {
+		softwareId, err := pathId(req, "/v1/software/")
+		if err != nil {
+			_ = WriteJsonResponse(w, http.StatusBadRequest, map[string]any{"msg": "invalid software id"})
+			return
+		}
+		var found *structs.PackageItem
+		service.FilesIterInstalledPackageItem(func(info *SavedInfo, packageItem *structs.PackageItem) {
+			if packageItem.Software.ID == softwareId {
+				found = packageItem
+			}
+		})
+		if found == nil {
+			_ = WriteJsonResponse(w, http.StatusNotFound, map[string]any{"msg": "software not installed"})
+			return
+		}
+		_ = WriteJsonResponse(w, http.StatusOK, found)
+	}))
+}
+
+func (service *AgentServiceWrap) OpenApiRoute() http.HandlerFunc {
+	return readOnly(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(openApiDocument)
+	})
+}
@@ -1,5 +1,10 @@
 package structs
 
+import (
+	"main/lib/helpers"
+	"time"
+)
+
 // BASES -------------------------------------------------
 
 type ApiInconsistencyContextErr struct {
@@ -47,6 +52,47 @@ type RestLogPost struct {
 	Context map[string]any `json:"context"`
 }
 
+// Remote command states
+const (
+	CommandReceived    = "received"
+	CommandRunning     = "running"
+	CommandDone        = "done"
+	CommandFailed      = "failed"
+	CommandRejected    = "rejected"
+	CommandInterrupted = "interrupted"
+)
+
+type RestCommandResultPost struct {
+	CmdTriggerId int              `json:"trigger_cmd_id"`
+	Command      string           `json:"command"`
+	Status       string           `json:"status"`
+	ExitStatus   int              `json:"exit_status"`
+	Error        string           `json:"error"`
+	StartedAt    time.Time        `json:"started_at"`
+	FinishedAt   time.Time        `json:"finished_at"`
+	Logs         []map[string]any `json:"logs"`
+}
+
+type RestHealthPost struct {
+	Services  []*ServiceHealth `json:"services"`
+	CheckedAt time.Time        `json:"checked_at"`
+}
+
+// RestHeartbeatPost is sent periodically so control server can tell stale or unhealthy agents
+type RestHeartbeatPost struct {
+	AgentVersion   string                 `json:"agent_version"`
+	Uptime         int64                  `json:"uptime"`
+	AgentUptime    int64                  `json:"agent_uptime"`
+	CpuCount       int                    `json:"cpu_count"`
+	Load           [3]float64             `json:"load"`
+	Memory         *helpers.MemoryStats   `json:"memory"`
+	Disks          []*helpers.DiskStats   `json:"disks"`
+	RebootRequired bool                   `json:"reboot_required"`
+	LastCommand    *RestCommandResultPost `json:"last_command"`
+	Errors         []string               `json:"errors"`
+	SentAt         time.Time              `json:"sent_at"`
+}
+
 // GET DTO -------------------------------------------------
 
 type RestCommandGet struct {
@@ -54,6 +100,28 @@ type RestCommandGet struct {
 	Command string `json:"command"`
 }
 
+// WsAgentMessage is a frame pushed by control server over agent websocket
+type WsAgentMessage struct {
+	Type    string               `json:"type"`
+	Command *RestCommandGet      `json:"command,omitempty"`
+	Shell   *RestShellSessionGet `json:"shell,omitempty"`
+}
+
+type RestShellSessionGet struct {
+	ID   int    `json:"id"`
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+// WsShellFrame is a frame of remote shell session (stdin, stdout, resize, exit)
+type WsShellFrame struct {
+	Type string `json:"type"`
+	Data []byte `json:"data,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+	Cols uint16 `json:"cols,omitempty"`
+	Code int    `json:"code,omitempty"`
+}
+
 type RestSessionGet struct {
 	ID int `json:"id"`
 }
@@ -68,3 +136,45 @@ type RestSoftwareConfigGet struct {
 	ID      int    `json:"id"`
 	RawData string `json:"raw_data"`
 }
+
+// RELAY DTO -------------------------------------------------
+
+// ProxyHop is agent on path of request to control server, Address is where hop got request from,
+// UpstreamMs is round trip from hop to its upstream
+type ProxyHop struct {
+	Agent      string    `json:"agent"`
+	Address    string    `json:"address"`
+	At         time.Time `json:"at"`
+	UpstreamMs float64   `json:"upstream_ms"`
+}
+
+// ProxyTrace is answer of /proxy/_trace, last relay of chain checks control server by agent credentials
+type ProxyTrace struct {
+	Hops          []*ProxyHop `json:"hops"`
+	Control       string      `json:"control"`
+	ControlStatus int         `json:"control_status"`
+	ControlError  string      `json:"control_error"`
+}
+
+// LOCAL API DTO -------------------------------------------------
+
+type LocalRegistrationGet struct {
+	Registered   bool       `json:"registered"`
+	RegisteredAt *time.Time `json:"registered_at"`
+}
+
+type LocalControlGet struct {
+	Endpoint       string     `json:"endpoint"`
+	Reachable      bool       `json:"reachable"`
+	LastCheckAt    *time.Time `json:"last_check_at"`
+	LastSuccessAt  *time.Time `json:"last_success_at"`
+	CommandsSocket bool       `json:"commands_socket"`
+}
+
+type LocalStatusGet struct {
+	Version      string                `json:"version"`
+	StartedAt    time.Time             `json:"started_at"`
+	Registration *LocalRegistrationGet `json:"registration"`
+	Control      *LocalControlGet      `json:"control"`
+	Tasks        []helpers.TaskState   `json:"tasks"`
+}
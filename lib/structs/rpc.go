@@ -0,0 +1,146 @@
+package structs
+
+import "time"
+
+// Control api of service (JSON-RPC 2.0 over control socket), api version is part of method name
+
+const (
+	RpcLock        = "pca.v1.lock"
+	RpcUnlock      = "pca.v1.unlock"
+	RpcRenew       = "pca.v1.lock.renew"
+	RpcLockStatus  = "pca.v1.lock.status"
+	RpcLockBreak   = "pca.v1.lock.break"
+	RpcReconfigure = "pca.v1.reconfigure"
+	RpcReload      = "pca.v1.reload"
+	RpcRun         = "pca.v1.run"
+	RpcSubscribe   = "pca.v1.events.subscribe"
+	RpcStatus      = "pca.v1.status"
+	RpcTailLogs    = "pca.v1.logs.tail"
+	RpcProxyAgents = "pca.v1.proxy.agents"
+
+	// RpcEvent is notification sent by service to subscribed clients and during pca.v1.run
+	RpcEvent = "pca.v1.event"
+)
+
+// Event types
+const (
+	EventLog      = "log"
+	EventLock     = "lock"
+	EventReload   = "reload"
+	EventProgress = "progress"
+)
+
+type RpcEmpty struct{}
+
+// Lock holders
+const (
+	LockFree    = "none"
+	LockLease   = "lease"
+	LockService = "service"
+	LockProcess = "process"
+)
+
+// LockOwner describes process holding operation lock
+type LockOwner struct {
+	Pid       int       `json:"pid"`
+	Command   string    `json:"command"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// RpcLockParams acquires lease on service lock, lease expires after Ttl seconds unless renewed
+type RpcLockParams struct {
+	Owner *LockOwner `json:"owner"`
+	Ttl   int        `json:"ttl"`
+}
+
+type RpcLockResult struct {
+	LeaseId    string    `json:"lease_id"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type RpcUnlockParams struct {
+	LeaseId string `json:"lease_id"`
+}
+
+type RpcRenewParams struct {
+	LeaseId string `json:"lease_id"`
+}
+
+type RpcRenewResult struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type RpcLockStatusResult struct {
+	Locked     bool       `json:"locked"`
+	Holder     string     `json:"holder"`
+	Owner      *LockOwner `json:"owner"`
+	AcquiredAt *time.Time `json:"acquired_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+type RpcReloadResult struct {
+	Installed    int    `json:"installed"`
+	StateVersion uint64 `json:"state_version"`
+}
+
+// RpcRunParams runs agent command (same args as cli) inside service,
+// command runs under lease of connection when connection holds it
+type RpcRunParams struct {
+	Args      []string `json:"args"`
+	AssumeYes bool     `json:"assume_yes"`
+}
+
+type RpcRunResult struct {
+	Status     string           `json:"status"`
+	Error      string           `json:"error"`
+	StartedAt  time.Time        `json:"started_at"`
+	FinishedAt time.Time        `json:"finished_at"`
+	Logs       []map[string]any `json:"logs"`
+}
+
+// RpcSubscribeParams subscribes connection to events of given types, all types when empty
+type RpcSubscribeParams struct {
+	Types []string `json:"types"`
+}
+
+type RpcEventParams struct {
+	Type string         `json:"type"`
+	Time time.Time      `json:"time"`
+	Data map[string]any `json:"data"`
+}
+
+type RpcTailLogsParams struct {
+	Lines int `json:"lines"`
+}
+
+type RpcTailLogsResult struct {
+	Lines []map[string]any `json:"lines"`
+}
+
+// Statuses of downstream agents of relay
+const (
+	DownstreamRegistered = "registered"
+	DownstreamApproved   = "approved"
+	DownstreamPending    = "pending"
+	DownstreamDenied     = "denied"
+)
+
+// DownstreamAgent is agent using this agent as relay, it is identified by sha256 of its secret
+type DownstreamAgent struct {
+	SecretSha256 string    `json:"secret_sha256"`
+	Status       string    `json:"status"`
+	Address      string    `json:"address"`
+	LocalAddress string    `json:"local_address"`
+	System       string    `json:"system"`
+	Version      string    `json:"version"`
+	FirstSeen    time.Time `json:"first_seen"`
+	LastSeen     time.Time `json:"last_seen"`
+	CheckedAt    time.Time `json:"checked_at"`
+	Requests     int64     `json:"requests"`
+	Limited      int64     `json:"limited"`
+}
+
+type RpcProxyAgentsResult struct {
+	Agents []*DownstreamAgent `json:"agents"`
+}
@@ -1,10 +1,12 @@
 package structs
 
 import (
+	"fmt"
 	"github.com/hashicorp/go-version"
 	"github.com/jedib0t/go-pretty/v6/table"
 	"github.com/jedib0t/go-pretty/v6/text"
 	"github.com/takama/daemon"
+	"main/lib/helpers"
 	"net/http"
 	"strconv"
 	"strings"
@@ -99,6 +101,112 @@ func (pr *Product) Header() *table.Row {
 	return &table.Row{"#", "Name", "Description"}
 }
 
+// ----------------------POLICY------------------------------------
+
+const (
+	PolicyManual     = "manual"
+	PolicyAutoPatch  = "auto-patch"
+	PolicyAutoUpdate = "auto-update"
+)
+
+// UpdatePolicy defines how package is updated, automatic modes apply changes only
+// inside maintenance window: Schedule (cron) marks window start, Duration in minutes
+type UpdatePolicy struct {
+	Mode     string `json:"mode" groups:"local"`
+	Schedule string `json:"schedule" groups:"local"`
+	Duration int    `json:"duration" groups:"local"`
+	Timezone string `json:"timezone" groups:"local"`
+}
+
+func (p *UpdatePolicy) Validate() error {
+	if p.Mode != PolicyManual && p.Mode != PolicyAutoPatch && p.Mode != PolicyAutoUpdate {
+		return fmt.Errorf("unknown policy mode %q", p.Mode)
+	}
+	if p.Mode == PolicyManual {
+		return nil
+	}
+	if _, err := helpers.ParseCron(p.Schedule); err != nil {
+		return err
+	}
+	if p.Duration <= 0 {
+		return fmt.Errorf("window duration must be positive, got %d", p.Duration)
+	}
+	if _, err := time.LoadLocation(p.Timezone); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Window returns start of maintenance window open at given time, zero time if window is closed
+func (p *UpdatePolicy) Window(now time.Time) (time.Time, error) {
+	schedule, err := helpers.ParseCron(p.Schedule)
+	if err != nil {
+		return time.Time{}, err
+	}
+	location, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	duration := time.Duration(p.Duration) * time.Minute
+	return schedule.Prev(now.In(location), duration-time.Minute), nil
+}
+
+// NextWindow returns start of next maintenance window
+func (p *UpdatePolicy) NextWindow(now time.Time) (time.Time, error) {
+	schedule, err := helpers.ParseCron(p.Schedule)
+	if err != nil {
+		return time.Time{}, err
+	}
+	location, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return schedule.Next(now.In(location)), nil
+}
+
+// ----------------------HEALTH------------------------------------
+
+const (
+	ProbeSystemd = "systemd"
+	ProbeHttp    = "http"
+	ProbeTcp     = "tcp"
+	ProbeCommand = "command"
+
+	HealthHealthy = "healthy"
+	HealthFailing = "failing"
+)
+
+// HealthProbe is a check of software declared on control server, Target is unit name,
+// url, host:port or shell command depending on Kind, Timeout in seconds.
+// Hold is used by readiness gates: probe must pass continuously for Hold seconds
+type HealthProbe struct {
+	Kind    string `json:"kind" groups:"local"`
+	Target  string `json:"target" groups:"local"`
+	Timeout int    `json:"timeout" groups:"local"`
+	Hold    int    `json:"hold" groups:"local"`
+}
+
+type ProbeResult struct {
+	Kind     string `json:"kind"`
+	Target   string `json:"target"`
+	Healthy  bool   `json:"healthy"`
+	Message  string `json:"message"`
+	Duration int64  `json:"duration_ms"`
+}
+
+type ServiceHealth struct {
+	PackageID   int            `json:"package_id"`
+	SoftwareID  int            `json:"software_id"`
+	Name        string         `json:"name"`
+	Status      string         `json:"status"`
+	Unit        string         `json:"unit,omitempty"`
+	ActiveState string         `json:"active_state,omitempty"`
+	SubState    string         `json:"sub_state,omitempty"`
+	Restarts    int            `json:"restarts"`
+	Probes      []*ProbeResult `json:"probes"`
+	CheckedAt   time.Time      `json:"checked_at"`
+}
+
 // ----------------------USAGE-------------------------------------
 
 type Build struct {
@@ -118,6 +226,10 @@ type Software struct {
 	Patch       int     `json:"patch" groups:"local"`
 	Build       *Build  `json:"build" groups:"local"`
 
+	Probes           []*HealthProbe `json:"probes" groups:"local"`
+	Readiness        []*HealthProbe `json:"readiness" groups:"local"`
+	ReadinessTimeout int            `json:"readiness_timeout" groups:"local"`
+
 	PackageInfo *Installation `json:"package_info" groups:"local"` // system usage
 	FullName    *string       `json:"full_name" groups:"local"`
 	Error       string        `json:"error" groups:"local"`
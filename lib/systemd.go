@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"main/lib/helpers"
+	"main/lib/log"
+	"net"
+	"strings"
+	"time"
+)
+
+// systemd integration: unit of Type=notify, service reports readiness and activity by sd_notify
+// and pings watchdog while scheduler is alive
+
+const WatchdogSec = 120
+
+// watchdogGrace is how long periodic task may be overdue before service is considered wedged
+const watchdogGrace = time.Minute
+
+// readyTimeout limits wait for listeners of http and rpc servers before READY=1
+const readyTimeout = 10 * time.Second
+
+// statusInterval is period of STATUS updates when watchdog is disabled
+const statusInterval = 30 * time.Second
+
+var systemdUnitTemplate = fmt.Sprintf(`[Unit]
+Description={{.Description}}
+Requires={{.Dependencies}}
+After={{.Dependencies}}
+
+[Service]
+Type=notify
+NotifyAccess=main
+ExecStart={{.Path}} {{.Args}}
+Restart=on-failure
+WatchdogSec=%d
+TimeoutStartSec=300
+TimeoutStopSec=%d
+
+[Install]
+WantedBy=multi-user.target
+`, WatchdogSec, TasksShutdownTimeout+15)
+
+// InstallService installs service running with current home and config, under systemd as notify unit
+func (service *AgentServiceWrap) InstallService() (string, error) {
+	if helpers.FileExists("/run/systemd/system") {
+		if err := service.SetTemplate(systemdUnitTemplate); err != nil {
+			return "", err
+		}
+	}
+	return service.Install("--home", HomePath, "--config", ConfigPath, "service", "serve")
+}
+
+// notifyReady reports readiness once http server and control socket accept connections
+func (service *AgentServiceWrap) notifyReady() {
+	_, port, _ := net.SplitHostPort(service.Settings.HttpPort)
+	host := service.Settings.HttpBind
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	endpoints := [][2]string{{"unix", service.Settings.RpcSocket}, {"tcp", net.JoinHostPort(host, port)}}
+	deadline := time.Now().Add(readyTimeout)
+	for _, endpoint := range endpoints {
+		for {
+			conn, err := net.DialTimeout(endpoint[0], endpoint[1], time.Second)
+			if err == nil {
+				_ = conn.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				log.Log.Warn().Err(err).Msgf("%s is not listening, report ready anyway", endpoint[1])
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	_, _ = helpers.SdNotify(helpers.SdReady)
+	helpers.SdNotifyStatus(service.activity())
+}
+
+// activity describes what service is doing now, it is shown by systemctl status
+func (service *AgentServiceWrap) activity() string {
+	parts := make([]string, 0)
+	service.tasksLock.Lock()
+	scheduler := service.scheduler
+	service.tasksLock.Unlock()
+	if scheduler != nil {
+		if running := scheduler.Running(); len(running) > 0 {
+			parts = append(parts, "running "+strings.Join(running, ", "))
+		}
+	}
+	if lockStatus := service.leases.status(); lockStatus.Owner != nil {
+		parts = append(parts, fmt.Sprintf("locked by pid %d", lockStatus.Owner.Pid))
+	} else if lockStatus.Locked {
+		parts = append(parts, "operation in progress")
+	}
+	if len(parts) == 0 {
+		return "Idle"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// stalledTasks is liveness check of watchdog, scheduler being restarted is alive
+func (service *AgentServiceWrap) stalledTasks() []string {
+	service.tasksLock.Lock()
+	scheduler := service.scheduler
+	service.tasksLock.Unlock()
+	if scheduler == nil {
+		return nil
+	}
+	return scheduler.Stalled(watchdogGrace)
+}
+
+// superviseSystemd pings watchdog until ctx is done, ping is skipped while tasks are stalled,
+// so systemd restarts wedged service after WatchdogSec
+func (service *AgentServiceWrap) superviseSystemd(ctx context.Context) {
+	watchdog := helpers.SdWatchdogInterval()
+	interval := statusInterval
+	if watchdog > 0 {
+		interval = watchdog / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if stalled := service.stalledTasks(); len(stalled) > 0 {
+			log.Log.Error().Strs("Tasks", stalled).Msg("Tasks are stalled, watchdog is not pinged")
+			helpers.SdNotifyStatus("Stalled: " + strings.Join(stalled, ", "))
+			continue
+		}
+		if watchdog > 0 {
+			if _, err := helpers.SdNotify(helpers.SdWatchdog); err != nil {
+				log.Log.Warn().Err(err).Msg("Can't ping systemd watchdog")
+			}
+		}
+		helpers.SdNotifyStatus(service.activity())
+	}
+}
@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"main/lib/helpers"
+	"main/lib/log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TLS of relay: upstream is verified by CA bundle or pinned sha256 fingerprint of its certificate,
+// local https listener may use generated self-signed certificate, its fingerprint is pinned by downstream agents
+
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+var ErrFingerprintMismatch = errors.New("certificate fingerprint mismatch")
+
+// CertFingerprint is sha256 hex of DER certificate
+func CertFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeFingerprint accepts hex with colons as printed by openssl
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+}
+
+// UpstreamTlsConfig verifies control server or upstream relay, pinned fingerprint replaces chain verification,
+// so self-signed certificate of relay is trusted
+func UpstreamTlsConfig(netInfo *NetSettings) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if netInfo.CaFile != "" {
+		caPem, err := os.ReadFile(netInfo.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificates in %s", netInfo.CaFile)
+		}
+		config.RootCAs = pool
+	}
+	if netInfo.CertSha256 != "" {
+		pinned := normalizeFingerprint(netInfo.CertSha256)
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return ErrFingerprintMismatch
+			}
+			if actual := CertFingerprint(state.PeerCertificates[0].Raw); actual != pinned {
+				return fmt.Errorf("%w: %s", ErrFingerprintMismatch, actual)
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
+
+// HttpCertFiles returns certificate and key of local https server, generated ones are used by self_signed
+func (settings *Settings) HttpCertFiles() (string, string) {
+	tlsSettings := settings.HttpTls
+	if tlsSettings == nil {
+		return "", ""
+	}
+	if tlsSettings.CertFile == "" && tlsSettings.SelfSigned {
+		return filepath.Join(settings.SystemDir, "tls", "agent.crt"), filepath.Join(settings.SystemDir, "tls", "agent.key")
+	}
+	return tlsSettings.CertFile, tlsSettings.KeyFile
+}
+
+// EnsureSelfSignedCert generates leaf certificate for host names and addresses of this machine, existing one is kept.
+// It can't sign other certificates, downstream agents trust it by pinned fingerprint only
+func EnsureSelfSignedCert(certFile string, keyFile string) error {
+	if helpers.FileExists(certFile) && helpers.FileExists(keyFile) {
+		return nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"pca"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		DNSNames:              []string{"localhost"},
+	}
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if addresses, addrErr := net.InterfaceAddrs(); addrErr == nil {
+		for _, address := range addresses {
+			if ipNet, ok := address.(*net.IPNet); ok {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(certFile), 0700); err != nil {
+		return err
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	log.Log.Info().Str("Fingerprint", CertFingerprint(der)).Msgf("Self-signed certificate %s generated", certFile)
+	return nil
+}
+
+// CertFileFingerprint returns fingerprint of first certificate of pem file
+func CertFileFingerprint(certFile string) (string, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return "", err
+	}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			return CertFingerprint(block.Bytes), nil
+		}
+	}
+	return "", fmt.Errorf("no certificates in %s", certFile)
+}
+
+// DisplayHttpFingerprint prints fingerprint of local https server, downstream agents pin it by
+// pca config set net_info.cert_sha256 <fingerprint>
+func (a *Agent) DisplayHttpFingerprint() error {
+	certFile, keyFile := a.Settings.HttpCertFiles()
+	if certFile == "" {
+		return errors.New("https is not enabled (http_tls)")
+	}
+	if a.Settings.HttpTls.SelfSigned {
+		if err := EnsureSelfSignedCert(certFile, keyFile); err != nil {
+			return err
+		}
+	}
+	fingerprint, err := CertFileFingerprint(certFile)
+	if err != nil {
+		return err
+	}
+	fmt.Println(fingerprint)
+	return nil
+}
@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"main/lib/helpers"
+	"main/lib/log"
+	"main/lib/structs"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Relay chains: every hop appends its record to HopsHeader of forwarded request, records are
+// comma separated, fields of record are agent=<id>;for=<address>;at=<time>. Agent id is prefix
+// of sha256 of agent SECRET, like in pca proxy agents. Relay seeing its own id rejects request as loop.
+
+const (
+	HopsHeader   = "X-Pca-Hops"
+	maxRelayHops = 16
+	tracePath    = "/_trace"
+	// traceControlPath is read only route last relay checks control server by, with credentials of agent
+	traceControlPath = "/api/v1/agent/update"
+	traceTimeout     = 30 * time.Second
+)
+
+// AgentId identifies agent in hop records without revealing its secret
+func AgentId(settings *Settings) string {
+	return secretSha256(settings.SECRET)[:12]
+}
+
+func formatHop(hop *structs.ProxyHop) string {
+	return fmt.Sprintf("agent=%s;for=%s;at=%s", hop.Agent, hop.Address, hop.At.UTC().Format(time.RFC3339Nano))
+}
+
+func appendHop(header string, hop *structs.ProxyHop) string {
+	if header == "" {
+		return formatHop(hop)
+	}
+	return header + ", " + formatHop(hop)
+}
+
+// ParseHops reads records of HopsHeader, unknown fields are ignored
+func ParseHops(header string) []*structs.ProxyHop {
+	hops := make([]*structs.ProxyHop, 0)
+	for _, record := range strings.Split(header, ",") {
+		if strings.TrimSpace(record) == "" {
+			continue
+		}
+		hop := &structs.ProxyHop{}
+		for _, field := range strings.Split(record, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch key {
+			case "agent":
+				hop.Agent = value
+			case "for":
+				hop.Address = value
+			case "at":
+				hop.At, _ = time.Parse(time.RFC3339Nano, value)
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration.Microseconds()) / 1000
+}
+
+// trace answers /proxy/_trace: relay before last one asks next relay, last one checks control server,
+// every hop sets round trip to its upstream. Returned code is status of control server for registry
+func (r *relay) trace(w http.ResponseWriter, req *http.Request) int {
+	client := &http.Client{Transport: r.transport, Timeout: traceTimeout}
+	upstream := r.service.upstreamUrl()
+	result := &structs.ProxyTrace{Hops: ParseHops(req.Header.Get(HopsHeader)), Control: upstream.String()}
+	target := *upstream
+	target.Path = traceControlPath
+	if r.service.Settings.NetInfo.AsProxy {
+		target.Path = relayPrefix + tracePath
+	}
+	started := time.Now()
+	forward, err := upstreamRequest(req.Context(), http.MethodGet, &target, req)
+	var resp *http.Response
+	if err == nil {
+		resp, err = client.Do(forward)
+	}
+	elapsed := time.Since(started)
+	switch {
+	case err != nil:
+		result.ControlError = err.Error()
+	case r.service.Settings.NetInfo.AsProxy && resp.StatusCode == http.StatusOK:
+		next := &structs.ProxyTrace{}
+		if err = json.NewDecoder(resp.Body).Decode(next); err != nil {
+			result.ControlError = "invalid trace of relay " + upstream.Host + ": " + err.Error()
+		} else {
+			result = next
+		}
+	case r.service.Settings.NetInfo.AsProxy:
+		result.ControlError = fmt.Sprintf("relay %s responded %s", upstream.Host, resp.Status)
+	default:
+		result.ControlStatus = resp.StatusCode
+	}
+	if resp != nil {
+		_ = resp.Body.Close()
+	}
+	own := AgentId(r.service.Settings)
+	for _, hop := range result.Hops {
+		if hop.Agent == own {
+			hop.UpstreamMs = milliseconds(elapsed)
+		}
+	}
+	_ = WriteJsonResponse(w, http.StatusOK, result)
+	if result.ControlStatus == 0 {
+		return http.StatusBadGateway
+	}
+	return result.ControlStatus
+}
+
+func (a *Agent) DisplayProxyTrace() error {
+	trace, err := a.ApiClient.ProxyTrace()
+	if err != nil {
+		return err
+	}
+	hopsTable := helpers.ConstructTable(&table.Row{"#", "Agent", "From", "At", "Upstream ms"})
+	for i, hop := range trace.Hops {
+		at := ""
+		if !hop.At.IsZero() {
+			at = hop.At.Local().Format(time.RFC3339Nano)
+		}
+		hopsTable.AppendRow(table.Row{i, hop.Agent, hop.Address, at, fmt.Sprintf("%.1f", hop.UpstreamMs)})
+	}
+	hopsTable.Render()
+	if trace.ControlError != "" {
+		return fmt.Errorf("control server %s is not reachable: %s", trace.Control, trace.ControlError)
+	}
+	log.Log.Info().Int("Status", trace.ControlStatus).Int("Hops", len(trace.Hops)).
+		Msgf("Control server %s answered", trace.Control)
+	return nil
+}
@@ -9,11 +9,11 @@ import (
 	"github.com/jedib0t/go-pretty/v6/text"
 	"github.com/liip/sheriff"
 	"main/lib/helpers"
+	"main/lib/jsonrpc"
 	"main/lib/log"
 	"main/lib/structs"
 	"net"
 	"net/http"
-	"net/rpc"
 	"os"
 	"os/exec"
 	"sort"
@@ -25,11 +25,13 @@ import (
 
 // Go
 
+var ErrLockBusy = errors.New(" WithLock() fails, can't acquire given lock ")
+
 func WithLock(lock *sync.Mutex, f func() error) func() error {
 	return func() error {
 		canLock := lock.TryLock()
 		if canLock == false {
-			return errors.New(" WithLock() fails, can't acquire given lock ")
+			return ErrLockBusy
 		}
 		log.Log.Debug().Msg("Locked()")
 		defer lock.Unlock()
@@ -49,12 +51,13 @@ func MergeMaps(src ...map[string]any) *map[string]any {
 	return &merged
 }
 
-func CreateRpcConn() *rpc.Client {
-	conn, conerr := net.DialTimeout("tcp", RrcDns, 1*time.Second)
+// CreateRpcConn connects to service control socket, tcp port is not used as it serves read only methods
+func CreateRpcConn(settings *Settings) *jsonrpc.Client {
+	conn, conerr := net.DialTimeout("unix", settings.RpcSocket, 1*time.Second)
 	if conerr != nil {
 		log.Log.Debug().Msg("Connect to service failed, is pca.service alive?")
 	} else {
-		return rpc.NewClient(conn)
+		return jsonrpc.NewClient(conn)
 	}
 	return nil
 }
@@ -126,7 +129,7 @@ func FindInstalledEditor() string {
 
 // Apis
 
-func WriteJsonResponse(w http.ResponseWriter, statusCode int, data map[string]any) error {
+func WriteJsonResponse(w http.ResponseWriter, statusCode int, data any) error {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 	err := json.NewEncoder(w).Encode(data)
@@ -169,7 +172,20 @@ func SafeWriteJsonFile(v interface{}, sheriffOpts *sheriff.Options, filename str
 
 // Agent asks
 
-func AskInput(selectName string, validate func(input string) bool) {
+var (
+	// Interactive is false in service process, prompts must never wait on stdin there
+	Interactive = true
+	// AssumeYes confirms prompts without input, set for remote commands whose policy implies confirmation
+	AssumeYes = false
+
+	ErrNonInteractive = errors.New("input required, but prompts are disabled")
+)
+
+func AskInput(selectName string, validate func(input string) bool) error {
+	if !Interactive {
+		log.Log.Warn().Err(ErrNonInteractive).Msgf("Can't choose %s", selectName)
+		return ErrNonInteractive
+	}
 	for {
 		var input string
 		log.Log.Info().Msgf("Please choose %s: ", selectName)
@@ -178,7 +194,7 @@ func AskInput(selectName string, validate func(input string) bool) {
 			log.Log.Warn().Msg("Filed to scan from console")
 		} else {
 			if validate(input) {
-				break
+				return nil
 			}
 		}
 	}
@@ -186,10 +202,10 @@ func AskInput(selectName string, validate func(input string) bool) {
 
 func AskConfirm(force *bool) bool {
 	confirm := false
-	if *force {
+	if *force || AssumeYes {
 		confirm = true
 	} else {
-		AskInput("(y/n)", func(input string) bool {
+		_ = AskInput("(y/n)", func(input string) bool {
 			if input == "y" {
 				confirm = true
 				return true
@@ -233,7 +249,7 @@ func AskTargetClient(clientId *int, clients []*structs.Client) *structs.Client {
 		t.AppendSeparator()
 	}
 	t.Render()
-	AskInput("client id", func(input string) bool {
+	inputErr := AskInput("client id", func(input string) bool {
 		num, err := strconv.Atoi(input)
 		if err != nil {
 			log.Log.Warn().Msg("Pass only digit value value, please retry")
@@ -247,6 +263,9 @@ func AskTargetClient(clientId *int, clients []*structs.Client) *structs.Client {
 			return true
 		}
 	})
+	if inputErr != nil {
+		return nil
+	}
 	return targetClient
 }
 
@@ -279,7 +298,7 @@ func AskTargetProduct(productId *int, products []*structs.Product) *structs.Prod
 		t.AppendSeparator()
 	}
 	t.Render()
-	AskInput("products id", func(input string) bool {
+	inputErr := AskInput("products id", func(input string) bool {
 		num, err := strconv.Atoi(input)
 		if err != nil {
 			log.Log.Warn().Msg("Pass only digit value value, please retry")
@@ -293,6 +312,9 @@ func AskTargetProduct(productId *int, products []*structs.Product) *structs.Prod
 			return true
 		}
 	})
+	if inputErr != nil {
+		return nil
+	}
 	return targetProduct
 }
 
@@ -336,7 +358,7 @@ func AskTargetPackage(product *structs.Product, units []*structs.Unit, packageId
 	}
 	t.Render()
 	var targetPackageName string
-	AskInput("package name num", func(input string) bool {
+	inputErr := AskInput("package name num", func(input string) bool {
 		num, err := strconv.Atoi(input)
 		if num > len(packages) || num == 0 || err != nil {
 			log.Log.Warn().Msg("This package not exists, please retry")
@@ -346,6 +368,9 @@ func AskTargetPackage(product *structs.Product, units []*structs.Unit, packageId
 			return true
 		}
 	})
+	if inputErr != nil {
+		return nil, nil
+	}
 	pkgList := make([]*structs.Package, 0)
 	for _, unit := range units {
 		pkg := helpers.Find(unit.Packages, func(p *structs.Package) bool {
@@ -381,7 +406,7 @@ func AskTargetPackage(product *structs.Product, units []*structs.Unit, packageId
 		t.AppendSeparator()
 	}
 	t.Render()
-	AskInput("package id", func(input string) bool {
+	inputErr = AskInput("package id", func(input string) bool {
 		num, err := strconv.Atoi(input)
 		if err != nil {
 			log.Log.Warn().Msg("Please pass int")
@@ -394,6 +419,9 @@ func AskTargetPackage(product *structs.Product, units []*structs.Unit, packageId
 		log.Log.Warn().Msg("Num of package not exists, please retry")
 		return false
 	})
+	if inputErr != nil {
+		return nil, nil
+	}
 	//log.Log.Info().Msg("Install this:")
 	//l = list.NewWriter()
 	//l.SetStyle(list.StyleConnectedRounded)
@@ -2,6 +2,7 @@ package lib
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,13 +11,12 @@ import (
 	"io"
 	"io/fs"
 	"main/lib/helpers"
+	"main/lib/jsonrpc"
 	"main/lib/log"
+	"main/lib/metrics"
 	"main/lib/structs"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/rpc"
-	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -29,8 +29,31 @@ import (
 
 type AgentServiceWrap struct {
 	daemon.Daemon
-	tasks []*helpers.GoTask
-	lock  *sync.Mutex
+	scheduler       *helpers.Scheduler
+	tasksLock       *sync.Mutex
+	restartLock     *sync.Mutex
+	reconfigureLock *sync.Mutex
+	// pendingSettings are accepted by reconfigure and applied by restartTasks while tasks using them are stopped
+	pendingSettings *Settings
+	commandLock     *sync.Mutex
+	// resultsLock serializes posting of command results, so every result is sent once
+	resultsLock    *sync.Mutex
+	stopSupervisor context.CancelFunc
+	// recoveredCommands are received but not started before service start, CommandsWorker runs them once
+	recoveredCommands []*structs.RestCommandGet
+	controlServer     *jsonrpc.Server
+	lock              *sync.Mutex
+	leases            *leaseLock
+	fileLock          *processLock
+	commands          *CommandsChannel
+	events            *eventHub
+	buildCache        *buildCache
+	health            map[int]string
+	restarts          map[int]int
+	started           time.Time
+	control           *controlState
+	downstream        *downstreamRegistry
+	policies          *policyCache
 	Agent
 }
 
@@ -45,174 +68,482 @@ func NewAgentServiceWrap(agent *Agent) *AgentServiceWrap {
 		panic(err)
 	}
 
-	return &AgentServiceWrap{
-		Daemon: serviceDaemon,
-		tasks:  make([]*helpers.GoTask, 0),
-		Agent:  *agent,
-		lock:   &sync.Mutex{},
+	service := &AgentServiceWrap{
+		Daemon:          serviceDaemon,
+		Agent:           *agent,
+		lock:            &sync.Mutex{},
+		tasksLock:       &sync.Mutex{},
+		restartLock:     &sync.Mutex{},
+		reconfigureLock: &sync.Mutex{},
+		commandLock:     &sync.Mutex{},
+		resultsLock:     &sync.Mutex{},
+		commands:        NewCommandsChannel(agent.ApiClient),
+		events:          newEventHub(),
+		health:          make(map[int]string),
+		restarts:        make(map[int]int),
+		started:         time.Now(),
+		control:         &controlState{},
+		policies:        newPolicyCache(),
 	}
+	// service holds lock file while it runs, commands it runs itself are serialized by commandLock
+	service.LockFile = ""
+	service.leases = newLeaseLock(service.lock)
+	service.downstream = newDownstreamRegistry(service.Settings)
+	service.leases.onRelease = service.onLeaseRelease
+	service.commands.Accept = service.receiveRemoteCommand
+	service.commands.OnShell = service.openShellSession
+	return service
 }
 
-func (service *AgentServiceWrap) RpcLock(_ int, _ *int) error {
-	log.Log.Debug().Msg("RpcLock()")
-	can := service.lock.TryLock()
-	if !can {
-		return errors.New("can't lock, service is busy")
+// periodicTaskDeadline is longest expected run of network bound periodic task, longer run stops watchdog pings
+const periodicTaskDeadline = 5 * time.Minute
+
+// startTasks builds tasks from current settings, so restart applies new intervals and listeners
+func (service *AgentServiceWrap) startTasks() {
+	scheduler := helpers.NewScheduler()
+	for _, task := range service.buildTasks() {
+		if err := scheduler.Add(task); err != nil {
+			log.Log.Error().Err(err).Msg("Can't schedule task")
+		}
 	}
-	return nil
+	service.tasksLock.Lock()
+	service.scheduler = scheduler
+	service.tasksLock.Unlock()
+	scheduler.Start()
 }
 
-func (service *AgentServiceWrap) RpcUnlock(_ int, _ *int) error {
-	service.FilesReload()
-	service.lock.Unlock()
-	log.Log.Debug().Msg("RpcUnlock()")
-	return nil
+func (service *AgentServiceWrap) stopTasks() {
+	log.Log.Debug().Msg("stopTasks()")
+	service.tasksLock.Lock()
+	scheduler := service.scheduler
+	service.tasksLock.Unlock()
+	if scheduler == nil {
+		return
+	}
+	if err := scheduler.Stop(TasksShutdownTimeout * time.Second); err != nil {
+		log.Log.Warn().Err(err).Msg("Service tasks were not stopped gracefully")
+	}
 }
 
-func (service *AgentServiceWrap) RpcReconfigure(_ int, _ *int) error {
-	service.stopTasks()
-	service.Settings = LoadSettings()
-	service.FilesReload()
-	service.startTasks()
-	log.Log.Info().Msg("Service was reconfigured")
-	return nil
+// restartTasks applies latest settings accepted by reconfigure. Only tasks depending on changed settings
+// are stopped while settings are applied and started again, others keep running.
+// Restarts are serialized, restart started after settings were taken by previous one does nothing
+func (service *AgentServiceWrap) restartTasks() {
+	service.restartLock.Lock()
+	defer service.restartLock.Unlock()
+	service.reconfigureLock.Lock()
+	settings := service.pendingSettings
+	service.pendingSettings = nil
+	var changes []settingChange
+	if settings != nil {
+		changes = settingsDiff(service.Settings, settings)
+	}
+	service.reconfigureLock.Unlock()
+	if len(changes) == 0 {
+		return
+	}
+	_, _ = helpers.SdNotify(helpers.SdReloading)
+	defer service.notifyReady()
+	service.tasksLock.Lock()
+	scheduler := service.scheduler
+	service.tasksLock.Unlock()
+	stale, all := staleTasks(changes)
+	if all || scheduler == nil {
+		service.stopTasks()
+		service.reconfigureLock.Lock()
+		service.applySettings(settings)
+		service.reconfigureLock.Unlock()
+		service.startTasks()
+		log.Log.Info().Msg("Service was reconfigured, all tasks were restarted")
+		return
+	}
+	err := scheduler.Restart(func(name string) bool { return stale[name] }, func() {
+		service.reconfigureLock.Lock()
+		defer service.reconfigureLock.Unlock()
+		applyChangedSettings(service.Settings, settings, changes)
+	}, service.buildTasks, TasksShutdownTimeout*time.Second)
+	if err != nil {
+		log.Log.Warn().Err(err).Msg("Service tasks were not restarted gracefully")
+	}
+	log.Log.Info().Int("Tasks", len(stale)).Msg("Service was reconfigured")
 }
 
-func (service *AgentServiceWrap) startTasks() {
-	for _, task := range service.tasks {
-		go task.Run()
+func (service *AgentServiceWrap) TaskStates() []helpers.TaskState {
+	service.tasksLock.Lock()
+	defer service.tasksLock.Unlock()
+	if service.scheduler == nil {
+		return make([]helpers.TaskState, 0)
 	}
+	return service.scheduler.States()
 }
 
-func (service *AgentServiceWrap) stopTasks() {
-	log.Log.Debug().Msg("stopTasks()")
-	for _, task := range service.tasks {
-		task.StopChan <- true
-	}
-	service.tasks = make([]*helpers.GoTask, 0)
+// closeOnDone closes listener of service task when task is stopped
+func closeOnDone(ctx context.Context, closer io.Closer) {
+	go func() {
+		<-ctx.Done()
+		_ = closer.Close()
+	}()
 }
 
 func (service *AgentServiceWrap) OnServiceStart() {
-	err := rpc.RegisterName(ServiceName, service)
-	if err != nil {
-		panic(err)
+	Interactive = false
+	helpers.SdNotifyStatus("Waiting for lock file")
+	// lock file is held while service runs, so cli falls back to it only when service is down
+	fileLock, lockErr := WaitProcessLock(service.Settings.LockFile, CurrentLockOwner(), serviceLockWait)
+	if lockErr != nil {
+		log.Log.Error().Err(lockErr).Msgf("Can't lock %s, service starts without lock file", service.Settings.LockFile)
 	}
-	service.tasks = append(service.tasks, helpers.NewAgentTask("HttpServer", 0, func() error {
+	service.fileLock = fileLock
+	service.useLastGoodConfig()
+	metrics.Default.OnScrape(service.collectStateMetrics)
+	log.Subscribe(func(line map[string]any) {
+		service.events.publish(structs.EventLog, line)
+	})
+	service.controlServer = service.newControlServer()
+	// recovery runs once per service start, restarted tasks must not interrupt commands still running
+	service.tasksLock.Lock()
+	service.recoveredCommands = service.recoverRemoteCommands()
+	service.tasksLock.Unlock()
+	service.startTasks()
+	service.notifyReady()
+	supervisorCtx, stopSupervisor := context.WithCancel(context.Background())
+	service.stopSupervisor = stopSupervisor
+	go service.superviseSystemd(supervisorCtx)
+}
+
+func (service *AgentServiceWrap) buildTasks() []*helpers.Task {
+	tasks := make([]*helpers.Task, 0)
+	tasks = append(tasks, &helpers.Task{Name: "HttpServer", Run: func(ctx context.Context) error {
 		handler := http.NewServeMux()
-		handler.HandleFunc("/proxy/", service.ProxyRoute())
-		handler.HandleFunc("/log", service.LogRoute())
-		handler.HandleFunc("/app/check", service.AppCheckRoute())
-		handler.HandleFunc("/app/update", service.AppUpdateRoute())
-		log.Log.Info().Msgf("Http server started on port %s", service.Settings.HttpPort)
-		return http.ListenAndServe(service.Settings.HttpPort, handler)
-	}, nil))
-	rpcListener, _ := net.Listen("tcp", service.Settings.RpcPort)
-	service.tasks = append(service.tasks, helpers.NewAgentTask("RpcServer", 0, func() error {
-
-		log.Log.Info().Msgf("Rpc server started on port %s", service.Settings.RpcPort)
-		rpc.Accept(rpcListener)
-		return nil
-	}, func() {
-		err := rpcListener.Close()
+		appKey := func(req *http.Request) string { return req.URL.Query().Get("ext_key") }
+		handler.HandleFunc("/proxy/", service.guard(RouteGroupProxy, false, nil,
+			instrumentProxy(service.ProxyRoute())))
+		handler.HandleFunc("/log", service.guard(RouteGroupLog, true, nil, service.LogRoute()))
+		handler.HandleFunc("/app/check", service.guard(RouteGroupApp, true, appKey, service.AppCheckRoute()))
+		handler.HandleFunc("/app/update", service.guard(RouteGroupApp, true, appKey, service.AppUpdateRoute()))
+		handler.HandleFunc("/metrics", service.guard(RouteGroupMetrics, false, nil, metrics.Default.Handler()))
+		handler.HandleFunc("/v1/status", service.guard(RouteGroupApi, false, nil, service.StatusRoute()))
+		handler.HandleFunc("/v1/packages", service.guard(RouteGroupApi, false, nil, service.PackagesRoute()))
+		handler.HandleFunc("/v1/packages/", service.guard(RouteGroupApi, false, nil, service.PackageRoute()))
+		handler.HandleFunc("/v1/software/", service.guard(RouteGroupApi, false, nil, service.SoftwareRoute()))
+		handler.HandleFunc("/v1/openapi.json", service.guard(RouteGroupApi, false, nil, service.OpenApiRoute()))
+		return service.serveHttp(ctx, handler)
+	}})
+	tasks = append(tasks, &helpers.Task{Name: "ConfigWatcher", Run: service.watchConfig})
+	tasks = append(tasks, &helpers.Task{Name: "RpcServer", Run: func(ctx context.Context) error {
+		socketListener, err := helpers.ListenUnixSocket(service.Settings.RpcSocket, 0600)
 		if err != nil {
-			return
+			return fmt.Errorf("can't listen control socket %s: %w", service.Settings.RpcSocket, err)
+		}
+		closeOnDone(ctx, socketListener)
+		log.Log.Info().Msgf("Rpc server started on %s", service.Settings.RpcSocket)
+		err = service.controlServer.Serve(&helpers.PeerCredListener{Listener: socketListener, AllowedUids: []uint32{0}})
+		if ctx.Err() != nil {
+			return nil
 		}
-	}))
+		return err
+	}})
+	if service.Settings.RpcTcpEnabled {
+		tasks = append(tasks, &helpers.Task{Name: "RpcTcpServer", Run: func(ctx context.Context) error {
+			tcpListener, err := net.Listen("tcp", service.Settings.RpcPort)
+			if err != nil {
+				return fmt.Errorf("can't listen rpc port %s: %w", service.Settings.RpcPort, err)
+			}
+			closeOnDone(ctx, tcpListener)
+			log.Log.Warn().Msgf("Read only rpc server started on port %s, it is reachable from network", service.Settings.RpcPort)
+			err = service.newReadOnlyControlServer().Serve(tcpListener)
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}})
+	}
 	if service.Settings.RemoteCommandsEnabled {
-		service.tasks = append(service.tasks,
-			helpers.NewAgentTask("AutoFetchCommands",
-				time.Duration(service.Settings.CommandsTimeout)*time.Second,
-				WithLock(service.lock, func() error {
-					cmd := service.ApiClient.GetCommand()
-					if cmd != nil {
-						service.CommandId = &cmd.ID
-						cmdErr := SelectCommand(strings.Split(cmd.Command, " "), &service.Agent)
-						service.CommandId = nil
-						return cmdErr
+		if service.Settings.CommandsSocketEnabled {
+			tasks = append(tasks, &helpers.Task{Name: "CommandsSocket",
+				Run:    service.commands.Listen,
+				OnStop: service.commands.Close,
+			})
+		}
+		tasks = append(tasks, &helpers.Task{Name: "CommandsWorker", Run: func(ctx context.Context) error {
+			for _, cmd := range service.takeRecoveredCommands() {
+				service.execRemoteCommand(cmd)
+			}
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case cmd := <-service.commands.Queue:
+					service.execRemoteCommand(cmd)
+				}
+				if len(service.commands.Queue) == 0 && service.commands.Overflowed() {
+					for _, cmd := range service.receivedRemoteCommands() {
+						service.execRemoteCommand(cmd)
 					}
+				}
+			}
+		}})
+		tasks = append(tasks, &helpers.Task{Name: "AutoResultPost", Every: 10 * time.Second,
+			Deadline: periodicTaskDeadline,
+			Run: helpers.WithoutContext(func() error {
+				service.postCommandResults()
+				return nil
+			}),
+		})
+		tasks = append(tasks, &helpers.Task{Name: "AutoFetchCommands",
+			Every:    time.Duration(service.Settings.CommandsTimeout) * time.Second,
+			Jitter:   0.1,
+			Deadline: periodicTaskDeadline,
+			Run: helpers.WithoutContext(func() error {
+				if service.commands.Connected() {
+					log.Log.Debug().Str("Task", "AutoFetchCommands").Msg("Websocket is alive, skip polling")
 					return nil
-				},
-				), nil,
-			),
-		)
-	}
-	service.tasks = append(service.tasks, helpers.NewAgentTask("AutoLogPost", 10*time.Second, func() error {
-		buffer := service.FilesGetLogsBuffer()
-		if buffer == nil {
-			log.Log.Info().Str("Task", "AutoLogPost").Msg("Log buffer is empty, skip task")
-			return nil
-		}
-		if len(buffer.Logs) == 0 {
-			log.Log.Info().Str("Task", "AutoLogPost").Msg("Log buffer is empty, skip task")
+				}
+				service.commands.Offer(service.ApiClient.GetCommand())
+				return nil
+			}),
+		})
+	}
+	if service.Settings.HeartbeatTimeout > 0 {
+		tasks = append(tasks, &helpers.Task{Name: "Heartbeat",
+			Every:    time.Duration(service.Settings.HeartbeatTimeout) * time.Second,
+			Jitter:   0.1,
+			Deadline: periodicTaskDeadline,
+			Run:      helpers.WithoutContext(service.sendHeartbeat),
+		})
+	}
+	if service.Settings.HealthCheckTimeout > 0 {
+		tasks = append(tasks, &helpers.Task{Name: "HealthCheck",
+			Every:    time.Duration(service.Settings.HealthCheckTimeout) * time.Second,
+			Jitter:   0.1,
+			Deadline: periodicTaskDeadline,
+			Run:      helpers.WithoutContext(service.checkHealth),
+		})
+	}
+	// maintenance windows start on minute boundary, so task follows cron instead of interval
+	tasks = append(tasks, &helpers.Task{Name: "AutoMaintenance", Cron: "* * * * *",
+		Run: helpers.WithoutContext(service.applyMaintenance),
+	})
+	tasks = append(tasks, &helpers.Task{Name: "AutoLogPost", Every: 10 * time.Second,
+		Deadline: periodicTaskDeadline,
+		Run: helpers.WithoutContext(func() error {
+			buffer := service.FilesGetLogsBuffer()
+			if buffer == nil {
+				log.Log.Info().Str("Task", "AutoLogPost").Msg("Log buffer is empty, skip task")
+				return nil
+			}
+			if len(buffer.Logs) == 0 {
+				log.Log.Info().Str("Task", "AutoLogPost").Msg("Log buffer is empty, skip task")
+				return nil
+			}
+			if service.ApiClient.PostLogData(buffer.Logs) {
+				clearErr := service.FilesClearLogsBuffer()
+				if clearErr != nil {
+					return clearErr
+				}
+			}
 			return nil
-		}
-		if service.ApiClient.PostLogData(buffer.Logs) {
-			clearErr := service.FilesClearLogsBuffer()
-			if clearErr != nil {
-				return clearErr
+		}),
+	})
+	return tasks
+}
+
+// OnServiceStop stops tasks without waiting for lock, running operations get shutdown timeout to finish
+func (service *AgentServiceWrap) OnServiceStop() {
+	_, _ = helpers.SdNotify(helpers.SdStopping)
+	if service.stopSupervisor != nil {
+		service.stopSupervisor()
+	}
+	service.stopTasks()
+	service.fileLock.Unlock()
+}
+
+// receiveRemoteCommand journals command before execution, same command id is never accepted twice
+func (service *AgentServiceWrap) receiveRemoteCommand(cmd *structs.RestCommandGet) bool {
+	err := service.FilesReceiveCommand(cmd)
+	if err != nil {
+		log.Log.Warn().Err(err).Int("CommandId", cmd.ID).Msg("Remote command skipped")
+		return false
+	}
+	return true
+}
+
+// recoverRemoteCommands marks commands running at service stop as interrupted
+// and returns received but not started commands to run them again
+func (service *AgentServiceWrap) recoverRemoteCommands() []*structs.RestCommandGet {
+	pending := make([]*structs.RestCommandGet, 0)
+	err := service.FilesUpdateCommandsHistory(func(history *CommandsHistoryFile) error {
+		for _, record := range history.Records {
+			switch record.Result.Status {
+			case structs.CommandRunning:
+				log.Log.Warn().Int("CommandId", record.Result.CmdTriggerId).Msg("Remote command was interrupted")
+				record.Result.Status = structs.CommandInterrupted
+				record.Result.ExitStatus = 1
+				record.Result.Error = "interrupted by agent restart"
+				record.Result.FinishedAt = time.Now()
+			case structs.CommandReceived:
+				log.Log.Info().Int("CommandId", record.Result.CmdTriggerId).Msg("Resume remote command")
+				pending = append(pending, &structs.RestCommandGet{
+					ID:      record.Result.CmdTriggerId,
+					Command: record.Result.Command,
+				})
 			}
 		}
 		return nil
-	}, nil))
-	service.startTasks()
+	})
+	if err != nil {
+		log.Log.Error().Err(err).Msg("Can't recover remote commands")
+	}
+	return pending
 }
 
-func (service *AgentServiceWrap) OnServiceStop() {
-	WithLock(service.lock, func() error {
-		service.stopTasks()
-		return nil
+// receivedRemoteCommands returns journaled commands which are not started yet
+func (service *AgentServiceWrap) receivedRemoteCommands() []*structs.RestCommandGet {
+	received := make([]*structs.RestCommandGet, 0)
+	history := service.FilesGetCommandsHistory()
+	if history == nil {
+		return received
+	}
+	for _, record := range history.Records {
+		if record.Result.Status == structs.CommandReceived {
+			received = append(received, &structs.RestCommandGet{ID: record.Result.CmdTriggerId, Command: record.Result.Command})
+		}
+	}
+	return received
+}
+
+func (service *AgentServiceWrap) takeRecoveredCommands() []*structs.RestCommandGet {
+	service.tasksLock.Lock()
+	defer service.tasksLock.Unlock()
+	recovered := service.recoveredCommands
+	service.recoveredCommands = nil
+	return recovered
+}
+
+// execRemoteCommand checks command against policy, runs it and reports its result
+func (service *AgentServiceWrap) execRemoteCommand(cmd *structs.RestCommandGet) {
+	log.Log.Info().Int("CommandId", cmd.ID).Msgf("Run remote command: %s", cmd.Command)
+	result := &structs.RestCommandResultPost{CmdTriggerId: cmd.ID, Command: cmd.Command}
+	args := strings.Fields(cmd.Command)
+	rule, policyErr := service.checkCommandPolicy(args)
+	var startErr error
+	if policyErr != nil {
+		log.Log.Warn().Err(policyErr).Int("CommandId", cmd.ID).Msg("Remote command rejected")
+		result.Status = structs.CommandRejected
+		result.ExitStatus = 126
+		result.Error = policyErr.Error()
+		result.StartedAt = time.Now()
+		result.FinishedAt = result.StartedAt
+		startErr = service.FilesStartCommandRecord(result)
+	} else {
+		startErr = service.runRemoteCommand(cmd, args, rule, result)
+	}
+	if errors.Is(startErr, ErrCommandNotReceived) {
+		log.Log.Warn().Err(startErr).Int("CommandId", cmd.ID).Msg("Remote command skipped")
+		return
+	}
+	// label is command of policy rule, args are given by server and would make unbounded labels
+	commandName := "other"
+	if rule != nil {
+		commandName = rule.Command
+	}
+	metricRemoteCommands.Inc(commandName, result.Status)
+	storeErr := service.FilesStoreCommandRecord(&CommandRecord{Result: result})
+	if storeErr != nil {
+		log.Log.Error().Err(storeErr).Int("CommandId", cmd.ID).Msg("Can't store command result")
+	}
+	service.postCommandResults()
+}
+
+// runRemoteCommand waits for service lock and runs command with log capture,
+// returns ErrCommandNotReceived when command was already started
+func (service *AgentServiceWrap) runRemoteCommand(cmd *structs.RestCommandGet, args []string,
+	rule *CommandRule, result *structs.RestCommandResultPost) error {
+	run := WithLock(service.lock, func() error {
+		service.CommandId = &cmd.ID
+		defer func() { service.CommandId = nil }()
+		result.StartedAt = time.Now()
+		result.Status = structs.CommandRunning
+		running := *result
+		startErr := service.FilesStartCommandRecord(&running)
+		if startErr != nil {
+			return startErr
+		}
+		stopCapture := log.Capture()
+		cmdErr := service.selectCommand(args, rule.ImpliesConfirm)
+		result.FinishedAt = time.Now()
+		result.Logs = stopCapture()
+		return cmdErr
 	})
+	err := run()
+	for errors.Is(err, ErrLockBusy) {
+		time.Sleep(time.Second)
+		err = run()
+	}
+	if errors.Is(err, ErrCommandNotReceived) {
+		return err
+	}
+	result.Status = structs.CommandDone
+	for _, line := range result.Logs {
+		if line["level"] == "error" || line["level"] == "fatal" {
+			result.Status = structs.CommandFailed
+			result.ExitStatus = 1
+		}
+	}
+	if err != nil {
+		log.Log.Error().Err(err).Int("CommandId", cmd.ID).Msg("Remote command failed")
+		result.Status = structs.CommandFailed
+		result.ExitStatus = 1
+		result.Error = err.Error()
+	}
+	return nil
 }
 
-func (service *AgentServiceWrap) ProxyRoute() func(w http.ResponseWriter, req *http.Request) {
-	return func(w http.ResponseWriter, req *http.Request) {
-		u, _ := url.Parse(fmt.Sprintf("http://%s%s",
-			service.Settings.NetInfo.ControlIp,
-			service.Settings.NetInfo.ControlPort))
-		log.Log.Debug().Msgf("Proxy request %s  to %s", req.URL.Path, u.String())
-		proxy := httputil.NewSingleHostReverseProxy(u)
-		modifyRequest := func(req *http.Request) {
-			if !service.Settings.NetInfo.AsProxy {
-				req.URL.Path = strings.Split(req.URL.Path, "proxy")[1]
-			}
-			if strings.Contains(req.URL.Path, "reg") {
-				var oldBody structs.RestRegPost
-				bodyBytes, _ := io.ReadAll(req.Body)
-				httpErr := req.Body.Close()
-				if httpErr != nil {
-					log.Log.Error().Err(httpErr).Str("Proxy", "body close fails").Msgf(req.URL.String())
-					return
-				}
-				httpErr = json.NewDecoder(bytes.NewReader(bodyBytes)).Decode(&oldBody)
-				if httpErr != nil {
-					log.Log.Error().Err(httpErr).Str("Json", "decode fails").Msgf(req.URL.String())
-					return
-				}
-				if oldBody.ProxyInfo != nil {
-					maxKey := 0
-					for key, _ := range oldBody.ProxyInfo {
-						if key > maxKey {
-							maxKey = key
-						}
-					}
-					oldBody.ProxyInfo[maxKey+1] = service.Settings.SECRET
-				} else {
-					oldBody.ProxyInfo = map[int]string{0: service.Settings.SECRET}
-				}
-				newBody, _ := json.Marshal(oldBody)
-				req.Body = io.NopCloser(bytes.NewReader(newBody))
-				req.ContentLength = int64(len(newBody))
-			}
+// checkCommandPolicy reads policy file on every command, so policy changes apply without restart
+func (service *AgentServiceWrap) checkCommandPolicy(args []string) (*CommandRule, error) {
+	policy, err := LoadCommandsPolicy(service.Settings.CommandsPolicyPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: can't load policy: %s", ErrCommandDenied, err.Error())
+	}
+	return policy.Check(args)
+}
+
+// postCommandResults sends every not acknowledged command result to control server
+func (service *AgentServiceWrap) postCommandResults() {
+	service.resultsLock.Lock()
+	defer service.resultsLock.Unlock()
+	history := service.FilesGetCommandsHistory()
+	if history == nil {
+		return
+	}
+	for _, record := range history.Records {
+		if record.Acknowledged || !record.Finished() {
+			continue
+		}
+		if !service.ApiClient.PostCommandResult(record.Result) {
+			log.Log.Warn().Int("CommandId", record.Result.CmdTriggerId).Msg("Command result not acknowledged, retry later")
+			return
 		}
-		originalDirector := proxy.Director
-		proxy.Director = func(req *http.Request) {
-			originalDirector(req)
-			modifyRequest(req)
+		ackErr := service.FilesAckCommandRecord(record.Result.CmdTriggerId)
+		if ackErr != nil {
+			log.Log.Error().Err(ackErr).Int("CommandId", record.Result.CmdTriggerId).Msg("Can't mark command result")
 		}
-		proxy.ServeHTTP(w, req)
 	}
 }
 
+// openShellSession starts remote shell requested by control server, sessions do not hold service lock
+func (service *AgentServiceWrap) openShellSession(session *structs.RestShellSessionGet) {
+	err := service.RemoteShellProcess(session)
+	if err != nil {
+		log.Log.Error().Err(err).Int("SessionId", session.ID).Msg("Remote shell session failed")
+	}
+}
+
+// ProxyRoute relays requests of downstream agents to upstream, see relay.go
+func (service *AgentServiceWrap) ProxyRoute() func(w http.ResponseWriter, req *http.Request) {
+	return newRelay(service).ServeHTTP
+}
+
 func (service *AgentServiceWrap) LogRoute() func(w http.ResponseWriter, req *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		var logData structs.RestLogPost
@@ -366,7 +697,7 @@ func (upd *AgentUpdateWrap) SelfUpdateProcess() {
 		oldAgentSoftware.Version = PcaVersion
 		log.Log.Info().Msgf("Update Agent,%s", VersionStringColor(&oldAgentSoftware, software))
 		if software.Changelog != nil {
-			log.Log.Info().Msgf("ChangeLog: %s", software.Changelog)
+			log.Log.Info().Msgf("ChangeLog: %s", *software.Changelog)
 		}
 		apply := AskConfirm(ForceCmd)
 		if !apply {
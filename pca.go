@@ -9,15 +9,13 @@ import (
 func main() {
 	//lib.HandleRoot()
 	lib.FindPackageSystem()
-	lib.ConfigurePaths()
+	lib.ConfigurePaths(os.Args[1:])
 	settings := lib.LoadSettings()
 	log.Log.Debug().Msgf("Use package manager: %s", lib.RunPkgManager)
-	log.Log.Debug().Msgf("Agent path is %s", "/opt/abt/pca")
+	log.Log.Debug().Msgf("Agent path is %s", lib.HomePath)
 	apiClient := lib.NewRestClient(settings)
-	rpcClient := lib.CreateRpcConn()
+	rpcClient := lib.CreateRpcConn(settings)
 	agent := lib.NewAgent(settings, apiClient, rpcClient)
 	err := lib.SelectCommand(os.Args[1:], agent)
-	if err != nil {
-		log.Log.Error().Err(err)
-	}
+	lib.Commander.FatalIfError(err, "")
 }